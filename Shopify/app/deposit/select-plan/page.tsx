@@ -126,7 +126,9 @@ function DepositPlanSelectionContent() {
 
         // Fetch cart total
         if (cartId) {
-          const cartResponse = await apiClient.get<GatewayResponse<{ cartId: string; cart: any }>>(`/api/gw/v1/cart?cartId=${cartId}`);
+          const cartResponse = await apiClient.get<GatewayResponse<{ cartId: string; cart: any }>>(`/api/gw/v1/cart?cartId=${cartId}`, {
+            headers: useCartStore.getState().getCartHeaders(),
+          });
           
           // Handle apiClient error
           if (cartResponse.error) {
@@ -222,12 +224,14 @@ function DepositPlanSelectionContent() {
 
     try {
       const response = await apiClient.post<GatewayResponse<{ 
-        session_id: string; 
-        checkout_url?: string;
-        deposit_session_url?: string;
+        sessionId: string; 
+        checkoutUrl?: string;
+        depositSessionUrl?: string;
       }>>('/api/gw/v1/deposit-sessions', {
         cartId,
-        plan_id: selectedPlan.id
+        planId: selectedPlan.id
+      }, {
+        headers: useCartStore.getState().getCartHeaders(),
       });
 
       // Debug logging
@@ -250,11 +254,11 @@ function DepositPlanSelectionContent() {
       // The gateway envelope is { data: {...}, error: null }
       // So response.data is the gateway envelope
       const gatewayResponse = response.data as GatewayResponse<{ 
-        session_id: string; 
-        checkout_url?: string;
-        deposit_session_url?: string;
-        draft_order_ids?: string[];
-        payment_amounts?: number[];
+        sessionId: string; 
+        checkoutUrl?: string;
+        depositSessionUrl?: string;
+        draftOrderIds?: string[];
+        paymentAmounts?: { amount: string; currencyCode: string }[];
       }> | undefined;
 
       // Debug logging
@@ -278,7 +282,7 @@ function DepositPlanSelectionContent() {
       // Extract data from gateway envelope
       // If gatewayResponse.data exists, use it; otherwise, try response.data directly (in case gateway returns data directly)
       let data = gatewayResponse?.data;
-      if (!data && response.data && typeof response.data === 'object' && 'session_id' in response.data) {
+      if (!data && response.data && typeof response.data === 'object' && 'sessionId' in response.data) {
         // Gateway might have returned data directly without envelope
         data = response.data as any;
       }
@@ -289,11 +293,13 @@ function DepositPlanSelectionContent() {
       }
       
       // Redirect to checkout URL if available, otherwise show success message
-      if (data.checkout_url) {
-        window.location.href = data.checkout_url;
-      } else if (data.session_id) {
-        // Fallback: redirect to deposit session page
-        router.push(`/deposit-session/${data.session_id}`);
+      if (data.checkoutUrl) {
+        window.location.href = data.checkoutUrl;
+      } else if (data.depositSessionUrl) {
+        // Fallback: redirect to deposit session page (the URL carries the session token)
+        router.push(data.depositSessionUrl);
+      } else if (data.sessionId) {
+        router.push(`/deposit-session/${data.sessionId}`);
       } else {
         throw new Error('No checkout URL or session ID returned');
       }
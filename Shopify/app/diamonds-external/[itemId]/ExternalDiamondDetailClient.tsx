@@ -67,6 +67,7 @@ export default function ExternalDiamondDetailClient({
       await addToCart({
         source: 'external',
         externalId,
+        collection,
         title: product.title || diamond.title,
         imageUrl,
         price: {
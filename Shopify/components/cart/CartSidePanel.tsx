@@ -157,7 +157,8 @@ export default function CartSidePanel({ isOpen, onClose }: CartSidePanelProps) {
       // apiClient wraps it as: { data: { data: { checkoutUrl }, error: {...} }, error: ... }
       const response = await apiClient.post<GatewayResponse<{ checkoutUrl: string }>>(
         '/api/gw/v1/cart/checkout',
-        { cartId }
+        { cartId },
+        { headers: useCartStore.getState().getCartHeaders() }
       );
 
       // Handle apiClient error (from axios/network)
@@ -7,6 +7,9 @@ import { AddToCartInput } from '@/types/hook.types';
 import { apiClient } from '@/services/api-client';
 
 const CART_ID_KEY = 'internal_cart_id';
+// Token proving possession of an anonymous cart, returned by the gateway as
+// cartToken and sent back as X-Cart-Token
+const CART_TOKEN_KEY = 'internal_cart_token';
 
 interface CartState {
   cart: Cart | null;
@@ -18,6 +21,8 @@ interface CartState {
   getCartId: () => string | null;
   saveCartId: (cartId: string) => void;
   clearCartId: () => void;
+  saveCartToken: (cartToken: string) => void;
+  getCartHeaders: () => Record<string, string>;
   getCart: () => Promise<void>;
   addToCart: (input: AddToCartInput) => Promise<void>;
   updateQuantity: (lineId: string, quantity: number) => Promise<void>;
@@ -57,6 +62,18 @@ export const useCartStore = create<CartState>()(
       clearCartId: () => {
         if (typeof window === 'undefined') return;
         localStorage.removeItem(CART_ID_KEY);
+        localStorage.removeItem(CART_TOKEN_KEY);
+      },
+
+      saveCartToken: (cartToken: string) => {
+        if (typeof window === 'undefined') return;
+        localStorage.setItem(CART_TOKEN_KEY, cartToken);
+      },
+
+      getCartHeaders: (): Record<string, string> => {
+        if (typeof window === 'undefined') return {};
+        const cartToken = localStorage.getItem(CART_TOKEN_KEY);
+        return cartToken ? { 'X-Cart-Token': cartToken } : {};
       },
 
       setCart: (cart: Cart | null) => {
@@ -119,7 +136,9 @@ export const useCartStore = create<CartState>()(
         try {
           // Gateway endpoint returns: { data: { cartId, cart }, error: {...} }
           // apiClient wraps it as: { data: { data: { cartId, cart }, error: {...} }, error: ... }
-          const response = await apiClient.get<GatewayResponse<{ cartId: string; cart: Cart }>>(`/api/gw/v1/cart?cartId=${encodeURIComponent(cartId)}`);
+          const response = await apiClient.get<GatewayResponse<{ cartId: string; cart: Cart }>>(`/api/gw/v1/cart?cartId=${encodeURIComponent(cartId)}`, {
+            headers: get().getCartHeaders(),
+          });
 
           // Handle apiClient error (network, timeout, etc.)
           if (response.error) {
@@ -192,11 +211,27 @@ export const useCartStore = create<CartState>()(
             });
           }
 
+          // External items are priced by a signed quote from the gateway;
+          // without one (quotes disabled) the item is added as before
+          const { collection, quote: inputQuote, ...item } = input;
+          let quote = inputQuote;
+          if (item.source === 'external' && !quote && item.externalId) {
+            const quoteResponse = await apiClient.post<GatewayResponse<{ quote: string }>>('/api/gw/v1/cart/quotes', {
+              externalId: item.externalId,
+              collection,
+            });
+            const quoteEnvelope = quoteResponse.data as GatewayResponse<{ quote: string }> | undefined;
+            quote = quoteEnvelope?.data?.quote;
+          }
+
           // Gateway endpoint returns: { data: { cartId, cart }, error: {...} }
           // apiClient wraps it as: { data: { data: { cartId, cart }, error: {...} }, error: ... }
-          const response = await apiClient.post<GatewayResponse<{ cartId: string; cart: Cart }>>('/api/gw/v1/cart/items', {
+          const response = await apiClient.post<GatewayResponse<{ cartId: string; cart: Cart; cartToken?: string }>>('/api/gw/v1/cart/items', {
             cartId: cartId || undefined,
-            ...input,
+            ...item,
+            quote,
+          }, {
+            headers: cartId ? get().getCartHeaders() : {},
           });
           
           // Debug logging for response
@@ -219,7 +254,10 @@ export const useCartStore = create<CartState>()(
           }
 
           // response.data is the gateway envelope: { data: {...}, error: {...} }
-          const gatewayResponse = response.data as GatewayResponse<{ cartId: string; cart: Cart }> | undefined;
+          const gatewayResponse = response.data as GatewayResponse<{ cartId: string; cart: Cart; cartToken?: string }> | undefined;
+          if (gatewayResponse?.data?.cartToken) {
+            get().saveCartToken(gatewayResponse.data.cartToken);
+          }
 
           // Handle gateway error
           if (gatewayResponse?.error) {
@@ -286,6 +324,7 @@ export const useCartStore = create<CartState>()(
           // apiClient wraps it as: { data: { data: { cartId, cart }, error: {...} }, error: ... }
           const response = await apiClient.request<GatewayResponse<{ cartId: string; cart: Cart }>>('/api/gw/v1/cart/items', {
             method: 'PUT',
+            headers: get().getCartHeaders(),
             body: { cartId, lineId, quantity },
           });
 
@@ -334,6 +373,7 @@ export const useCartStore = create<CartState>()(
           // apiClient wraps it as: { data: { data: { cartId, cart }, error: {...} }, error: ... }
           const response = await apiClient.request<GatewayResponse<{ cartId: string; cart: Cart }>>('/api/gw/v1/cart/items', {
             method: 'DELETE',
+            headers: get().getCartHeaders(),
             body: { cartId, lineId },
           });
 
@@ -14,6 +14,9 @@ export interface AddToCartInput {
   attributes?: Array<{ key: string; value: string }>;
   productHandle?: string;
   payload?: Record<string, any>;
+  // External items: catalog collection to quote the price from, or a quote already issued
+  collection?: 'natural' | 'labgrown';
+  quote?: string;
 }
 import { DiamondFilters, JewelryFilters } from './filter.types';
 
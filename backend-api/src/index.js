@@ -99,6 +99,7 @@ app.use((req, res) => {
       'POST /api/v1/cart/items',
       'PUT /api/v1/cart/items',
       'DELETE /api/v1/cart/items',
+      'POST /api/v1/cart/merge',
       'POST /api/v1/cart/checkout',
       'GET /api/v1/deposit-sessions/:sessionId',
       'POST /api/v1/deposit-sessions',
@@ -177,5 +177,31 @@ router.delete('/items', async (req, res, next) => {
   }
 });
 
+// POST /api/v1/cart/merge - Merge an anonymous cart into a customer's cart
+router.post('/merge', async (req, res, next) => {
+  try {
+    const { sourceCartId, targetCartId, customerId } = req.body;
+    
+    if (!sourceCartId || !customerId) {
+      return res.status(400).json({
+        code: 'VALIDATION_ERROR',
+        message: 'sourceCartId and customerId are required'
+      });
+    }
+    
+    const cart = await cartService.mergeCarts(sourceCartId, targetCartId || null, String(customerId));
+    res.json(cart);
+  } catch (error) {
+    if (error.code === 'CART_NOT_FOUND') {
+      res.status(404).json({
+        code: error.code,
+        message: error.message
+      });
+    } else {
+      next(error);
+    }
+  }
+});
+
 module.exports = router;
 
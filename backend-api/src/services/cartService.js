@@ -408,6 +408,120 @@ class CartService {
       client.release();
     }
   }
+  
+  // Merge an anonymous cart into a customer's cart at login. Without a target
+  // cart, the source cart itself is bound to the customer.
+  async mergeCarts(sourceCartId, targetCartId, customerId) {
+    if (!pool) {
+      throw { code: 'DATABASE_NOT_CONFIGURED', message: 'Database connection not configured.' };
+    }
+    const client = await pool.connect();
+    
+    try {
+      await client.query('BEGIN');
+      
+      const cartIds = targetCartId ? [sourceCartId, targetCartId] : [sourceCartId];
+      const cartsResult = await client.query(
+        `SELECT id FROM carts WHERE id = ANY($1) FOR UPDATE`,
+        [cartIds]
+      );
+      if (!cartsResult.rows.some(row => row.id === sourceCartId)) {
+        throw { code: 'CART_NOT_FOUND', message: 'Cart not found' };
+      }
+      
+      let cartId = sourceCartId;
+      if (targetCartId && targetCartId !== sourceCartId) {
+        cartId = targetCartId;
+        
+        // Create the customer cart if it no longer exists
+        await client.query(
+          `INSERT INTO carts (id, customer_id, total_quantity, status, created_at, updated_at)
+           VALUES ($1, $2, 0, 'active', NOW(), NOW())
+           ON CONFLICT (id) DO NOTHING`,
+          [targetCartId, customerId]
+        );
+        
+        // External items are unique per cart: fold duplicates into the existing line
+        const duplicates = await client.query(
+          `SELECT s.id AS source_line_id, t.id AS target_line_id, s.quantity
+           FROM cart_items s
+           JOIN cart_items t ON t.cart_id = $2 AND t.source = 'external' AND t.external_id = s.external_id
+           WHERE s.cart_id = $1 AND s.source = 'external'`,
+          [sourceCartId, targetCartId]
+        );
+        for (const row of duplicates.rows) {
+          await client.query(
+            `UPDATE cart_items SET quantity = quantity + $1, updated_at = NOW() WHERE id = $2`,
+            [row.quantity, row.target_line_id]
+          );
+          await client.query(`DELETE FROM cart_items WHERE id = $1`, [row.source_line_id]);
+        }
+        
+        await client.query(
+          `UPDATE cart_items SET cart_id = $1, updated_at = NOW() WHERE cart_id = $2`,
+          [targetCartId, sourceCartId]
+        );
+        await this.updateCartTotals(client, sourceCartId, { status: 'merged' });
+      }
+      
+      await client.query(
+        `UPDATE carts SET customer_id = $1, updated_at = NOW() WHERE id = ANY($2)`,
+        [customerId, cartIds]
+      );
+      await this.updateCartTotals(client, cartId);
+      
+      await client.query('COMMIT');
+      
+      return await this.getCart(cartId);
+    } catch (error) {
+      await client.query('ROLLBACK');
+      throw error;
+    } finally {
+      client.release();
+    }
+  }
+  
+  // Recalculate cart totals (quantity and amount) from its items
+  async updateCartTotals(client, cartId, { status } = {}) {
+    const totalsResult = await client.query(
+      `SELECT 
+        COALESCE(SUM(quantity), 0) as total_quantity,
+        COALESCE(SUM(price_amount * quantity), 0) as total_amount
+       FROM cart_items WHERE cart_id = $1`,
+      [cartId]
+    );
+    const totalQuantity = parseInt(totalsResult.rows[0].total_quantity);
+    const totalAmount = parseFloat(totalsResult.rows[0].total_amount);
+    
+    // Check if total_amount column exists
+    const columnCheck = await client.query(
+      `SELECT column_name 
+       FROM information_schema.columns 
+       WHERE table_name = 'carts' AND column_name = 'total_amount'`
+    );
+    const hasTotalAmount = columnCheck.rows.length > 0;
+    
+    const updateColumns = ['total_quantity = $1', 'updated_at = NOW()'];
+    const updateValues = [totalQuantity];
+    let updateParamIndex = 2;
+    
+    if (hasTotalAmount) {
+      updateColumns.push(`total_amount = $${updateParamIndex}`);
+      updateValues.push(totalAmount);
+      updateParamIndex++;
+    }
+    
+    if (status) {
+      updateColumns.push(`status = $${updateParamIndex}`);
+      updateValues.push(status);
+      updateParamIndex++;
+    }
+    
+    await client.query(
+      `UPDATE carts SET ${updateColumns.join(', ')} WHERE id = $${updateParamIndex}`,
+      [...updateValues, cartId]
+    );
+  }
 }
 
 module.exports = new CartService();
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Name of the key created from the legacy API_KEY environment variable
+const legacyAPIKeyName = "default"
+
+// APIKeyConfig is one entry of the API key file. Only the SHA-256 of the key
+// is stored ("sha256:<hex>"); `gateway hash-key` generates keys and hashes.
+type APIKeyConfig struct {
+	Name       string     `json:"name"`
+	Hash       string     `json:"hash"`
+	Scopes     []string   `json:"scopes"`
+	Prefixes   []string   `json:"prefixes,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	AllowQuery bool       `json:"allow_query,omitempty"`
+}
+
+// apiKeyFile is the document stored in the API key file
+type apiKeyFile struct {
+	Keys []APIKeyConfig `json:"keys"`
+}
+
+// apiKey is a client credential with the scopes and route prefixes it may use
+type apiKey struct {
+	name       string
+	hash       []byte
+	scopes     []string
+	prefixes   []string
+	expiresAt  time.Time
+	allowQuery bool
+}
+
+// Authentication failures
+var (
+	errMissingAPIKey = errors.New("missing API key")
+	errInvalidAPIKey = errors.New("invalid API key")
+	errExpiredAPIKey = errors.New("API key expired")
+)
+
+// apiKeyStore holds the keys clients authenticate with. Keys come from the
+// file named in the configuration, which is re-read when it changes, plus
+// the legacy API_KEY.
+type apiKeyStore struct {
+	path   string
+	legacy *apiKey
+	keys   atomic.Pointer[[]*apiKey]
+}
+
+func newAPIKeyStore(cfg *APIKeysConfig, legacyKey string) (*apiKeyStore, error) {
+	s := &apiKeyStore{}
+	allowQuery := false
+	if cfg != nil {
+		s.path = cfg.File
+		allowQuery = cfg.LegacyAllowQuery
+	}
+	if legacyKey != "" {
+		sum := sha256.Sum256([]byte(legacyKey))
+		s.legacy = &apiKey{name: legacyAPIKeyName, hash: sum[:], scopes: []string{"*"}, allowQuery: allowQuery}
+		if allowQuery {
+			slog.Warn("API_KEY is accepted in the api_key query parameter; this is deprecated, send it in the X-API-Key header")
+		}
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// enabled reports whether any key exists; without keys authentication is off
+func (s *apiKeyStore) enabled() bool {
+	return s.legacy != nil || s.path != ""
+}
+
+// load reads the key file and replaces the active keys
+func (s *apiKeyStore) load() error {
+	var keys []*apiKey
+	if s.legacy != nil {
+		keys = append(keys, s.legacy)
+	}
+	if s.path != "" {
+		data, err := os.ReadFile(s.path)
+		if err != nil {
+			return fmt.Errorf("reading api keys %s: %w", s.path, err)
+		}
+		parsed, err := parseAPIKeys(data, filepath.Ext(s.path))
+		if err != nil {
+			return fmt.Errorf("loading api keys %s: %w", s.path, err)
+		}
+		keys = append(keys, parsed...)
+	}
+	s.keys.Store(&keys)
+	return nil
+}
+
+// watch re-reads the key file whenever it changes until stop is closed, so
+// keys can be issued and revoked without restarting the gateway
+func (s *apiKeyStore) watch(interval time.Duration, stop <-chan struct{}) {
+	if s.path == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		lastSum := fileChecksum(s.path)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				sum := fileChecksum(s.path)
+				if sum == lastSum {
+					continue
+				}
+				lastSum = sum
+				if err := s.load(); err != nil {
+					slog.Error("API key reload rejected, keeping current keys", "path", s.path, "error", err)
+					continue
+				}
+				slog.Info("API keys reloaded", "path", s.path, "keys", len(*s.keys.Load()))
+			}
+		}
+	}()
+}
+
+// parseAPIKeys decodes and validates a YAML or JSON key file
+func parseAPIKeys(data []byte, ext string) ([]*apiKey, error) {
+	var file apiKeyFile
+	if err := decodeDocument(data, ext, &file); err != nil {
+		return nil, fmt.Errorf("parsing api keys: %w", err)
+	}
+
+	names := map[string]bool{}
+	keys := make([]*apiKey, 0, len(file.Keys))
+	for i, kc := range file.Keys {
+		if kc.Name == "" {
+			return nil, fmt.Errorf("key #%d: name is required", i)
+		}
+		if names[kc.Name] {
+			return nil, fmt.Errorf("key %q: duplicate name", kc.Name)
+		}
+		names[kc.Name] = true
+
+		encoded, ok := strings.CutPrefix(kc.Hash, "sha256:")
+		hash, err := hex.DecodeString(encoded)
+		if !ok || err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("key %q: hash must be sha256:<64 hex digits>", kc.Name)
+		}
+		if len(kc.Scopes) == 0 {
+			return nil, fmt.Errorf("key %q: at least one scope is required", kc.Name)
+		}
+		for _, scope := range kc.Scopes {
+			if !validScope(scope) {
+				return nil, fmt.Errorf("key %q: invalid scope %q (want *, <resource>:read, <resource>:write or <resource>:*)", kc.Name, scope)
+			}
+		}
+		for _, prefix := range kc.Prefixes {
+			if !strings.HasPrefix(prefix, "/") {
+				return nil, fmt.Errorf("key %q: prefix %q must start with /", kc.Name, prefix)
+			}
+		}
+
+		key := &apiKey{
+			name:       kc.Name,
+			hash:       hash,
+			scopes:     kc.Scopes,
+			prefixes:   kc.Prefixes,
+			allowQuery: kc.AllowQuery,
+		}
+		if kc.ExpiresAt != nil {
+			key.expiresAt = *kc.ExpiresAt
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func validScope(scope string) bool {
+	if scope == "*" {
+		return true
+	}
+	resource, action, ok := strings.Cut(scope, ":")
+	return ok && resource != "" && (action == "read" || action == "write" || action == "*")
+}
+
+// authenticate returns the key matching the presented secret. Every stored
+// hash is compared in constant time so timing reveals nothing about which
+// keys exist.
+func (s *apiKeyStore) authenticate(presented string, fromQuery bool, now time.Time) (*apiKey, error) {
+	if presented == "" {
+		return nil, errMissingAPIKey
+	}
+	sum := sha256.Sum256([]byte(presented))
+
+	var match *apiKey
+	for _, key := range *s.keys.Load() {
+		if subtle.ConstantTimeCompare(sum[:], key.hash) == 1 {
+			match = key
+		}
+	}
+	switch {
+	case match == nil:
+		return nil, errInvalidAPIKey
+	case fromQuery && !match.allowQuery:
+		// Keys in URLs end up in logs and browser history
+		return nil, errInvalidAPIKey
+	case !match.expiresAt.IsZero() && now.After(match.expiresAt):
+		return nil, errExpiredAPIKey
+	}
+	return match, nil
+}
+
+// authorize checks that the key may call the route with the given method
+// and path. Routes declaring a scope require <scope>:read for safe methods
+// and <scope>:write for everything else.
+func (k *apiKey) authorize(route *compiledRoute, method, path string) error {
+	if len(k.prefixes) > 0 {
+		allowed := false
+		for _, prefix := range k.prefixes {
+			if strings.HasPrefix(path, prefix) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("API key %s is not allowed to access %s", k.name, path)
+		}
+	}
+
+	if route.Scope == "" {
+		return nil
+	}
+	required := route.Scope + ":write"
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		required = route.Scope + ":read"
+	}
+	for _, scope := range k.scopes {
+		if scope == "*" || scope == required || scope == route.Scope+":*" {
+			return nil
+		}
+	}
+	return fmt.Errorf("API key %s lacks scope %s", k.name, required)
+}
+
+// hashKeyCommand implements `gateway hash-key [key]`: it prints the hash to
+// put in the API key file for the given key, or for a newly generated one
+func hashKeyCommand(args []string, out io.Writer) error {
+	var key string
+	switch len(args) {
+	case 0:
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		key = "gw_" + base64.RawURLEncoding.EncodeToString(secret)
+		fmt.Fprintf(out, "key:  %s\n", key)
+	case 1:
+		key = args[0]
+	default:
+		return errors.New("usage: gateway hash-key [key]")
+	}
+	sum := sha256.Sum256([]byte(key))
+	fmt.Fprintf(out, "hash: sha256:%s\n", hex.EncodeToString(sum[:]))
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLegacyAPIKeyQueryParameter(t *testing.T) {
+	now := time.Now()
+
+	keys, err := newAPIKeyStore(nil, "legacy-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.authenticate("legacy-key", false, now); err != nil {
+		t.Fatalf("header key: %v", err)
+	}
+	if _, err := keys.authenticate("legacy-key", true, now); err != errInvalidAPIKey {
+		t.Fatalf("query key error = %v, want %v", err, errInvalidAPIKey)
+	}
+
+	keys, err = newAPIKeyStore(&APIKeysConfig{LegacyAllowQuery: true}, "legacy-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.authenticate("legacy-key", true, now); err != nil {
+		t.Fatalf("query key with legacy_allow_query: %v", err)
+	}
+}
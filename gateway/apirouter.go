@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Path parameter types usable in route templates as {name:type}
+var paramTypes = map[string]*regexp.Regexp{
+	"string": nil,
+	"int":    regexp.MustCompile(`^[0-9]+$`),
+	"uuid":   regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`),
+}
+
+// templateSegment is one "/"-separated part of a route template:
+// either a literal or a named parameter
+type templateSegment struct {
+	literal string
+	param   string
+	check   *regexp.Regexp
+}
+
+// apiRoute binds a method and path template such as
+// /deposit-sessions/{sessionId}/checkout to a handler
+type apiRoute struct {
+	method   string
+	template string
+	segments []templateSegment
+	handler  func(g *Gateway, w http.ResponseWriter, r *http.Request)
+
+	// operation documents the route when the router uses an OpenAPI spec
+	operation *openAPIOperation
+}
+
+// apiRouter dispatches requests on method and path template.
+// Literal segments take precedence over parameters regardless of
+// registration order, so /deposit-plans/default is never captured
+// by /deposit-plans/{planId}, and templates only match paths with the
+// same number of segments, so /cart can't shadow /cart/checkout.
+// With a spec, requests are validated against it before the handler runs.
+type apiRouter struct {
+	prefix string
+	routes []*apiRoute
+	spec   *openAPISpec
+}
+
+func newAPIRouter(prefix string) *apiRouter {
+	return &apiRouter{prefix: prefix}
+}
+
+// handle registers a route; it panics on malformed templates since the
+// table is defined in code
+func (ar *apiRouter) handle(method, template string, handler func(g *Gateway, w http.ResponseWriter, r *http.Request)) {
+	route := &apiRoute{method: method, template: template, handler: handler}
+	for _, part := range splitPath(template) {
+		if !strings.HasPrefix(part, "{") {
+			route.segments = append(route.segments, templateSegment{literal: part})
+			continue
+		}
+		name, typ, _ := strings.Cut(strings.Trim(part, "{}"), ":")
+		if typ == "" {
+			typ = "string"
+		}
+		check, ok := paramTypes[typ]
+		if !ok || name == "" {
+			panic(fmt.Sprintf("invalid route template %s", template))
+		}
+		route.segments = append(route.segments, templateSegment{param: name, check: check})
+	}
+	for _, existing := range ar.routes {
+		if existing.method == method && sameShape(existing.segments, route.segments) {
+			panic(fmt.Sprintf("route %s %s conflicts with %s", method, template, existing.template))
+		}
+	}
+	ar.routes = append(ar.routes, route)
+}
+
+// serveAPI dispatches to the matching route, or replies with a 404 or 405 envelope
+func (g *Gateway) serveAPI(ar *apiRouter, w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.EscapedPath(), ar.prefix)
+	parts := splitPath(path)
+	for i, part := range parts {
+		unescaped, err := url.PathUnescape(part)
+		if err != nil {
+			g.sendResponse(w, http.StatusBadRequest, nil, &ErrorInfo{
+				Code:    "VALIDATION_ERROR",
+				Message: "Malformed request path",
+			})
+			return
+		}
+		parts[i] = unescaped
+	}
+
+	// Find the most specific template matching the path, then the method
+	type candidate struct {
+		route  *apiRoute
+		params map[string]string
+	}
+	var best []candidate
+	for _, route := range ar.routes {
+		params, ok := route.match(parts)
+		if !ok {
+			continue
+		}
+		switch {
+		case best == nil || moreSpecific(route.segments, best[0].route.segments):
+			best = []candidate{{route, params}}
+		case sameShape(route.segments, best[0].route.segments):
+			best = append(best, candidate{route, params})
+		}
+	}
+
+	if best == nil {
+		g.sendResponse(w, http.StatusNotFound, nil, &ErrorInfo{
+			Code:    "NOT_FOUND",
+			Message: fmt.Sprintf("No API route for %s %s", r.Method, r.URL.Path),
+		})
+		return
+	}
+
+	var allowed []string
+	for _, c := range best {
+		if c.route.method == r.Method {
+			r = withPathParams(r, c.route.template, c.params)
+			spanFromContext(r.Context()).setRoute(ar.prefix + c.route.template)
+			setRequestAttr(r, "routeTemplate", ar.prefix+c.route.template)
+			if ar.spec != nil && !g.validateRequest(ar.spec, c.route.operation, w, r) {
+				return
+			}
+			c.route.handler(g, w, r)
+			return
+		}
+		allowed = append(allowed, c.route.method)
+	}
+
+	sort.Strings(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	g.sendResponse(w, http.StatusMethodNotAllowed, nil, &ErrorInfo{
+		Code:    "METHOD_NOT_ALLOWED",
+		Message: fmt.Sprintf("Method %s is not allowed for %s", r.Method, r.URL.Path),
+		Details: map[string]interface{}{"allowed": allowed},
+	})
+}
+
+// match reports whether the path segments fit the template and returns the captured parameters
+func (route *apiRoute) match(parts []string) (map[string]string, bool) {
+	if len(parts) != len(route.segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, seg := range route.segments {
+		if seg.param == "" {
+			if parts[i] != seg.literal {
+				return nil, false
+			}
+			continue
+		}
+		if parts[i] == "" || (seg.check != nil && !seg.check.MatchString(parts[i])) {
+			return nil, false
+		}
+		params[seg.param] = parts[i]
+	}
+	return params, true
+}
+
+// moreSpecific reports whether template a should win over b for the same path:
+// the first position where one has a literal and the other a parameter decides
+func moreSpecific(a, b []templateSegment) bool {
+	for i := range a {
+		if (a[i].param == "") != (b[i].param == "") {
+			return a[i].param == ""
+		}
+	}
+	return false
+}
+
+// sameShape reports whether two templates have literals and parameters in the same places
+func sameShape(a, b []templateSegment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if (a[i].param == "") != (b[i].param == "") || a[i].literal != b[i].literal {
+			return false
+		}
+	}
+	return true
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+type pathParamsContextKey struct{}
+
+type pathParams struct {
+	template string
+	values   map[string]string
+}
+
+func withPathParams(r *http.Request, template string, values map[string]string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), pathParamsContextKey{}, &pathParams{template: template, values: values}))
+}
+
+// pathParam returns a path parameter captured by the API router
+func pathParam(r *http.Request, name string) string {
+	if p, ok := r.Context().Value(pathParamsContextKey{}).(*pathParams); ok {
+		return p.values[name]
+	}
+	return ""
+}
+
+// routeTemplate returns the API route template matched for the request, if any
+func routeTemplate(r *http.Request) string {
+	if p, ok := r.Context().Value(pathParamsContextKey{}).(*pathParams); ok {
+		return p.template
+	}
+	return ""
+}
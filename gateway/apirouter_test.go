@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestAPIRouter registers the templates in order; each handler replies
+// with its method, template and captured parameters
+func newTestAPIRouter(routes ...string) *apiRouter {
+	ar := newAPIRouter("/api")
+	for _, route := range routes {
+		method, template, _ := strings.Cut(route, " ")
+		ar.handle(method, template, func(g *Gateway, w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, method+" "+routeTemplate(r))
+			for _, part := range splitPath(template) {
+				if strings.HasPrefix(part, "{") {
+					name, _, _ := strings.Cut(strings.Trim(part, "{}"), ":")
+					io.WriteString(w, " "+name+"="+pathParam(r, name))
+				}
+			}
+		})
+	}
+	return ar
+}
+
+func serveAPI(g *Gateway, ar *apiRouter, method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	g.serveAPI(ar, w, httptest.NewRequest(method, path, nil))
+	return w
+}
+
+func TestAPIRouterPrecedence(t *testing.T) {
+	g := newTestGateway(t, proxyConfig("http://localhost:3001"))
+
+	// Parameters are registered first so that order can't decide
+	ar := newTestAPIRouter(
+		"GET /plans/{planId}",
+		"GET /plans/default",
+		"GET /plans",
+		"GET /orders/{orderId:int}",
+		"GET /sessions/{sessionId:uuid}",
+		"GET /a/{x}/c",
+		"GET /a/b/{y}",
+		"POST /cart",
+		"POST /cart/checkout",
+	)
+
+	tests := []struct {
+		method, path string
+		want         string
+	}{
+		{"GET", "/api/plans/default", "GET /plans/default"},
+		{"GET", "/api/plans/gold", "GET /plans/{planId} planId=gold"},
+		{"GET", "/api/plans", "GET /plans"},
+		{"GET", "/api/plans/", "GET /plans"},
+		{"GET", "/api/plans/gold%2Fplus", "GET /plans/{planId} planId=gold/plus"},
+		{"GET", "/api/orders/1042", "GET /orders/{orderId:int} orderId=1042"},
+		{"GET", "/api/sessions/0190b6f4-8c2e-7d3a-9f1b-2c4d6e8f0a1b", "GET /sessions/{sessionId:uuid} sessionId=0190b6f4-8c2e-7d3a-9f1b-2c4d6e8f0a1b"},
+
+		// The first position where a literal meets a parameter decides
+		{"GET", "/api/a/b/c", "GET /a/b/{y} y=c"},
+		{"GET", "/api/a/z/c", "GET /a/{x}/c x=z"},
+
+		// Templates only match paths with as many segments
+		{"POST", "/api/cart", "POST /cart"},
+		{"POST", "/api/cart/checkout", "POST /cart/checkout"},
+	}
+	for _, tt := range tests {
+		w := serveAPI(g, ar, tt.method, tt.path)
+		if w.Code != http.StatusOK || w.Body.String() != tt.want {
+			t.Errorf("%s %s: %d %s, want %s", tt.method, tt.path, w.Code, w.Body, tt.want)
+		}
+	}
+}
+
+func TestAPIRouterNotFound(t *testing.T) {
+	g := newTestGateway(t, proxyConfig("http://localhost:3001"))
+	ar := newTestAPIRouter(
+		"GET /plans/{planId}",
+		"GET /orders/{orderId:int}",
+		"GET /sessions/{sessionId:uuid}",
+		"POST /cart",
+	)
+
+	for _, path := range []string{
+		"/api/orders/abc",
+		"/api/sessions/not-a-uuid",
+		"/api/cart/checkout",
+		"/api/plans/gold/extra",
+		"/api/plans//x",
+		"/api/unknown",
+		"/api",
+	} {
+		w := serveAPI(g, ar, "GET", path)
+		if w.Code != http.StatusNotFound || envelopeErrorCode(t, w) != "NOT_FOUND" {
+			t.Errorf("GET %s: %d %s", path, w.Code, w.Body)
+		}
+	}
+}
+
+func TestAPIRouterMethodNotAllowed(t *testing.T) {
+	g := newTestGateway(t, proxyConfig("http://localhost:3001"))
+	ar := newTestAPIRouter(
+		"PUT /cart/items",
+		"POST /cart/items",
+		"DELETE /cart/items",
+		"GET /plans/default",
+		"POST /plans/{planId}",
+	)
+
+	tests := []struct {
+		method, path string
+		allow        string
+	}{
+		{"GET", "/api/cart/items", "DELETE, POST, PUT"},
+		{"PATCH", "/api/cart/items", "DELETE, POST, PUT"},
+
+		// Only the most specific template counts: /plans/default is GET only
+		{"POST", "/api/plans/default", "GET"},
+		{"GET", "/api/plans/gold", "POST"},
+	}
+	for _, tt := range tests {
+		w := serveAPI(g, ar, tt.method, tt.path)
+		if w.Code != http.StatusMethodNotAllowed || envelopeErrorCode(t, w) != "METHOD_NOT_ALLOWED" {
+			t.Errorf("%s %s: %d %s", tt.method, tt.path, w.Code, w.Body)
+			continue
+		}
+		if got := w.Header().Get("Allow"); got != tt.allow {
+			t.Errorf("%s %s: Allow = %q, want %q", tt.method, tt.path, got, tt.allow)
+		}
+		var envelope struct {
+			Error struct {
+				Details struct {
+					Allowed []string `json:"allowed"`
+				} `json:"details"`
+			} `json:"error"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &envelope)
+		if got := strings.Join(envelope.Error.Details.Allowed, ", "); got != tt.allow {
+			t.Errorf("%s %s: details.allowed = %q, want %q", tt.method, tt.path, got, tt.allow)
+		}
+	}
+}
+
+func TestAPIRouterHandlePanics(t *testing.T) {
+	tests := map[string][]string{
+		"unknown parameter type":    {"GET /orders/{orderId:float}"},
+		"unnamed parameter":         {"GET /orders/{}"},
+		"same shape":                {"GET /plans/{planId}", "GET /plans/{id}"},
+		"same shape with a type":    {"GET /orders/{orderId:int}", "GET /orders/{orderId:uuid}"},
+		"same literal registration": {"POST /cart", "POST /cart/"},
+	}
+	for name, routes := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: no panic", name)
+				}
+			}()
+			newTestAPIRouter(routes...)
+		}()
+	}
+
+	// Different methods may share a template
+	newTestAPIRouter("GET /plans/{planId}", "POST /plans/{planId}")
+}
+
+func TestFrontendRoutesThroughGateway(t *testing.T) {
+	g := newTestGateway(t, `
+upstreams:
+  backend:
+    url: http://localhost:3001
+routes:
+  - name: frontend
+    prefix: /api/gw/v1/
+    handler: frontend
+    upstream: backend
+    auth: none
+`)
+
+	w := serveGateway(g, httptest.NewRequest("PATCH", "/api/gw/v1/cart", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET" {
+		t.Errorf("PATCH /cart: %d, Allow %q", w.Code, w.Header().Get("Allow"))
+	}
+	w = serveGateway(g, httptest.NewRequest("GET", "/api/gw/v1/cart/unknown", nil))
+	if w.Code != http.StatusNotFound || envelopeErrorCode(t, w) != "NOT_FOUND" {
+		t.Errorf("GET /cart/unknown: %d %s", w.Code, w.Body)
+	}
+}
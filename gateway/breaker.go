@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// Defaults for circuit breakers
+const (
+	defaultBreakerFailureThreshold = 5
+	defaultBreakerOpenDuration     = 30 * time.Second
+	defaultBreakerHalfOpenRequests = 1
+)
+
+// errCircuitOpen is returned instead of calling an upstream whose circuit is open
+type errCircuitOpen struct {
+	upstream   string
+	retryAfter time.Duration
+}
+
+func (e *errCircuitOpen) Error() string {
+	return fmt.Sprintf("circuit open for upstream %s, retry in %s", e.upstream, e.retryAfter.Round(time.Second))
+}
+
+// circuitBreaker stops sending requests to an upstream after repeated
+// failures. While open every call fails immediately; after open_duration a
+// limited number of trial requests are let through (half-open) and the
+// circuit closes once they all succeed, or opens again on the first failure.
+type circuitBreaker struct {
+	upstream         string
+	failureThreshold int
+	openDuration     time.Duration
+	halfOpenRequests int
+
+	mu        sync.Mutex
+	state     string
+	failures  int // consecutive failures while closed
+	openedAt  time.Time
+	trials    int // trial requests in flight while half-open
+	successes int // successful trial requests while half-open
+}
+
+func newCircuitBreaker(upstream string, cfg *CircuitBreakerConfig) *circuitBreaker {
+	if cfg == nil {
+		return nil
+	}
+	cb := &circuitBreaker{
+		upstream:         upstream,
+		failureThreshold: cfg.FailureThreshold,
+		openDuration:     time.Duration(cfg.OpenDuration),
+		halfOpenRequests: cfg.HalfOpenRequests,
+		state:            circuitClosed,
+	}
+	if cb.failureThreshold <= 0 {
+		cb.failureThreshold = defaultBreakerFailureThreshold
+	}
+	if cb.openDuration <= 0 {
+		cb.openDuration = defaultBreakerOpenDuration
+	}
+	if cb.halfOpenRequests <= 0 {
+		cb.halfOpenRequests = defaultBreakerHalfOpenRequests
+	}
+	return cb
+}
+
+// breakerCall is a request a circuit breaker let through. done reports its
+// outcome, or abandon that it was never sent; only the first call counts.
+type breakerCall struct {
+	cb    *circuitBreaker
+	trial bool
+	once  sync.Once
+}
+
+func (c *breakerCall) done(failed bool) {
+	if c.cb != nil {
+		c.once.Do(func() { c.cb.record(c.trial, failed) })
+	}
+}
+
+// abandon frees the call's trial slot without counting it as a success or
+// a failure
+func (c *breakerCall) abandon() {
+	if c.cb != nil {
+		c.once.Do(func() { c.cb.release(c.trial) })
+	}
+}
+
+// allow reports whether a request may be sent. When it may, the returned
+// call must be given the outcome of the request.
+func (cb *circuitBreaker) allow() (*breakerCall, error) {
+	if cb == nil {
+		return &breakerCall{}, nil
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := time.Now()
+	if cb.state == circuitOpen {
+		if wait := cb.openedAt.Add(cb.openDuration).Sub(now); wait > 0 {
+			return nil, &errCircuitOpen{upstream: cb.upstream, retryAfter: wait}
+		}
+		cb.transition(circuitHalfOpen, "open duration elapsed")
+	}
+
+	trial := cb.state == circuitHalfOpen
+	if trial {
+		if cb.trials >= cb.halfOpenRequests {
+			return nil, &errCircuitOpen{upstream: cb.upstream, retryAfter: time.Second}
+		}
+		cb.trials++
+	}
+
+	return &breakerCall{cb: cb, trial: trial}, nil
+}
+
+func (cb *circuitBreaker) release(trial bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if trial {
+		cb.trials--
+	}
+}
+
+func (cb *circuitBreaker) record(trial, failed bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if trial {
+		cb.trials--
+	}
+
+	switch cb.state {
+	case circuitClosed:
+		if !failed {
+			cb.failures = 0
+			return
+		}
+		cb.failures++
+		if cb.failures >= cb.failureThreshold {
+			cb.trip(fmt.Sprintf("%d consecutive failures", cb.failures))
+		}
+	case circuitHalfOpen:
+		// Results of requests sent before the circuit opened don't count
+		if !trial {
+			return
+		}
+		if failed {
+			cb.trip("trial request failed")
+			return
+		}
+		cb.successes++
+		if cb.successes >= cb.halfOpenRequests {
+			cb.transition(circuitClosed, "trial requests succeeded")
+		}
+	}
+}
+
+func (cb *circuitBreaker) trip(reason string) {
+	cb.openedAt = time.Now()
+	cb.transition(circuitOpen, reason)
+}
+
+// transition changes state and resets the counters of the new state; mu must be held
+func (cb *circuitBreaker) transition(state, reason string) {
+	slog.Warn("Circuit breaker state changed", "upstream", cb.upstream, "from", cb.state, "to", state, "reason", reason)
+	cb.state = state
+	cb.failures = 0
+	cb.successes = 0
+}
+
+// currentState returns the breaker state for the admin endpoint
+func (cb *circuitBreaker) currentState() string {
+	if cb == nil {
+		return ""
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == circuitOpen && time.Since(cb.openedAt) >= cb.openDuration {
+		return circuitHalfOpen
+	}
+	return cb.state
+}
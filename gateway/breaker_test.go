@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestBreaker(threshold, halfOpenRequests int) *circuitBreaker {
+	return newCircuitBreaker("backend", &CircuitBreakerConfig{
+		FailureThreshold: threshold,
+		OpenDuration:     Duration(time.Minute),
+		HalfOpenRequests: halfOpenRequests,
+	})
+}
+
+// elapse ends the open period of a breaker
+func elapse(cb *circuitBreaker) {
+	cb.mu.Lock()
+	cb.openedAt = time.Now().Add(-cb.openDuration)
+	cb.mu.Unlock()
+}
+
+func mustAllow(t *testing.T, cb *circuitBreaker) *breakerCall {
+	t.Helper()
+	call, err := cb.allow()
+	if err != nil {
+		t.Fatalf("allow in state %s: %v", cb.currentState(), err)
+	}
+	return call
+}
+
+func checkCircuitOpen(t *testing.T, cb *circuitBreaker) {
+	t.Helper()
+	var open *errCircuitOpen
+	if _, err := cb.allow(); !errors.As(err, &open) {
+		t.Fatalf("allow in state %s = %v, want circuit open", cb.currentState(), err)
+	}
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	cb := newTestBreaker(3, 2)
+
+	// A success resets the count of consecutive failures
+	mustAllow(t, cb).done(true)
+	mustAllow(t, cb).done(true)
+	mustAllow(t, cb).done(false)
+	mustAllow(t, cb).done(true)
+	mustAllow(t, cb).done(true)
+	if state := cb.currentState(); state != circuitClosed {
+		t.Fatalf("state after 2 consecutive failures = %s", state)
+	}
+
+	// closed -> open
+	mustAllow(t, cb).done(true)
+	if state := cb.currentState(); state != circuitOpen {
+		t.Fatalf("state after 3 consecutive failures = %s", state)
+	}
+	var open *errCircuitOpen
+	if _, err := cb.allow(); !errors.As(err, &open) || open.retryAfter <= 0 || open.retryAfter > time.Minute {
+		t.Fatalf("allow while open = %v", err)
+	}
+
+	// open -> half-open, with halfOpenRequests trials at a time
+	elapse(cb)
+	if state := cb.currentState(); state != circuitHalfOpen {
+		t.Fatalf("state after open duration = %s", state)
+	}
+	first := mustAllow(t, cb)
+	second := mustAllow(t, cb)
+	checkCircuitOpen(t, cb)
+
+	// half-open -> closed once every trial succeeded
+	first.done(false)
+	if state := cb.currentState(); state != circuitHalfOpen {
+		t.Fatalf("state after one successful trial = %s", state)
+	}
+	second.done(false)
+	if state := cb.currentState(); state != circuitClosed {
+		t.Fatalf("state after successful trials = %s", state)
+	}
+}
+
+func TestCircuitBreakerTrialFailure(t *testing.T) {
+	cb := newTestBreaker(1, 2)
+	mustAllow(t, cb).done(true)
+	elapse(cb)
+
+	// A request sent while closed reports after the circuit opened: it
+	// doesn't count as a trial
+	late := &breakerCall{cb: cb}
+	first := mustAllow(t, cb)
+	late.done(false)
+	first.done(false)
+	if state := cb.currentState(); state != circuitHalfOpen {
+		t.Fatalf("state after one successful trial = %s", state)
+	}
+
+	// half-open -> open on the first failed trial
+	mustAllow(t, cb).done(true)
+	if state := cb.currentState(); state != circuitOpen {
+		t.Fatalf("state after failed trial = %s", state)
+	}
+	checkCircuitOpen(t, cb)
+}
+
+func TestCircuitBreakerAbandonedCall(t *testing.T) {
+	cb := newTestBreaker(1, 1)
+	mustAllow(t, cb).done(true)
+	elapse(cb)
+
+	// A trial that was never sent frees its slot without closing or
+	// opening the circuit
+	call := mustAllow(t, cb)
+	checkCircuitOpen(t, cb)
+	call.abandon()
+	call.done(true)
+	if state := cb.currentState(); state != circuitHalfOpen {
+		t.Fatalf("state after abandoned trial = %s", state)
+	}
+
+	mustAllow(t, cb).done(false)
+	if state := cb.currentState(); state != circuitClosed {
+		t.Fatalf("state after successful trial = %s", state)
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	var cb *circuitBreaker
+	for i := 0; i < 10; i++ {
+		call, err := cb.allow()
+		if err != nil {
+			t.Fatal(err)
+		}
+		call.done(true)
+	}
+	if state := cb.currentState(); state != "" {
+		t.Errorf("state = %q", state)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math/rand"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Body capture limits: bodies longer than maxCaptureBodyRead can't be
+// redacted reliably and are left out
+const (
+	defaultCaptureBodySize = 4096
+	maxCaptureBodyRead     = 1 << 20
+)
+
+// bodyCapture records redacted exchanges of the routes selected by the
+// capture configuration
+type bodyCapture struct {
+	config      CaptureConfig
+	ratio       float64
+	maxBodySize int
+	redactor    *redactor
+	sink        *captureSink
+}
+
+func newBodyCapture(cfg *CaptureConfig, sink *captureSink) (*bodyCapture, error) {
+	rd, err := newRedactor(cfg.Redact)
+	if err != nil {
+		return nil, err
+	}
+	c := &bodyCapture{config: *cfg, ratio: 1, maxBodySize: cfg.MaxBodySize, redactor: rd, sink: sink}
+	if cfg.SampleRatio != nil {
+		c.ratio = *cfg.SampleRatio
+	}
+	if c.maxBodySize == 0 {
+		c.maxBodySize = defaultCaptureBodySize
+	}
+	return c, nil
+}
+
+// sampled decides whether a request is a capture candidate. It is asked
+// before the request is served, so the response body is only kept for
+// candidates.
+func (c *bodyCapture) sampled() bool {
+	return c != nil && c.ratio > 0 && rand.Float64() < c.ratio
+}
+
+// selects reports whether the route that served r is one to capture
+func (c *bodyCapture) selects(r *http.Request) bool {
+	route := requestAttr(r, "route")
+	template := requestAttr(r, "routeTemplate")
+	for _, selector := range c.config.Routes {
+		switch {
+		case selector == route && route != "":
+			return true
+		case strings.HasSuffix(selector, "*") && strings.HasPrefix(template, strings.TrimSuffix(selector, "*")):
+			return true
+		case selector == template && template != "":
+			return true
+		}
+	}
+	return false
+}
+
+// captureRecord is one line of the capture sink
+type captureRecord struct {
+	Time       string          `json:"time"`
+	RequestID  string          `json:"request_id,omitempty"`
+	TraceID    string          `json:"trace_id,omitempty"`
+	Route      string          `json:"route,omitempty"`
+	Template   string          `json:"route_template,omitempty"`
+	Method     string          `json:"method"`
+	Path       string          `json:"path"`
+	Query      string          `json:"query,omitempty"`
+	Status     int             `json:"status"`
+	DurationMs float64         `json:"duration_ms"`
+	Request    capturedMessage `json:"request"`
+	Response   capturedMessage `json:"response"`
+}
+
+// capturedMessage is the redacted headers and body of a request or response
+type capturedMessage struct {
+	Headers   map[string]string `json:"headers,omitempty"`
+	Body      string            `json:"body,omitempty"`
+	BodySize  int64             `json:"body_size"`
+	Truncated bool              `json:"truncated,omitempty"`
+}
+
+// record writes the exchange to the sink if its route is selected and its
+// status high enough. body and ww must have kept the start of the bodies;
+// a request body the handler didn't read is recorded as far as it was read.
+func (c *bodyCapture) record(r *http.Request, body *countingBody, ww *responseWriter, duration time.Duration) {
+	if ww.statusCode < c.config.MinStatus || !c.selects(r) {
+		return
+	}
+
+	requestBody, requestSize := body.captured()
+	rec := captureRecord{
+		Time:       time.Now().UTC().Format(time.RFC3339Nano),
+		RequestID:  requestID(r),
+		Route:      requestAttr(r, "route"),
+		Template:   requestAttr(r, "routeTemplate"),
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Query:      c.redactor.query(r.URL.RawQuery),
+		Status:     ww.statusCode,
+		DurationMs: float64(duration.Microseconds()) / 1000,
+		Request:    c.message(r.Header, requestBody, requestSize),
+		Response:   c.message(ww.Header(), ww.body, ww.size),
+	}
+	if s := spanFromContext(r.Context()); s != nil && s.sampled() {
+		rec.TraceID = s.traceID()
+	}
+	c.sink.write(r, rec)
+}
+
+// message redacts headers and body. size is the full body size; body may
+// hold only its start.
+func (c *bodyCapture) message(header http.Header, body []byte, size int64) capturedMessage {
+	msg := capturedMessage{Headers: c.redactor.header(header), BodySize: size}
+	if size == 0 {
+		return msg
+	}
+	if size > int64(len(body)) || size > maxCaptureBodyRead {
+		msg.Body = "[body omitted: too large to redact]"
+		return msg
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		redacted, ok := c.redactor.jsonBody(body)
+		if !ok {
+			// Without its structure, field rules can't be applied
+			msg.Body = "[body omitted: invalid JSON]"
+			return msg
+		}
+		msg.Body = string(redacted)
+	case mediaType == "" || strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "application/x-www-form-urlencoded" || strings.HasSuffix(mediaType, "xml"):
+		if !utf8.Valid(body) {
+			msg.Body = "[body omitted: binary]"
+			return msg
+		}
+		msg.Body = c.redactor.text(string(body))
+		if mediaType == "" {
+			// Untyped JSON still gets its field rules applied
+			if redacted, ok := c.redactor.jsonBody(body); ok {
+				msg.Body = string(redacted)
+			}
+		}
+	default:
+		msg.Body = "[body omitted: " + mediaType + "]"
+		return msg
+	}
+
+	if len(msg.Body) > c.maxBodySize {
+		cut := c.maxBodySize
+		for cut > 0 && !utf8.RuneStart(msg.Body[cut]) {
+			cut--
+		}
+		msg.Body = msg.Body[:cut]
+		msg.Truncated = true
+	}
+	return msg
+}
+
+// captureSink appends capture records as JSON lines to a file or stdout
+type captureSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// write appends a record; failures are logged and the record dropped
+func (s *captureSink) write(r *http.Request, rec captureRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Capture failed", "error", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(append(line, '\n')); err != nil {
+		slog.WarnContext(r.Context(), "Capture failed", "error", err)
+	}
+}
+
+// captureSink returns the sink writing to path, opening the file once for
+// the life of the process so reloads keep appending to it
+func (g *Gateway) captureSink(path string) (*captureSink, error) {
+	g.sinksMu.Lock()
+	defer g.sinksMu.Unlock()
+
+	if sink, ok := g.sinks[path]; ok {
+		return sink, nil
+	}
+	var w io.Writer = os.Stdout
+	if path != "stdout" {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		w = file
+	}
+	sink := &captureSink{w: w}
+	if g.sinks == nil {
+		g.sinks = map[string]*captureSink{}
+	}
+	g.sinks[path] = sink
+	return sink, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+// Header carrying the token of an anonymous cart
+const cartTokenHeader = "X-Cart-Token"
+
+// cartGuard decides who may use a cart. A cart bound to a customer (the
+// backend's customerId) can only be used with that customer's bearer token;
+// an anonymous cart only with the cart token handed out when it was created.
+type cartGuard struct {
+	secret []byte
+}
+
+// newCartGuard returns nil when ownership checks are disabled
+func newCartGuard(cfg *CartsConfig) *cartGuard {
+	if !cfg.enabled() {
+		return nil
+	}
+	return &cartGuard{secret: []byte(cfg.TokenSecret)}
+}
+
+// token returns the cart token proving possession of an anonymous cart
+func (cg *cartGuard) token(cartID string) string {
+	mac := hmac.New(sha256.New, cg.secret)
+	mac.Write([]byte("cart:" + cartID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (cg *cartGuard) validToken(cartID, token string) bool {
+	return token != "" && hmac.Equal([]byte(cg.token(cartID)), []byte(token))
+}
+
+// check returns why the caller may not use a cart owned by owner ("" for
+// an anonymous cart), or nil if it may
+func (cg *cartGuard) check(r *http.Request, cartID, owner string) *ErrorInfo {
+	if cg == nil {
+		return nil
+	}
+	if owner != "" {
+		if claims := claimsFromContext(r.Context()); claims != nil && claims.CustomerID == owner {
+			return nil
+		}
+		slog.WarnContext(r.Context(), "Forbidden: cart belongs to another customer", "method", r.Method, "path", r.URL.Path, "owner", owner)
+		return &ErrorInfo{
+			Code:    "FORBIDDEN",
+			Message: "Cart belongs to another customer",
+		}
+	}
+	if cg.validToken(cartID, r.Header.Get(cartTokenHeader)) {
+		return nil
+	}
+	slog.WarnContext(r.Context(), "Forbidden: missing or invalid cart token", "method", r.Method, "path", r.URL.Path)
+	return &ErrorInfo{
+		Code:    "FORBIDDEN",
+		Message: "A valid " + cartTokenHeader + " is required for this cart",
+	}
+}
+
+// cartOwner asks the backend which customer a cart is bound to. found is
+// false when the cart doesn't exist yet.
+func (g *Gateway) cartOwner(r *http.Request, cartID string) (owner string, found bool, err error) {
+	resp, err := g.callUpstream(r, "GET", "/api/v1/cart/"+url.PathEscape(cartID), nil)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", false, nil
+	case resp.StatusCode >= 400:
+		return "", false, fmt.Errorf("looking up cart %s: backend returned %s", cartID, resp.Status)
+	}
+	var cart Cart
+	if err := decodeStrict(resp.Body, &cart); err != nil {
+		return "", false, fmt.Errorf("looking up cart %s: %w", cartID, err)
+	}
+	return string(cart.CustomerID), true, nil
+}
+
+// authorizeCart checks that the caller may use an existing cart, replying
+// with a FORBIDDEN envelope if not. Carts that don't exist yet are allowed:
+// the caller creates and owns them.
+func (g *Gateway) authorizeCart(w http.ResponseWriter, r *http.Request, cartID string) bool {
+	guard := g.state.Load().carts
+	if guard == nil {
+		return true
+	}
+	owner, found, err := g.cartOwner(r, cartID)
+	if err != nil {
+		g.sendUpstreamError(w, err)
+		return false
+	}
+	if !found {
+		return true
+	}
+	if errInfo := guard.check(r, cartID, owner); errInfo != nil {
+		g.sendResponse(w, http.StatusForbidden, nil, errInfo)
+		return false
+	}
+	return true
+}
+
+// Handle cart merge: at login, moves the items of the shopper's anonymous
+// cart into their customer cart, or binds the anonymous cart to the customer
+// if they don't have one
+func (g *Gateway) handleMergeCart(w http.ResponseWriter, r *http.Request) {
+	claims := claimsFromContext(r.Context())
+	if claims == nil || claims.CustomerID == "" {
+		g.sendBearerChallenge(w, "", "Unauthorized: merging carts requires a signed-in customer")
+		return
+	}
+
+	var body MergeCartRequest
+	if !g.decodeRequest(w, r, &body) {
+		return
+	}
+	setRequestAttr(r, "cartId", body.CartID)
+
+	if !g.authorizeCart(w, r, body.CartID) {
+		return
+	}
+	if body.CustomerCartID != "" && body.CustomerCartID != body.CartID {
+		owner, found, err := g.cartOwner(r, body.CustomerCartID)
+		if err != nil {
+			g.sendUpstreamError(w, err)
+			return
+		}
+		if found && owner != claims.CustomerID {
+			slog.WarnContext(r.Context(), "Forbidden: merge target cart belongs to another customer", "target_cart_id", body.CustomerCartID, "owner", owner, "customer_id", claims.CustomerID)
+			g.sendResponse(w, http.StatusForbidden, nil, &ErrorInfo{
+				Code:    "FORBIDDEN",
+				Message: "customerCartId must be a cart of the signed-in customer",
+			})
+			return
+		}
+	}
+
+	bodyBytes, _ := json.Marshal(map[string]interface{}{
+		"sourceCartId": body.CartID,
+		"targetCartId": body.CustomerCartID,
+		"customerId":   claims.CustomerID,
+	})
+	resp, err := g.callUpstream(r, "POST", "/api/v1/cart/merge", bodyBytes)
+	if err != nil {
+		g.sendUpstreamError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		g.sendBackendError(w, resp, "CART_NOT_FOUND")
+		return
+	}
+
+	var cart Cart
+	if !g.decodeBackendResponse(w, resp, &cart) {
+		return
+	}
+	g.sendResponse(w, http.StatusOK, CartResponse{CartID: cart.ID, Cart: &cart}, nil)
+}
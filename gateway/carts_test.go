@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testCartSecret = "cart-secret-that-is-at-least-32-chars"
+
+// fakeCartBackend serves the backend-api cart endpoints the gateway calls
+// for carts listed in owners (cart ID to customer ID, "" if anonymous)
+type fakeCartBackend struct {
+	mu     sync.Mutex
+	owners map[string]string
+	merges []map[string]string
+}
+
+func (b *fakeCartBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cart := func(id string) string {
+		return fmt.Sprintf(`{"id":%q,"customerId":%q,"totalQuantity":0,"totalAmount":0,"lines":[],`+
+			`"cost":{"subtotalAmount":{"amount":"0.00","currencyCode":"USD"},"totalAmount":{"amount":"0.00","currencyCode":"USD"},"totalTaxAmount":null,"totalDutyAmount":null}}`,
+			id, b.owners[id])
+	}
+
+	var body map[string]string
+	json.NewDecoder(r.Body).Decode(&body)
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/api/v1/cart/"):
+		id := strings.TrimPrefix(r.URL.Path, "/api/v1/cart/")
+		if _, ok := b.owners[id]; !ok {
+			http.Error(w, `{"message":"Cart not found"}`, http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, cart(id))
+	case r.Method == "PUT" && r.URL.Path == "/api/v1/cart/items":
+		if _, ok := b.owners[body["cartId"]]; !ok {
+			http.Error(w, `{"message":"Cart not found"}`, http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, cart(body["cartId"]))
+	case r.Method == "POST" && r.URL.Path == "/api/v1/cart/merge":
+		b.merges = append(b.merges, body)
+		b.owners[body["sourceCartId"]] = body["customerId"]
+		io.WriteString(w, cart(body["sourceCartId"]))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newCartTestGateway serves the cart routes with ownership enforced and
+// HS256 bearer tokens accepted
+func newCartTestGateway(t *testing.T, owners map[string]string) (*Gateway, *fakeCartBackend) {
+	t.Helper()
+	backend := &fakeCartBackend{owners: owners}
+	srv := httptest.NewServer(backend)
+	t.Cleanup(srv.Close)
+	g := newTestGateway(t, `
+upstreams:
+  backend:
+    url: `+srv.URL+`
+jwt:
+  secret: `+testJWTSecret+`
+carts:
+  token_secret: `+testCartSecret+`
+routes:
+  - name: frontend-cart
+    prefix: /api/gw/v1/cart
+    handler: frontend
+    upstream: backend
+    auth: api_key_or_jwt
+`)
+	return g, backend
+}
+
+func customerToken(t *testing.T, customerID string) string {
+	claims := validClaims(time.Now())
+	claims["sub"] = customerID
+	delete(claims, "iss")
+	delete(claims, "aud")
+	return signJWT(t, jwtAlgHS256, "", []byte(testJWTSecret), claims)
+}
+
+func TestCartGuardCheck(t *testing.T) {
+	guard := newCartGuard(&CartsConfig{TokenSecret: testCartSecret})
+	customer := &jwtClaims{CustomerID: "customer-1"}
+
+	tests := []struct {
+		name   string
+		owner  string
+		token  string
+		claims *jwtClaims
+		ok     bool
+	}{
+		{"anonymous cart with its token", "", guard.token("cart-1"), nil, true},
+		{"anonymous cart without token", "", "", nil, false},
+		{"anonymous cart with another cart's token", "", guard.token("cart-2"), nil, false},
+		{"anonymous cart with a bearer token only", "", "", customer, false},
+		{"customer cart with the customer's token", "customer-1", "", customer, true},
+		{"customer cart with another customer's token", "customer-2", "", customer, false},
+		{"customer cart with its cart token only", "customer-1", guard.token("cart-1"), nil, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/gw/v1/cart?cartId=cart-1", nil)
+		if tt.token != "" {
+			r.Header.Set(cartTokenHeader, tt.token)
+		}
+		if tt.claims != nil {
+			r = withClaims(r, tt.claims)
+		}
+		if err := guard.check(r, "cart-1", tt.owner); (err == nil) != tt.ok {
+			t.Errorf("%s: check = %v, want allowed %v", tt.name, err, tt.ok)
+		} else if err != nil && err.Code != "FORBIDDEN" {
+			t.Errorf("%s: code = %s", tt.name, err.Code)
+		}
+	}
+
+	var disabled *cartGuard
+	if err := disabled.check(httptest.NewRequest("GET", "/", nil), "cart-1", "customer-1"); err != nil {
+		t.Errorf("disabled guard: %v", err)
+	}
+}
+
+func TestAuthorizeCart(t *testing.T) {
+	g, _ := newCartTestGateway(t, map[string]string{"anon": "", "owned": "customer-1"})
+	guard := g.state.Load().carts
+
+	tests := []struct {
+		name    string
+		cartID  string
+		headers map[string]string
+		status  int
+	}{
+		{"anonymous cart with its token", "anon", map[string]string{cartTokenHeader: guard.token("anon")}, http.StatusOK},
+		{"anonymous cart without token", "anon", nil, http.StatusForbidden},
+		{"customer cart with the customer's token", "owned", map[string]string{"Authorization": "Bearer " + customerToken(t, "customer-1")}, http.StatusOK},
+		{"customer cart with another customer's token", "owned", map[string]string{"Authorization": "Bearer " + customerToken(t, "customer-2")}, http.StatusForbidden},
+		{"customer cart with a cart token", "owned", map[string]string{cartTokenHeader: guard.token("owned")}, http.StatusForbidden},
+		// Unknown carts aren't anyone's: the backend reports them missing
+		{"unknown cart", "missing", nil, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		body := `{"cartId":"` + tt.cartID + `","lineId":"line-1","quantity":2}`
+		r := httptest.NewRequest("PUT", "/api/gw/v1/cart/items", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		if w := serveGateway(g, r); w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+	}
+}
+
+func TestMergeCart(t *testing.T) {
+	g, backend := newCartTestGateway(t, map[string]string{"anon": "", "mine": "customer-1", "theirs": "customer-2"})
+	guard := g.state.Load().carts
+
+	merge := func(body string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/gw/v1/cart/merge", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		return serveGateway(g, r)
+	}
+	signedIn := map[string]string{
+		"Authorization": "Bearer " + customerToken(t, "customer-1"),
+		cartTokenHeader: guard.token("anon"),
+	}
+
+	if w := merge(`{"cartId":"anon"}`, map[string]string{cartTokenHeader: guard.token("anon")}); w.Code != http.StatusUnauthorized {
+		t.Errorf("merge without bearer token = %d, want 401", w.Code)
+	}
+	if w := merge(`{"cartId":"anon"}`, map[string]string{"Authorization": signedIn["Authorization"]}); w.Code != http.StatusForbidden {
+		t.Errorf("merge without cart token = %d, want 403", w.Code)
+	}
+	if w := merge(`{"cartId":"anon","customerCartId":"theirs"}`, signedIn); w.Code != http.StatusForbidden {
+		t.Errorf("merge into another customer's cart = %d, want 403", w.Code)
+	}
+	if len(backend.merges) != 0 {
+		t.Fatalf("rejected merges reached the backend: %v", backend.merges)
+	}
+
+	w := merge(`{"cartId":"anon","customerCartId":"mine"}`, signedIn)
+	if w.Code != http.StatusOK {
+		t.Fatalf("merge = %d: %s", w.Code, w.Body)
+	}
+	want := map[string]string{"sourceCartId": "anon", "targetCartId": "mine", "customerId": "customer-1"}
+	if len(backend.merges) != 1 || fmt.Sprint(backend.merges[0]) != fmt.Sprint(want) {
+		t.Errorf("backend merge = %v, want %v", backend.merges, want)
+	}
+}
+
+func TestBackendCartPathsDenied(t *testing.T) {
+	g := newTestGateway(t, string(defaultConfigYAML))
+	routes := g.state.Load().routes
+
+	for _, path := range []string{
+		"/api/api/v1/cart/cart-1",
+		"/api/api/v1/cart/items",
+		"/api/api/v1/cart/merge",
+		"/api/api/v1/cart",
+		"/api/API/v1/Cart/items",
+		"/api//api//v1/cart/items",
+	} {
+		if route := routes.match("POST", path); route == nil || route.Name != "backend-denied" {
+			t.Errorf("%s is routed to %v", path, route)
+		}
+	}
+	if route := routes.match("GET", "/api/api/v1/orders/1"); route == nil || route.Name != "backend" {
+		t.Errorf("/api/api/v1/orders/1 is routed to %v", route)
+	}
+
+	r := httptest.NewRequest("PUT", "/api/api/v1/cart/items", strings.NewReader(`{}`))
+	if w := serveGateway(g, r); w.Code != http.StatusForbidden || envelopeErrorCode(t, w) != "FORBIDDEN" {
+		t.Errorf("PUT /api/api/v1/cart/items = %d %s", w.Code, w.Body)
+	}
+}
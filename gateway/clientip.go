@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// flyClientIPHeader is set by Fly's edge proxy to the address of the client
+// that connected to it
+const flyClientIPHeader = "Fly-Client-IP"
+
+// Proxies trusted when the configuration doesn't list any: loopback and the
+// private ranges Fly's edge connects to machines from
+var defaultTrustedProxies = []string{
+	"127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7",
+}
+
+// trustedProxies lists the address ranges of proxies in front of the gateway
+type trustedProxies []netip.Prefix
+
+// parseTrustedProxies parses IP addresses and CIDR ranges
+func parseTrustedProxies(entries []string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", entry)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+// contains reports whether addr belongs to a trusted proxy
+func (t trustedProxies) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range t {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the address of the client that sent r. Headers naming
+// the client are only believed from a trusted proxy: Fly-Client-IP first,
+// then X-Forwarded-For read from the right, skipping trusted proxies, up to
+// the first address a trusted proxy vouches for.
+func (t trustedProxies) resolve(r *http.Request) string {
+	peer := peerAddr(r)
+	if !peer.IsValid() {
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			return host
+		}
+		return r.RemoteAddr
+	}
+	if !t.contains(peer) {
+		return peer.String()
+	}
+
+	if addr, ok := parseForwardedAddr(r.Header.Get(flyClientIPHeader)); ok {
+		return addr.String()
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	if len(hops) == 1 && strings.TrimSpace(hops[0]) == "" {
+		hops = []string{r.Header.Get("X-Real-IP")}
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseForwardedAddr(hops[i])
+		if !ok {
+			// Whatever is left of a malformed entry can't be trusted
+			break
+		}
+		client = addr
+		if !t.contains(addr) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// parseForwardedAddr parses an address from a forwarding header, which
+// some proxies write with a port
+func parseForwardedAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Unmap(), true
+	}
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// peerAddr returns the address of the connection a request came in on
+func peerAddr(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr.Unmap()
+}
+
+type clientIPContextKey struct{}
+
+// clientIPMiddleware resolves the client's address once, with the trusted
+// proxies of the current configuration, for logs, spans, rate limits and
+// upstreams to share
+func (g *Gateway) clientIPMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := g.state.Load().trusted.resolve(r)
+		next(w, r.WithContext(context.WithValue(r.Context(), clientIPContextKey{}, ip)))
+	}
+}
+
+// getClientIP returns the client address resolved by clientIPMiddleware,
+// or the connection's address for requests that didn't pass through it
+func getClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey{}).(string); ok {
+		return ip
+	}
+	return trustedProxies(nil).resolve(r)
+}
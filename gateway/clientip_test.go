@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.1", "172.16.5.9/12", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := proxies[1].String(); got != "172.16.0.0/12" {
+		t.Errorf("CIDR range not masked: %s", got)
+	}
+	for _, entry := range []string{"10.0.0.300", "10.0.0.0/33", "proxy.internal"} {
+		if _, err := parseTrustedProxies([]string{entry}); err == nil {
+			t.Errorf("%q accepted", entry)
+		}
+	}
+}
+
+func TestResolveClientIP(t *testing.T) {
+	trusted, _ := parseTrustedProxies([]string{"10.0.0.0/8", "fc00::/7"})
+
+	tests := []struct {
+		name   string
+		peer   string
+		header http.Header
+		want   string
+	}{
+		{"direct client", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted peer sending X-Forwarded-For", "203.0.113.7:5000", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "203.0.113.7"},
+		{"untrusted peer sending Fly-Client-IP", "203.0.113.7:5000", http.Header{"Fly-Client-Ip": {"1.2.3.4"}}, "203.0.113.7"},
+		{"untrusted peer sending X-Real-IP", "203.0.113.7:5000", http.Header{"X-Real-Ip": {"1.2.3.4"}}, "203.0.113.7"},
+		{"trusted proxy without headers", "10.0.0.2:5000", nil, "10.0.0.2"},
+		{"Fly-Client-IP from trusted proxy", "10.0.0.2:5000", http.Header{"Fly-Client-Ip": {"198.51.100.1"}, "X-Forwarded-For": {"1.2.3.4"}}, "198.51.100.1"},
+		{"malformed Fly-Client-IP falls back", "10.0.0.2:5000", http.Header{"Fly-Client-Ip": {"unknown"}, "X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"X-Real-IP from trusted proxy", "10.0.0.2:5000", http.Header{"X-Real-Ip": {"198.51.100.1"}}, "198.51.100.1"},
+
+		// X-Forwarded-For is walked from the right, past trusted proxies
+		{"one hop", "10.0.0.2:5000", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"spoofed entry left of the client", "10.0.0.2:5000", http.Header{"X-Forwarded-For": {"1.2.3.4, 198.51.100.1"}}, "198.51.100.1"},
+		{"trusted hops skipped", "10.0.0.2:5000", http.Header{"X-Forwarded-For": {"1.2.3.4, 198.51.100.1, 10.1.1.1, 10.2.2.2"}}, "198.51.100.1"},
+		{"hops across header lines", "10.0.0.2:5000", http.Header{"X-Forwarded-For": {"1.2.3.4, 198.51.100.1", "10.1.1.1"}}, "198.51.100.1"},
+		{"only trusted hops", "10.0.0.2:5000", http.Header{"X-Forwarded-For": {"10.1.1.1, 10.2.2.2"}}, "10.1.1.1"},
+		{"hop with port", "10.0.0.2:5000", http.Header{"X-Forwarded-For": {"198.51.100.1:4711"}}, "198.51.100.1"},
+		{"IPv6 hop with port", "10.0.0.2:5000", http.Header{"X-Forwarded-For": {"[2001:db8::7]:4711"}}, "2001:db8::7"},
+		{"IPv4-mapped hop", "10.0.0.2:5000", http.Header{"X-Forwarded-For": {"::ffff:198.51.100.1"}}, "198.51.100.1"},
+
+		// Nothing left of a malformed entry is believed
+		{"malformed last hop", "10.0.0.2:5000", http.Header{"X-Forwarded-For": {"198.51.100.1, garbage"}}, "10.0.0.2"},
+		{"malformed hop behind trusted one", "10.0.0.2:5000", http.Header{"X-Forwarded-For": {"1.2.3.4, not-an-ip, 10.1.1.1"}}, "10.1.1.1"},
+		{"empty hop", "10.0.0.2:5000", http.Header{"X-Forwarded-For": {"198.51.100.1, , 10.1.1.1"}}, "10.1.1.1"},
+
+		// Peers
+		{"IPv6 trusted proxy", "[fd00::2]:5000", http.Header{"X-Forwarded-For": {"2001:db8::7"}}, "2001:db8::7"},
+		{"IPv4-mapped trusted peer", "[::ffff:10.0.0.2]:5000", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"peer without port", "203.0.113.7", nil, "203.0.113.7"},
+		{"unparsable peer", "@unix", http.Header{"X-Forwarded-For": {"1.2.3.4"}}, "@unix"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.peer
+		if tt.header != nil {
+			r.Header = tt.header
+		}
+		if got := trusted.resolve(r); got != tt.want {
+			t.Errorf("%s: resolve = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultTrustedProxies(t *testing.T) {
+	trusted, err := parseTrustedProxies(defaultTrustedProxies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "[fdaa:0:1::3]:5000"
+	r.Header.Set("Fly-Client-IP", "198.51.100.1")
+	if got := trusted.resolve(r); got != "198.51.100.1" {
+		t.Errorf("Fly edge: resolve = %s", got)
+	}
+
+	r.RemoteAddr = "198.51.100.9:5000"
+	if got := trusted.resolve(r); got != "198.51.100.9" {
+		t.Errorf("public peer: resolve = %s", got)
+	}
+}
+
+func TestClientIPMiddleware(t *testing.T) {
+	g := newTestGateway(t, `
+upstreams:
+  backend:
+    url: http://localhost:3001
+trusted_proxies: [10.0.0.0/8]
+routes:
+  - name: backend
+    prefix: /
+    upstream: backend
+`)
+	var got string
+	handler := g.clientIPMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		got = getClientIP(r)
+	})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.2:5000"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4, 198.51.100.1")
+	handler(httptest.NewRecorder(), r)
+	if got != "198.51.100.1" {
+		t.Errorf("getClientIP = %s", got)
+	}
+
+	// Without the middleware, only the connection is believed
+	if ip := getClientIP(r); ip != "10.0.0.2" {
+		t.Errorf("getClientIP outside the middleware = %s", ip)
+	}
+}
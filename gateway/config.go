@@ -0,0 +1,706 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Default configuration, used when GATEWAY_CONFIG is not set. It expresses the
+// original hard-coded routing table so the gateway behaves the same out of the box.
+//
+//go:embed gateway.default.yaml
+var defaultConfigYAML []byte
+
+// Config is the declarative gateway configuration loaded at startup
+type Config struct {
+	Upstreams       map[string]UpstreamConfig  `json:"upstreams"`
+	Routes          []RouteConfig              `json:"routes"`
+	RetryBudget     *RetryBudgetConfig         `json:"retry_budget,omitempty"`
+	Idempotency     *IdempotencyConfig         `json:"idempotency,omitempty"`
+	RateLimits      map[string]RateLimitConfig `json:"rate_limits,omitempty"`
+	APIKeys         *APIKeysConfig             `json:"api_keys,omitempty"`
+	JWT             *JWTConfig                 `json:"jwt,omitempty"`
+	Carts           *CartsConfig               `json:"carts,omitempty"`
+	DepositSessions *DepositSessionsConfig     `json:"deposit_sessions,omitempty"`
+	Quotes          *QuotesConfig              `json:"quotes,omitempty"`
+	Tracing         *TracingConfig             `json:"tracing,omitempty"`
+	Metrics         *MetricsConfig             `json:"metrics,omitempty"`
+	Capture         *CaptureConfig             `json:"capture,omitempty"`
+	TrustedProxies  []string                   `json:"trusted_proxies,omitempty"`
+
+	// source is the raw document the configuration was parsed from,
+	// kept so reloads can log what changed
+	source []byte
+}
+
+// UpstreamConfig describes a service the gateway can forward requests to.
+// A service is a pool of one or more instances: url is shorthand for a
+// single instance, targets lists several.
+type UpstreamConfig struct {
+	URL            string                `json:"url,omitempty"`
+	Targets        []string              `json:"targets,omitempty"`
+	Balancer       string                `json:"balancer,omitempty"`
+	HashKey        string                `json:"hash_key,omitempty"`
+	HealthCheck    *HealthCheckConfig    `json:"health_check,omitempty"`
+	PassiveHealth  *PassiveHealthConfig  `json:"passive_health,omitempty"`
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker,omitempty"`
+	RequestHeaders *HeaderPolicyConfig   `json:"request_headers,omitempty"`
+}
+
+// HeaderPolicyConfig limits the client headers forwarded to an upstream.
+// With allow set only the listed headers pass; deny removes headers. A name
+// ending in * matches every header with that prefix.
+type HeaderPolicyConfig struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// HealthCheckConfig enables periodic probing of every target of an upstream
+type HealthCheckConfig struct {
+	Path               string   `json:"path"`
+	Interval           Duration `json:"interval,omitempty"`
+	Timeout            Duration `json:"timeout,omitempty"`
+	HealthyThreshold   int      `json:"healthy_threshold,omitempty"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold,omitempty"`
+}
+
+// PassiveHealthConfig controls ejection of targets that fail live traffic
+type PassiveHealthConfig struct {
+	MaxFailures  int      `json:"max_failures,omitempty"`
+	BaseEjection Duration `json:"base_ejection,omitempty"`
+	MaxEjection  Duration `json:"max_ejection,omitempty"`
+}
+
+// CircuitBreakerConfig enables a circuit breaker in front of an upstream
+type CircuitBreakerConfig struct {
+	FailureThreshold int      `json:"failure_threshold,omitempty"`
+	OpenDuration     Duration `json:"open_duration,omitempty"`
+	HalfOpenRequests int      `json:"half_open_requests,omitempty"`
+}
+
+// Duration is a time.Duration written as a string such as "10s" in configuration files
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// NameList is a list of names that may also be written as a single name
+type NameList []string
+
+func (l *NameList) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*l = nil
+		if name != "" {
+			*l = NameList{name}
+		}
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return fmt.Errorf("must be a name or a list of names")
+	}
+	*l = names
+	return nil
+}
+
+// RouteConfig describes a single entry in the routing table.
+// Exactly one of Path, Prefix or Pattern selects the requests the route matches,
+// and exactly one of Upstream or Handler decides where they go (a handler route
+// may still name the upstream its handler talks to). MaxBodySize limits request
+// bodies to that many bytes; 0 means no limit.
+type RouteConfig struct {
+	Name        string       `json:"name"`
+	Path        string       `json:"path,omitempty"`
+	Prefix      string       `json:"prefix,omitempty"`
+	Pattern     string       `json:"pattern,omitempty"`
+	Methods     []string     `json:"methods,omitempty"`
+	Upstream    string       `json:"upstream,omitempty"`
+	Handler     string       `json:"handler,omitempty"`
+	StripPrefix string       `json:"strip_prefix,omitempty"`
+	Rewrite     string       `json:"rewrite,omitempty"`
+	Auth        string       `json:"auth,omitempty"`
+	Retry       *RetryConfig `json:"retry,omitempty"`
+	RateLimit   NameList     `json:"rate_limit,omitempty"`
+	Scope       string       `json:"scope,omitempty"`
+	MaxBodySize int64        `json:"max_body_size,omitempty"`
+}
+
+// RetryConfig enables retries of failed upstream calls made for a route.
+// Only idempotent methods and requests with an Idempotency-Key are retried.
+type RetryConfig struct {
+	Attempts  int      `json:"attempts,omitempty"`
+	BaseDelay Duration `json:"base_delay,omitempty"`
+	MaxDelay  Duration `json:"max_delay,omitempty"`
+	OnStatus  []int    `json:"on_status,omitempty"`
+}
+
+// RetryBudgetConfig limits retries across the whole gateway
+type RetryBudgetConfig struct {
+	Ratio               float64 `json:"ratio,omitempty"`
+	MinRetriesPerSecond float64 `json:"min_retries_per_second,omitempty"`
+}
+
+// RateLimitConfig is a token bucket policy: limit requests per period, with
+// bursts of up to burst requests (default limit), counted per key
+type RateLimitConfig struct {
+	Limit  int      `json:"limit"`
+	Period Duration `json:"period"`
+	Burst  int      `json:"burst,omitempty"`
+	Key    string   `json:"key"`
+}
+
+// APIKeysConfig points to the file listing the API keys clients may use.
+// LegacyAllowQuery lets the legacy API_KEY be sent as an api_key query
+// parameter while clients move to the X-API-Key header.
+type APIKeysConfig struct {
+	File             string `json:"file,omitempty"`
+	LegacyAllowQuery bool   `json:"legacy_allow_query,omitempty"`
+}
+
+// JWTConfig enables validation of bearer tokens on routes using a jwt auth
+// policy. Keys come from a JWKS URL or file, and/or an HS256 shared secret.
+type JWTConfig struct {
+	JWKSURL         string   `json:"jwks_url,omitempty"`
+	JWKSFile        string   `json:"jwks_file,omitempty"`
+	Secret          string   `json:"secret,omitempty"`
+	Issuer          string   `json:"issuer,omitempty"`
+	Audience        string   `json:"audience,omitempty"`
+	Algorithms      []string `json:"algorithms,omitempty"`
+	ClockSkew       Duration `json:"clock_skew,omitempty"`
+	RefreshInterval Duration `json:"refresh_interval,omitempty"`
+	CustomerIDClaim string   `json:"customer_id_claim,omitempty"`
+	RolesClaim      string   `json:"roles_claim,omitempty"`
+}
+
+// enabled reports whether any key source is configured; settings whose
+// environment variables are unset leave JWT validation off
+func (c *JWTConfig) enabled() bool {
+	return c != nil && (c.JWKSURL != "" || c.JWKSFile != "" || c.Secret != "")
+}
+
+// CartsConfig enables cart ownership checks on the frontend API. Carts of
+// signed-in customers are bound to their customer ID; anonymous carts can
+// only be used with the cart token issued when they were created.
+type CartsConfig struct {
+	TokenSecret string `json:"token_secret,omitempty"`
+}
+
+// enabled reports whether cart ownership is enforced
+func (c *CartsConfig) enabled() bool {
+	return c != nil && c.TokenSecret != ""
+}
+
+// DepositSessionsConfig enables signed, expiring deposit session URLs. The
+// first of secrets signs new tokens; the others are still accepted so a
+// secret can be rotated without breaking active sessions.
+type DepositSessionsConfig struct {
+	Secrets  []string `json:"secrets,omitempty"`
+	TokenTTL Duration `json:"token_ttl,omitempty"`
+}
+
+// enabled reports whether any secret is set; entries whose environment
+// variables are unset are ignored
+func (c *DepositSessionsConfig) enabled() bool {
+	return c != nil && hasSecret(c.Secrets)
+}
+
+// QuotesConfig enables signed price quotes: external cart items can only be
+// added with a quote the gateway issued from the catalog's price
+type QuotesConfig struct {
+	Secrets []string      `json:"secrets,omitempty"`
+	TTL     Duration      `json:"ttl,omitempty"`
+	Catalog CatalogConfig `json:"catalog"`
+}
+
+// enabled reports whether any secret is set
+func (c *QuotesConfig) enabled() bool {
+	return c != nil && hasSecret(c.Secrets)
+}
+
+// CatalogConfig locates external items in the catalog: path is requested from
+// the upstream with {collection} and {externalId} filled in
+type CatalogConfig struct {
+	Upstream    string   `json:"upstream"`
+	Path        string   `json:"path"`
+	APIKey      string   `json:"api_key,omitempty"`
+	Collections []string `json:"collections,omitempty"`
+	PriceFields []string `json:"price_fields,omitempty"`
+	Currency    string   `json:"currency,omitempty"`
+}
+
+func hasSecret(secrets []string) bool {
+	for _, secret := range secrets {
+		if secret != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// TracingConfig exports OpenTelemetry traces of requests and upstream calls
+// to an OTLP endpoint such as a collector, over HTTP or gRPC. SampleRatio
+// (default 1) is the fraction of new traces recorded; traces started by a
+// caller follow the caller's sampling decision.
+type TracingConfig struct {
+	Endpoint    string            `json:"endpoint,omitempty"`
+	Protocol    string            `json:"protocol,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	ServiceName string            `json:"service_name,omitempty"`
+	SampleRatio *float64          `json:"sample_ratio,omitempty"`
+}
+
+// enabled reports whether an endpoint is set
+func (c *TracingConfig) enabled() bool {
+	return c != nil && c.Endpoint != ""
+}
+
+// MetricsConfig serves Prometheus metrics on a listener of their own, apart
+// from the routes and their auth policies. Listen is only read at startup;
+// path and token follow reloads. When token is set, scrapers must send it as
+// a bearer token; it is required unless listen is a loopback or private
+// address.
+type MetricsConfig struct {
+	Listen string `json:"listen,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Token  string `json:"token,omitempty"`
+}
+
+// enabled reports whether a listen address is set
+func (c *MetricsConfig) enabled() bool {
+	return c != nil && c.Listen != ""
+}
+
+// path returns the metrics path, /metrics by default
+func (c *MetricsConfig) path() string {
+	if c.Path == "" {
+		return "/metrics"
+	}
+	return c.Path
+}
+
+// CaptureConfig records the bodies of selected requests and their
+// responses, redacted, to a sink apart from the logs: a file of JSON lines
+// or stdout. Routes lists route names and route templates such as
+// /api/gw/v1/deposit-sessions/{sessionId}/checkout; a trailing * matches
+// every template with that prefix. MinStatus limits capture to responses
+// with at least that status, SampleRatio (default 1) to a fraction of the
+// requests, and bodies are cut after MaxBodySize bytes (default 4096).
+type CaptureConfig struct {
+	Sink        string       `json:"sink,omitempty"`
+	Routes      []string     `json:"routes,omitempty"`
+	MinStatus   int          `json:"min_status,omitempty"`
+	SampleRatio *float64     `json:"sample_ratio,omitempty"`
+	MaxBodySize int          `json:"max_body_size,omitempty"`
+	Redact      RedactConfig `json:"redact"`
+}
+
+// enabled reports whether a sink and at least one route are set
+func (c *CaptureConfig) enabled() bool {
+	return c != nil && c.Sink != "" && len(c.Routes) > 0
+}
+
+// RedactConfig adds rules to the built-in redaction of captures. Fields
+// are JSON paths such as $.customer.email, $..phone or $.items[*].payload
+// whose values are masked, patterns are regular expressions masked
+// wherever they match (only the first group when they have one), and
+// headers are headers whose values are masked.
+type RedactConfig struct {
+	Fields   []string `json:"fields,omitempty"`
+	Patterns []string `json:"patterns,omitempty"`
+	Headers  []string `json:"headers,omitempty"`
+}
+
+// IdempotencyConfig controls how responses to requests with an
+// Idempotency-Key are stored
+type IdempotencyConfig struct {
+	Store       StoreConfig `json:"store"`
+	TTL         Duration    `json:"ttl,omitempty"`
+	LockTimeout Duration    `json:"lock_timeout,omitempty"`
+}
+
+// StoreConfig selects a key-value store: memory (default) or redis with a
+// url such as redis://:password@localhost:6379/0
+type StoreConfig struct {
+	Type string `json:"type,omitempty"`
+	URL  string `json:"url,omitempty"`
+}
+
+// Auth policies a route can use
+const (
+	authPolicyAPIKey      = "api_key"
+	authPolicyNone        = "none"
+	authPolicyJWT         = "jwt"          // a valid bearer token is required
+	authPolicyJWTOptional = "jwt_optional" // a bearer token is validated if sent
+	authPolicyAPIKeyOrJWT = "api_key_or_jwt"
+)
+
+// LoadConfig reads the configuration from the file named by GATEWAY_CONFIG,
+// falling back to the embedded default configuration
+func LoadConfig() (*Config, error) {
+	path := configPath()
+	if path == "" {
+		return parseConfig(defaultConfigYAML, ".yaml")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config %s: %w", path, err)
+	}
+	cfg, err := parseConfig(data, filepath.Ext(path))
+	if err != nil {
+		return nil, fmt.Errorf("loading config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// configPath returns the configuration file in use, or "" for the embedded default
+func configPath() string {
+	return os.Getenv("GATEWAY_CONFIG")
+}
+
+// parseConfig decodes a YAML or JSON document into a validated Config.
+// Environment references like ${BACKEND_API_URL} or ${BACKEND_API_URL:-http://localhost:4000}
+// are expanded before parsing.
+func parseConfig(source []byte, ext string) (*Config, error) {
+	data := []byte(os.Expand(string(source), expandEnvDefault))
+
+	var cfg Config
+	if err := decodeDocument(data, ext, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing config: %w", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	cfg.source = source
+	return &cfg, nil
+}
+
+// decodeDocument decodes a YAML or JSON document into v, rejecting unknown
+// fields. YAML is converted to JSON so both formats share the same strict decoder.
+func decodeDocument(data []byte, ext string, v interface{}) error {
+	if ext != ".json" {
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("yaml: %w", err)
+		}
+		converted, err := json.Marshal(doc)
+		if err != nil {
+			return fmt.Errorf("yaml: %w", err)
+		}
+		data = converted
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// privateListenAddr reports whether a listen address only accepts
+// connections from the host or a private network. An empty host listens on
+// every interface; host names, such as Fly's fly-local-6pn, are resolved.
+func privateListenAddr(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil || host == "" {
+		return false
+	}
+	addrs := []string{host}
+	if net.ParseIP(host) == nil {
+		if addrs, err = net.LookupHost(host); err != nil || len(addrs) == 0 {
+			return false
+		}
+	}
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil || !(ip.IsLoopback() || ip.IsPrivate()) {
+			return false
+		}
+	}
+	return true
+}
+
+// expandEnvDefault resolves VAR and VAR:-default references
+func expandEnvDefault(ref string) string {
+	name, fallback, hasDefault := strings.Cut(ref, ":-")
+	if value := os.Getenv(name); value != "" || !hasDefault {
+		return value
+	}
+	return fallback
+}
+
+// Validate checks that the configuration is complete and internally consistent
+func (c *Config) Validate() error {
+	for name, upstream := range c.Upstreams {
+		if upstream.URL == "" && len(upstream.Targets) == 0 {
+			return fmt.Errorf("upstream %q: url or targets is required", name)
+		}
+		for _, target := range append([]string{upstream.URL}, upstream.Targets...) {
+			if target == "" {
+				continue
+			}
+			if u, err := url.Parse(target); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("upstream %q: invalid target url %q", name, redactURLPassword(target))
+			}
+		}
+		if upstream.HealthCheck != nil && !strings.HasPrefix(upstream.HealthCheck.Path, "/") {
+			return fmt.Errorf("upstream %q: health_check.path must start with /", name)
+		}
+		switch upstream.Balancer {
+		case "", balancerRoundRobin, balancerLeastConnections:
+		case balancerConsistentHash:
+			if upstream.HashKey == "" {
+				return fmt.Errorf("upstream %q: consistent_hash requires hash_key", name)
+			}
+		default:
+			return fmt.Errorf("upstream %q: unknown balancer %q", name, upstream.Balancer)
+		}
+		if policy := upstream.RequestHeaders; policy != nil {
+			for _, header := range append(append([]string{}, policy.Allow...), policy.Deny...) {
+				if !validHeaderPattern(header) {
+					return fmt.Errorf("upstream %q: invalid header name %q in request_headers", name, header)
+				}
+			}
+		}
+	}
+
+	for name, limit := range c.RateLimits {
+		if limit.Limit <= 0 || limit.Period <= 0 {
+			return fmt.Errorf("rate limit %q: limit and period must be positive", name)
+		}
+		if limit.Burst < 0 {
+			return fmt.Errorf("rate limit %q: burst must not be negative", name)
+		}
+		switch limit.Key {
+		case rateLimitKeyAPIKey, rateLimitKeyIP, rateLimitKeyCartID:
+		default:
+			return fmt.Errorf("rate limit %q: key must be api_key, ip or cartId", name)
+		}
+	}
+
+	if c.JWT.enabled() {
+		if c.JWT.JWKSURL != "" && c.JWT.JWKSFile != "" {
+			return fmt.Errorf("jwt: only one of jwks_url and jwks_file can be set")
+		}
+		for _, alg := range c.JWT.Algorithms {
+			switch alg {
+			case jwtAlgRS256, jwtAlgES256, jwtAlgHS256:
+			default:
+				return fmt.Errorf("jwt: unsupported algorithm %q (supported: RS256, ES256, HS256)", alg)
+			}
+		}
+	}
+
+	if c.Carts.enabled() && len(c.Carts.TokenSecret) < minSigningSecretLength {
+		return fmt.Errorf("carts: token_secret must be at least %d characters", minSigningSecretLength)
+	}
+
+	if c.DepositSessions != nil {
+		for _, secret := range c.DepositSessions.Secrets {
+			if secret != "" && len(secret) < minSigningSecretLength {
+				return fmt.Errorf("deposit_sessions: secrets must be at least %d characters", minSigningSecretLength)
+			}
+		}
+		if c.DepositSessions.TokenTTL < 0 {
+			return fmt.Errorf("deposit_sessions: token_ttl must not be negative")
+		}
+	}
+
+	if c.Quotes.enabled() {
+		for _, secret := range c.Quotes.Secrets {
+			if secret != "" && len(secret) < minSigningSecretLength {
+				return fmt.Errorf("quotes: secrets must be at least %d characters", minSigningSecretLength)
+			}
+		}
+		catalog := c.Quotes.Catalog
+		if _, ok := c.Upstreams[catalog.Upstream]; !ok {
+			return fmt.Errorf("quotes: catalog.upstream %q is not defined", catalog.Upstream)
+		}
+		if !strings.HasPrefix(catalog.Path, "/") || !strings.Contains(catalog.Path, "{externalId}") {
+			return fmt.Errorf("quotes: catalog.path must start with / and contain {externalId}")
+		}
+		if c.Quotes.TTL < 0 {
+			return fmt.Errorf("quotes: ttl must not be negative")
+		}
+	}
+
+	if c.Tracing.enabled() {
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("tracing: invalid endpoint %q", c.Tracing.Endpoint)
+		}
+		switch c.Tracing.Protocol {
+		case "", otlpProtocolProtobuf, otlpProtocolGRPC:
+		case "http/json":
+			return fmt.Errorf("tracing: protocol http/json is not supported by the OpenTelemetry Go exporters, use http/protobuf or grpc")
+		default:
+			return fmt.Errorf("tracing: unknown protocol %q (supported: http/protobuf, grpc)", c.Tracing.Protocol)
+		}
+		if ratio := c.Tracing.SampleRatio; ratio != nil && (*ratio < 0 || *ratio > 1) {
+			return fmt.Errorf("tracing: sample_ratio must be between 0 and 1")
+		}
+	}
+
+	if c.Metrics.enabled() {
+		if _, _, err := net.SplitHostPort(c.Metrics.Listen); err != nil {
+			return fmt.Errorf("metrics: invalid listen address %q", c.Metrics.Listen)
+		}
+		if c.Metrics.Path != "" && !strings.HasPrefix(c.Metrics.Path, "/") {
+			return fmt.Errorf("metrics: path must start with /")
+		}
+		if c.Metrics.Token == "" && !privateListenAddr(c.Metrics.Listen) {
+			return fmt.Errorf("metrics: token is required when listen %q is not a loopback or private address", c.Metrics.Listen)
+		}
+	}
+
+	if c.Capture.enabled() {
+		if c.Capture.MinStatus != 0 && (c.Capture.MinStatus < 100 || c.Capture.MinStatus > 599) {
+			return fmt.Errorf("capture: min_status must be an HTTP status")
+		}
+		if ratio := c.Capture.SampleRatio; ratio != nil && (*ratio < 0 || *ratio > 1) {
+			return fmt.Errorf("capture: sample_ratio must be between 0 and 1")
+		}
+		if c.Capture.MaxBodySize < 0 || c.Capture.MaxBodySize > maxCaptureBodyRead {
+			return fmt.Errorf("capture: max_body_size must be between 0 and %d", maxCaptureBodyRead)
+		}
+		if _, err := newRedactor(c.Capture.Redact); err != nil {
+			return fmt.Errorf("capture: %w", err)
+		}
+	}
+
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		return fmt.Errorf("trusted_proxies: %w", err)
+	}
+
+	if len(c.Routes) == 0 {
+		return fmt.Errorf("at least one route is required")
+	}
+
+	for i, route := range c.Routes {
+		label := route.Name
+		if label == "" {
+			label = fmt.Sprintf("#%d", i)
+		}
+
+		matchers := 0
+		for _, m := range []string{route.Path, route.Prefix, route.Pattern} {
+			if m != "" {
+				matchers++
+			}
+		}
+		if matchers != 1 {
+			return fmt.Errorf("route %s: exactly one of path, prefix or pattern is required", label)
+		}
+		if route.Pattern != "" {
+			if _, err := regexp.Compile(route.Pattern); err != nil {
+				return fmt.Errorf("route %s: invalid pattern: %w", label, err)
+			}
+		}
+
+		if route.Upstream == "" && route.Handler == "" {
+			return fmt.Errorf("route %s: upstream or handler is required", label)
+		}
+		if route.Handler != "" && (route.StripPrefix != "" || route.Rewrite != "") {
+			return fmt.Errorf("route %s: strip_prefix and rewrite only apply to proxied routes", label)
+		}
+		if route.Upstream != "" {
+			if _, ok := c.Upstreams[route.Upstream]; !ok {
+				return fmt.Errorf("route %s: unknown upstream %q", label, route.Upstream)
+			}
+		}
+		if route.Handler != "" {
+			handler, ok := builtinHandlers[route.Handler]
+			if !ok {
+				return fmt.Errorf("route %s: unknown handler %q", label, route.Handler)
+			}
+			if handler.requiresUpstream && route.Upstream == "" {
+				return fmt.Errorf("route %s: handler %q requires an upstream", label, route.Handler)
+			}
+		}
+
+		if route.Retry != nil && route.Retry.Attempts > 10 {
+			return fmt.Errorf("route %s: retry.attempts must be at most 10", label)
+		}
+
+		if route.MaxBodySize < 0 {
+			return fmt.Errorf("route %s: max_body_size must not be negative", label)
+		}
+
+		for _, name := range route.RateLimit {
+			if _, ok := c.RateLimits[name]; !ok {
+				return fmt.Errorf("route %s: unknown rate limit %q", label, name)
+			}
+		}
+
+		if strings.ContainsAny(route.Scope, ":* ") {
+			return fmt.Errorf("route %s: scope must be a resource name such as cart", label)
+		}
+
+		switch route.Auth {
+		case "", authPolicyAPIKey, authPolicyNone:
+		case authPolicyJWTOptional, authPolicyAPIKeyOrJWT:
+		case authPolicyJWT:
+			if !c.JWT.enabled() {
+				return fmt.Errorf("route %s: auth %s requires jwt.jwks_url, jwt.jwks_file or jwt.secret", label, route.Auth)
+			}
+		default:
+			return fmt.Errorf("route %s: unknown auth policy %q", label, route.Auth)
+		}
+	}
+
+	if c.Idempotency != nil {
+		if err := c.Idempotency.Store.validate(); err != nil {
+			return fmt.Errorf("idempotency.store: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// validate checks the store settings without connecting to the store
+func (s StoreConfig) validate() error {
+	switch s.Type {
+	case "", "memory":
+		return nil
+	case "redis":
+		_, err := newRedisStore(s.URL)
+		return err
+	default:
+		return fmt.Errorf("unknown store type %q", s.Type)
+	}
+}
+
+// sortedKeys returns the keys of a string-keyed map in a stable order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrivateListenAddr(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1:9091":    true,
+		"[::1]:9091":        true,
+		"localhost:9091":    true,
+		"10.0.0.5:9091":     true,
+		"[fdaa::3]:9091":    true,
+		":9091":             false,
+		"0.0.0.0:9091":      false,
+		"[::]:9091":         false,
+		"203.0.113.10:9091": false,
+		"9091":              false,
+	}
+	for listen, want := range tests {
+		if got := privateListenAddr(listen); got != want {
+			t.Errorf("privateListenAddr(%q) = %v, want %v", listen, got, want)
+		}
+	}
+}
+
+func TestMetricsPublicListenRequiresToken(t *testing.T) {
+	const base = "upstreams:\n  backend:\n    url: http://localhost:4000\nroutes:\n  - path: /health\n    upstream: backend\n"
+	if _, err := parseConfig([]byte(base+"metrics:\n  listen: \":9091\"\n"), ".yaml"); err == nil || !strings.Contains(err.Error(), "token is required") {
+		t.Fatalf("public listen without token: err = %v", err)
+	}
+	for _, metrics := range []string{
+		"metrics:\n  listen: \":9091\"\n  token: scrape-token\n",
+		"metrics:\n  listen: 127.0.0.1:9091\n",
+	} {
+		if _, err := parseConfig([]byte(base+metrics), ".yaml"); err != nil {
+			t.Errorf("%q: %v", metrics, err)
+		}
+	}
+}
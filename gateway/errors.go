@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// maxBackendErrorSize bounds how much of a backend error body is read
+const maxBackendErrorSize = 64 << 10
+
+// errorCode is an entry of the error catalog: the HTTP status a code is sent
+// with, whether repeating the same request may succeed, and the message used
+// when there is no more specific one
+type errorCode struct {
+	status    int
+	retryable bool
+	message   string
+}
+
+// errorCatalog lists every code the gateway returns in an error envelope.
+// Clients should branch on the code, never on the message.
+var errorCatalog = map[string]errorCode{
+	// Requests the gateway rejects itself
+	"VALIDATION_ERROR":                {http.StatusBadRequest, false, "Invalid request"},
+	"UNAUTHORIZED":                    {http.StatusUnauthorized, false, "Authentication required"},
+	"FORBIDDEN":                       {http.StatusForbidden, false, "Access denied"},
+	"NOT_FOUND":                       {http.StatusNotFound, false, "Not found"},
+	"METHOD_NOT_ALLOWED":              {http.StatusMethodNotAllowed, false, "Method not allowed"},
+	"CONFLICT":                        {http.StatusConflict, false, "Request conflicts with the current state of the resource"},
+	"PAYLOAD_TOO_LARGE":               {http.StatusRequestEntityTooLarge, false, "Request body is too large"},
+	"RATE_LIMITED":                    {http.StatusTooManyRequests, true, "Too many requests"},
+	"IDEMPOTENCY_KEY_REUSED":          {http.StatusConflict, false, "Idempotency-Key was used for a different request"},
+	"IDEMPOTENCY_REQUEST_IN_PROGRESS": {http.StatusConflict, true, "A request with this Idempotency-Key is still in progress"},
+	"INVALID_QUOTE":                   {http.StatusBadRequest, false, "Invalid price quote"},
+	"QUOTE_EXPIRED":                   {http.StatusBadRequest, false, "Price quote expired, request a new one"},
+
+	// Carts, deposits and orders
+	"CART_NOT_FOUND":            {http.StatusNotFound, false, "Cart not found"},
+	"CART_EMPTY":                {http.StatusUnprocessableEntity, false, "Cart is empty"},
+	"ITEM_ALREADY_IN_CART":      {http.StatusConflict, false, "Item is already in the cart"},
+	"VARIANT_UNAVAILABLE":       {http.StatusUnprocessableEntity, false, "Product variant is not available"},
+	"PLAN_NOT_FOUND":            {http.StatusNotFound, false, "Deposit plan not found"},
+	"PLAN_INACTIVE":             {http.StatusUnprocessableEntity, false, "Deposit plan is not available"},
+	"DEPOSIT_SESSION_NOT_FOUND": {http.StatusNotFound, false, "Deposit session not found"},
+	"ORDER_NOT_FOUND":           {http.StatusNotFound, false, "Order not found"},
+	"ORDER_ALREADY_PAID":        {http.StatusConflict, false, "Order has no remaining amount to pay"},
+
+	// Upstream failures
+	"BACKEND_ERROR":           {http.StatusBadGateway, false, "Backend API error"},
+	"UPSTREAM_UNAVAILABLE":    {http.StatusServiceUnavailable, true, "Upstream service is temporarily unavailable"},
+	"UPSTREAM_TIMEOUT":        {http.StatusGatewayTimeout, true, "Upstream service timed out"},
+	"SERVICE_NOT_CONFIGURED":  {http.StatusServiceUnavailable, false, "Service is not configured"},
+	"IDEMPOTENCY_UNAVAILABLE": {http.StatusServiceUnavailable, true, "Idempotency store is unavailable"},
+}
+
+// backendErrorCodes translates backend-api error codes to catalog codes.
+// Backend codes that are catalog codes already are kept as they are.
+var backendErrorCodes = map[string]string{
+	"SESSION_NOT_FOUND":               "DEPOSIT_SESSION_NOT_FOUND",
+	"NO_PLANS_AVAILABLE":              "PLAN_NOT_FOUND",
+	"INVALID_PLAN":                    "PLAN_INACTIVE",
+	"EXTERNAL_ALREADY_IN_CART":        "ITEM_ALREADY_IN_CART",
+	"MISSING_VARIANT":                 "VARIANT_UNAVAILABLE",
+	"NO_REMAINING_AMOUNT":             "ORDER_ALREADY_PAID",
+	"SERVICE_UNAVAILABLE":             "UPSTREAM_UNAVAILABLE",
+	"DATABASE_NOT_CONFIGURED":         "SERVICE_NOT_CONFIGURED",
+	"SHOPIFY_NOT_CONFIGURED":          "SERVICE_NOT_CONFIGURED",
+	"DEPOSIT_PRODUCT_NOT_CONFIGURED":  "SERVICE_NOT_CONFIGURED",
+	"SHOPIFY_PRODUCT_CREATION_FAILED": "BACKEND_ERROR",
+	"DEPOSIT_SESSION_CREATION_FAILED": "BACKEND_ERROR",
+}
+
+// backendErrorMessages recognizes errors backend-api reports without a
+// code, such as Shopify user errors passed through as plain messages
+var backendErrorMessages = []struct {
+	pattern *regexp.Regexp
+	code    string
+}{
+	{regexp.MustCompile(`(?i)merchandise .*(does not exist|not available)|variant .*(not found|unavailable|sold out)|out of stock`), "VARIANT_UNAVAILABLE"},
+	{regexp.MustCompile(`(?i)plan .*(inactive|not active|disabled)`), "PLAN_INACTIVE"},
+	{regexp.MustCompile(`(?i)cart not found`), "CART_NOT_FOUND"},
+	{regexp.MustCompile(`(?i)plan not found`), "PLAN_NOT_FOUND"},
+	{regexp.MustCompile(`(?i)order not found`), "ORDER_NOT_FOUND"},
+	{regexp.MustCompile(`(?i)timed? ?out|ETIMEDOUT`), "UPSTREAM_TIMEOUT"},
+	{regexp.MustCompile(`ECONNREFUSED|ECONNRESET|ENOTFOUND`), "UPSTREAM_UNAVAILABLE"},
+}
+
+// newError returns the envelope error for a catalog code, with the
+// catalog's message unless one is given
+func newError(code, message string) *ErrorInfo {
+	if message == "" {
+		message = errorCatalog[code].message
+	}
+	return &ErrorInfo{Code: code, Message: message}
+}
+
+// sendError replies with an error envelope using the catalog status of its code
+func (g *Gateway) sendError(w http.ResponseWriter, err *ErrorInfo) {
+	status := http.StatusInternalServerError
+	if entry, ok := errorCatalog[err.Code]; ok {
+		status = entry.status
+	} else {
+		slog.Error("Error code is missing from the error catalog", "code", err.Code, "request_id", w.Header().Get(requestIDHeader))
+	}
+	g.sendResponse(w, status, nil, err)
+}
+
+// sendBodyTooLarge replies with PAYLOAD_TOO_LARGE if err comes from reading
+// a request body past the route's max_body_size, and reports whether it did
+func (g *Gateway) sendBodyTooLarge(w http.ResponseWriter, err error) bool {
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		return false
+	}
+	errInfo := newError("PAYLOAD_TOO_LARGE", fmt.Sprintf("Request body must be at most %d bytes", tooLarge.Limit))
+	errInfo.Details = map[string]interface{}{"limit": tooLarge.Limit}
+	g.sendError(w, errInfo)
+	return true
+}
+
+// sendBackendError replies to a backend error response with the matching
+// catalog error. notFound is the code for a 404 the backend doesn't
+// explain, which depends on what the handler asked for.
+func (g *Gateway) sendBackendError(w http.ResponseWriter, resp *http.Response, notFound string) {
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		w.Header().Set("Retry-After", retryAfter)
+	}
+	err := mapBackendError(resp, notFound)
+	g.metrics.upstreamErrors.inc(upstreamName(resp.Request), err.Code)
+	g.sendError(w, err)
+}
+
+// mapBackendError converts a backend error response, whatever its body, to
+// a catalog error. The backend's message is kept for client errors; for
+// server errors it is only logged since it may describe internals.
+func mapBackendError(resp *http.Response, notFound string) *ErrorInfo {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxBackendErrorSize))
+	var body struct {
+		Code    string      `json:"code"`
+		Message string      `json:"message"`
+		Error   string      `json:"error"`
+		Details interface{} `json:"details"`
+	}
+	if err := json.Unmarshal(data, &body); err != nil {
+		// Not a JSON object: an empty body, an HTML error page from a proxy or plain text
+		body.Code, body.Details = "", nil
+		if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+			body.Message = strings.TrimSpace(string(data))
+		}
+	}
+	message := body.Message
+	if message == "" {
+		message = body.Error
+	}
+
+	code := backendErrorCodes[body.Code]
+	if _, known := errorCatalog[body.Code]; code == "" && known {
+		code = body.Code
+	}
+	if code == "" && message != "" {
+		for _, rule := range backendErrorMessages {
+			if rule.pattern.MatchString(message) {
+				code = rule.code
+				break
+			}
+		}
+	}
+	if code == "" {
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized:
+			code = "UNAUTHORIZED"
+		case resp.StatusCode == http.StatusForbidden:
+			code = "FORBIDDEN"
+		case resp.StatusCode == http.StatusNotFound:
+			code = notFound
+		case resp.StatusCode == http.StatusConflict:
+			code = "CONFLICT"
+		case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusServiceUnavailable:
+			code = "UPSTREAM_UNAVAILABLE"
+		case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusGatewayTimeout:
+			code = "UPSTREAM_TIMEOUT"
+		case resp.StatusCode < 500:
+			code = "VALIDATION_ERROR"
+		default:
+			code = "BACKEND_ERROR"
+		}
+	}
+
+	level := slog.LevelInfo
+	if resp.StatusCode >= 500 {
+		level = slog.LevelWarn
+	}
+	slog.Log(resp.Request.Context(), level, "Backend API error response",
+		"method", resp.Request.Method, "backend_path", resp.Request.URL.Path, "status", resp.StatusCode,
+		"backend_code", body.Code, "backend_message", message, "code", code)
+
+	errInfo := newError(code, "")
+	if resp.StatusCode < 500 && errorCatalog[code].status < 500 {
+		if message != "" {
+			errInfo.Message = message
+		}
+		errInfo.Details = body.Details
+	}
+	return errInfo
+}
+
+// upstreamError converts a failed upstream call to a catalog error
+func upstreamError(err error) *ErrorInfo {
+	var circuitErr *errCircuitOpen
+	var netErr net.Error
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &circuitErr):
+		return newError("UPSTREAM_UNAVAILABLE", "Upstream service "+circuitErr.upstream+" is temporarily unavailable")
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return newError("UPSTREAM_TIMEOUT", "")
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return newError("UPSTREAM_UNAVAILABLE", "Failed to connect to backend API")
+	default:
+		return newError("BACKEND_ERROR", "Failed to connect to backend API")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func backendErrorResponse(status int, contentType, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {contentType}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    httptest.NewRequest("POST", "/api/v1/deposit-sessions", nil),
+	}
+}
+
+func TestMapBackendErrorDepositSessionNotFound(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"message":"Cart not found"}`, "CART_NOT_FOUND"},
+		{`{"message":"Deposit plan not found"}`, "PLAN_NOT_FOUND"},
+		{`{"code":"NO_PLANS_AVAILABLE"}`, "PLAN_NOT_FOUND"},
+		{``, "NOT_FOUND"},
+	}
+	for _, tt := range tests {
+		resp := backendErrorResponse(http.StatusNotFound, "application/json", tt.body)
+		if got := mapBackendError(resp, "NOT_FOUND"); got.Code != tt.want {
+			t.Errorf("404 %q = %s, want %s", tt.body, got.Code, tt.want)
+		}
+	}
+}
+
+func TestMapBackendError(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		code        string
+		message     string
+	}{
+		// Backend codes and messages
+		{"mapped code", 409, "application/json", `{"code":"EXTERNAL_ALREADY_IN_CART","message":"Already added"}`, "ITEM_ALREADY_IN_CART", "Already added"},
+		{"catalog code", 404, "application/json", `{"code":"ORDER_NOT_FOUND"}`, "ORDER_NOT_FOUND", "Order not found"},
+		{"known message", 400, "application/json", `{"error":"Variant 123 is sold out"}`, "VARIANT_UNAVAILABLE", "Variant 123 is sold out"},
+		{"5xx code hides message", 500, "application/json", `{"code":"DATABASE_NOT_CONFIGURED","message":"DATABASE_URL missing"}`, "SERVICE_NOT_CONFIGURED", "Service is not configured"},
+
+		// Status fallbacks for unknown codes
+		{"400", 400, "application/json", `{"code":"QUANTITY_INVALID","message":"Quantity must be positive"}`, "VALIDATION_ERROR", "Quantity must be positive"},
+		{"401", 401, "application/json", `{"code":"TOKEN_EXPIRED","message":"Token expired"}`, "UNAUTHORIZED", "Token expired"},
+		{"403", 403, "application/json", `{"message":"Not your order"}`, "FORBIDDEN", "Not your order"},
+		{"409", 409, "application/json", `{"code":"ORDER_LOCKED","message":"Order is being updated"}`, "CONFLICT", "Order is being updated"},
+		{"408", 408, "application/json", `{}`, "UPSTREAM_TIMEOUT", "Upstream service timed out"},
+		{"429", 429, "application/json", `{}`, "UPSTREAM_UNAVAILABLE", "Upstream service is temporarily unavailable"},
+		{"500", 500, "application/json", `{"message":"TypeError: cannot read property 'id' of undefined"}`, "BACKEND_ERROR", "Backend API error"},
+		{"503", 503, "application/json", `{}`, "UPSTREAM_UNAVAILABLE", "Upstream service is temporarily unavailable"},
+		{"504", 504, "application/json", `{}`, "UPSTREAM_TIMEOUT", "Upstream service timed out"},
+
+		// Bodies that aren't JSON objects
+		{"empty 400", 400, "application/json", ``, "VALIDATION_ERROR", "Invalid request"},
+		{"empty 401", 401, "", ``, "UNAUTHORIZED", "Authentication required"},
+		{"empty 502", 502, "", ``, "BACKEND_ERROR", "Backend API error"},
+		{"text/plain 400", 400, "text/plain; charset=utf-8", "Bad quantity\n", "VALIDATION_ERROR", "Bad quantity"},
+		{"text/plain 403", 403, "text/plain", "Forbidden", "FORBIDDEN", "Forbidden"},
+		{"text/plain 502", 502, "text/plain", "upstream connect error", "BACKEND_ERROR", "Backend API error"},
+		{"text/plain matching message", 500, "text/plain", "connect ECONNREFUSED 10.0.0.1:5432", "UPSTREAM_UNAVAILABLE", "Upstream service is temporarily unavailable"},
+		{"HTML 400", 400, "text/html", "<html><body>Bad Request</body></html>", "VALIDATION_ERROR", "Invalid request"},
+		{"HTML 500", 500, "text/html", "<html><body><h1>500 Internal Server Error</h1></body></html>", "BACKEND_ERROR", "Backend API error"},
+		{"HTML 503", 503, "text/html", "<html><body>Service Unavailable</body></html>", "UPSTREAM_UNAVAILABLE", "Upstream service is temporarily unavailable"},
+		{"JSON array", 422, "application/json", `["bad"]`, "VALIDATION_ERROR", "Invalid request"},
+	}
+	for _, tt := range tests {
+		got := mapBackendError(backendErrorResponse(tt.status, tt.contentType, tt.body), "NOT_FOUND")
+		if got.Code != tt.code || got.Message != tt.message {
+			t.Errorf("%s: %s %q, want %s %q", tt.name, got.Code, got.Message, tt.code, tt.message)
+		}
+		if _, ok := errorCatalog[got.Code]; !ok {
+			t.Errorf("%s: %s is not in the catalog", tt.name, got.Code)
+		}
+	}
+}
+
+func TestMapBackendErrorDetails(t *testing.T) {
+	body := `{"code":"QUANTITY_INVALID","message":"Invalid","details":{"field":"quantity"}}`
+	got := mapBackendError(backendErrorResponse(400, "application/json", body), "NOT_FOUND")
+	if details, ok := got.Details.(map[string]interface{}); !ok || details["field"] != "quantity" {
+		t.Errorf("4xx details = %v", got.Details)
+	}
+
+	body = `{"message":"Query failed","details":{"sql":"SELECT * FROM orders"}}`
+	if got := mapBackendError(backendErrorResponse(500, "application/json", body), "NOT_FOUND"); got.Details != nil {
+		t.Errorf("5xx details = %v, want none", got.Details)
+	}
+}
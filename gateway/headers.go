@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// Headers describing the client connection. They are passed on only when
+// they come from a trusted proxy; otherwise the gateway replaces them.
+var forwardingHeaders = []string{
+	"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Forwarded-Port", "X-Real-IP",
+	flyClientIPHeader,
+}
+
+// setForwardingHeaders describes the client connection to the upstream in
+// X-Forwarded-For, X-Forwarded-Host, X-Forwarded-Proto and Forwarded
+// (RFC 7239), and X-Real-IP to the resolved client address. When the
+// request comes from a trusted proxy, the chain it reports is extended with
+// the proxy's address; anything else a client sent in these headers is
+// dropped.
+func setForwardingHeaders(pr *httputil.ProxyRequest, trusted trustedProxies) {
+	in, out := pr.In, pr.Out
+	peer := peerAddr(in)
+	fromProxy := peer.IsValid() && trusted.contains(peer)
+
+	host, proto := in.Host, "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+	var priorFor, priorForwarded []string
+	for _, key := range forwardingHeaders {
+		out.Header.Del(key)
+	}
+	if fromProxy {
+		priorFor = in.Header.Values("X-Forwarded-For")
+		priorForwarded = in.Header.Values("Forwarded")
+		if v := in.Header.Get("X-Forwarded-Host"); v != "" {
+			host = v
+		}
+		if v := in.Header.Get("X-Forwarded-Proto"); v != "" {
+			proto = v
+		}
+		for _, key := range []string{"X-Forwarded-Port", flyClientIPHeader} {
+			if values := in.Header.Values(key); len(values) > 0 {
+				out.Header[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+			}
+		}
+	}
+
+	node := "unknown"
+	if peer.IsValid() {
+		node = peer.String()
+	}
+	out.Header.Set("X-Forwarded-For", strings.Join(append(priorFor, node), ", "))
+	out.Header.Set("X-Forwarded-Host", host)
+	out.Header.Set("X-Forwarded-Proto", proto)
+	out.Header.Set("X-Real-IP", getClientIP(in))
+
+	if peer.Is6() {
+		node = "[" + node + "]"
+	}
+	element := "for=" + forwardedValue(node) + ";host=" + forwardedValue(host) + ";proto=" + forwardedValue(proto)
+	out.Header.Set("Forwarded", strings.Join(append(priorForwarded, element), ", "))
+}
+
+// forwardedValue renders a Forwarded parameter value: a token when it is
+// one, a quoted string otherwise
+func forwardedValue(s string) string {
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+		}
+	}
+	if s == "" {
+		return `""`
+	}
+	return s
+}
+
+// isTokenChar reports whether c may appear in an RFC 9110 token
+func isTokenChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// headerPolicy filters the client headers proxied to an upstream. Names
+// ending in * match every header with that prefix.
+type headerPolicy struct {
+	allow []string
+	deny  []string
+}
+
+func newHeaderPolicy(cfg *HeaderPolicyConfig) *headerPolicy {
+	if cfg == nil || (len(cfg.Allow) == 0 && len(cfg.Deny) == 0) {
+		return nil
+	}
+	return &headerPolicy{allow: cfg.Allow, deny: cfg.Deny}
+}
+
+// filter removes the headers the policy doesn't forward
+func (p *headerPolicy) filter(h http.Header) {
+	if p == nil {
+		return
+	}
+	for name := range h {
+		if (len(p.allow) > 0 && !matchHeaderName(p.allow, name)) || matchHeaderName(p.deny, name) {
+			delete(h, name)
+		}
+	}
+}
+
+func matchHeaderName(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// validHeaderPattern reports whether s is a header name, optionally
+// ending in *
+func validHeaderPattern(s string) bool {
+	s = strings.TrimSuffix(s, "*")
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
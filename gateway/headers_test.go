@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+)
+
+// forwardedRequest runs setForwardingHeaders on a request from peer, with
+// the client IP resolved as clientIPMiddleware would
+func forwardedRequest(t *testing.T, peer string, header http.Header, trusted trustedProxies) http.Header {
+	t.Helper()
+	in := httptest.NewRequest("GET", "http://shop.example/api/v1/products", nil)
+	in.RemoteAddr = peer
+	in.Header = header
+	in = in.WithContext(context.WithValue(in.Context(), clientIPContextKey{}, trusted.resolve(in)))
+	pr := &httputil.ProxyRequest{In: in, Out: in.Clone(in.Context())}
+	setForwardingHeaders(pr, trusted)
+	return pr.Out.Header
+}
+
+func TestSetForwardingHeaders(t *testing.T) {
+	trusted, _ := parseTrustedProxies([]string{"10.0.0.0/8"})
+	spoofed := http.Header{
+		"X-Forwarded-For":   {"1.2.3.4"},
+		"X-Forwarded-Host":  {"evil.example"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Port":  {"443"},
+		"Forwarded":         {"for=1.2.3.4"},
+		"X-Real-Ip":         {"1.2.3.4"},
+		"Fly-Client-Ip":     {"1.2.3.4"},
+	}
+
+	tests := []struct {
+		name   string
+		peer   string
+		header http.Header
+		want   map[string]string
+	}{
+		{
+			name:   "untrusted peer's headers are replaced",
+			peer:   "203.0.113.7:5000",
+			header: spoofed.Clone(),
+			want: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7",
+				"X-Forwarded-Host":  "shop.example",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Port":  "",
+				"Forwarded":         "for=203.0.113.7;host=shop.example;proto=http",
+				"X-Real-IP":         "203.0.113.7",
+				"Fly-Client-IP":     "",
+			},
+		},
+		{
+			name: "trusted proxy's chain is extended",
+			peer: "10.0.0.2:5000",
+			header: http.Header{
+				"X-Forwarded-For":   {"198.51.100.1, 10.0.0.9"},
+				"X-Forwarded-Host":  {"www.shop.example"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Port":  {"443"},
+				"Forwarded":         {"for=198.51.100.1;proto=https"},
+			},
+			want: map[string]string{
+				"X-Forwarded-For":   "198.51.100.1, 10.0.0.9, 10.0.0.2",
+				"X-Forwarded-Host":  "www.shop.example",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Port":  "443",
+				"Forwarded":         "for=198.51.100.1;proto=https, for=10.0.0.2;host=www.shop.example;proto=https",
+				"X-Real-IP":         "198.51.100.1",
+			},
+		},
+		{
+			name:   "IPv6 peer is bracketed and quoted in Forwarded",
+			peer:   "[2001:db8::1]:5000",
+			header: http.Header{},
+			want: map[string]string{
+				"X-Forwarded-For": "2001:db8::1",
+				"Forwarded":       `for="[2001:db8::1]";host=shop.example;proto=http`,
+				"X-Real-IP":       "2001:db8::1",
+			},
+		},
+		{
+			name:   "unparsable peer",
+			peer:   "pipe",
+			header: http.Header{},
+			want: map[string]string{
+				"X-Forwarded-For": "unknown",
+				"Forwarded":       "for=unknown;host=shop.example;proto=http",
+			},
+		},
+	}
+	for _, tt := range tests {
+		out := forwardedRequest(t, tt.peer, tt.header, trusted)
+		for name, value := range tt.want {
+			if got := strings.Join(out.Values(name), ", "); got != value {
+				t.Errorf("%s: %s = %q, want %q", tt.name, name, got, value)
+			}
+		}
+	}
+}
+
+func TestSetForwardingHeadersTLS(t *testing.T) {
+	in := httptest.NewRequest("GET", "https://shop.example/", nil)
+	in.TLS = &tls.ConnectionState{}
+	pr := &httputil.ProxyRequest{In: in, Out: in.Clone(in.Context())}
+	setForwardingHeaders(pr, nil)
+	if got := pr.Out.Header.Get("X-Forwarded-Proto"); got != "https" {
+		t.Errorf("X-Forwarded-Proto = %q", got)
+	}
+}
+
+func TestForwardedValue(t *testing.T) {
+	tests := map[string]string{
+		"203.0.113.7":      "203.0.113.7",
+		"shop.example":     "shop.example",
+		"[2001:db8::1]":    `"[2001:db8::1]"`,
+		"shop.example:443": `"shop.example:443"`,
+		`a"b\c`:            `"a\"b\\c"`,
+		"":                 `""`,
+	}
+	for in, want := range tests {
+		if got := forwardedValue(in); got != want {
+			t.Errorf("forwardedValue(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestHeaderPolicyFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *HeaderPolicyConfig
+		want   []string
+	}{
+		{"no policy", nil, []string{"Accept", "Authorization", "X-Api-Key", "X-Debug-Id", "X-Debug-Trace"}},
+		{"deny", &HeaderPolicyConfig{Deny: []string{"x-api-key"}}, []string{"Accept", "Authorization", "X-Debug-Id", "X-Debug-Trace"}},
+		{"deny prefix", &HeaderPolicyConfig{Deny: []string{"X-Debug-*"}}, []string{"Accept", "Authorization", "X-Api-Key"}},
+		{"allow", &HeaderPolicyConfig{Allow: []string{"Accept", "X-Debug-*"}}, []string{"Accept", "X-Debug-Id", "X-Debug-Trace"}},
+		{"deny wins over allow", &HeaderPolicyConfig{Allow: []string{"Accept", "X-Debug-*"}, Deny: []string{"X-Debug-Trace"}}, []string{"Accept", "X-Debug-Id"}},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		for _, name := range []string{"Accept", "Authorization", "X-Api-Key", "X-Debug-Id", "X-Debug-Trace"} {
+			h.Set(name, "v")
+		}
+		newHeaderPolicy(tt.config).filter(h)
+		var got []string
+		for _, name := range []string{"Accept", "Authorization", "X-Api-Key", "X-Debug-Id", "X-Debug-Trace"} {
+			if h.Get(name) != "" {
+				got = append(got, name)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: forwarded %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidHeaderPattern(t *testing.T) {
+	for pattern, want := range map[string]bool{
+		"X-API-Key": true,
+		"X-Debug-*": true,
+		"*":         false,
+		"":          false,
+		"X API Key": false,
+		"X-Key:":    false,
+	} {
+		if got := validHeaderPattern(pattern); got != want {
+			t.Errorf("validHeaderPattern(%q) = %v, want %v", pattern, got, want)
+		}
+	}
+}
+
+func TestProxyStripsHopByHopAndDeniedHeaders(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		io.WriteString(w, `{}`)
+	}))
+	defer backend.Close()
+	g := newTestGateway(t, `
+upstreams:
+  postgrest:
+    url: `+backend.URL+`
+    request_headers:
+      deny: [X-API-Key]
+routes:
+  - name: postgrest
+    prefix: /rest/
+    upstream: postgrest
+    strip_prefix: /rest
+    auth: none
+`)
+
+	r := httptest.NewRequest("GET", "/rest/products", nil)
+	r.Header.Set("Connection", "keep-alive, X-Session-Hint")
+	r.Header.Set("X-Session-Hint", "abc")
+	r.Header.Set("Keep-Alive", "timeout=5")
+	r.Header.Set("Proxy-Authorization", "Basic Zm9vOmJhcg==")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("X-API-Key", "gateway-key")
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	r.Header.Set("Accept", "application/json")
+	if w := serveGateway(g, r); w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+
+	for _, name := range []string{"Connection", "X-Session-Hint", "Keep-Alive", "Proxy-Authorization", "Upgrade", "X-API-Key"} {
+		if v := received.Get(name); v != "" {
+			t.Errorf("%s forwarded: %q", name, v)
+		}
+	}
+	if got := received.Get("Accept"); got != "application/json" {
+		t.Errorf("Accept = %q", got)
+	}
+	if got := received.Get("X-Forwarded-For"); got != "192.0.2.1" {
+		t.Errorf("X-Forwarded-For = %q, want the peer only", got)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Defaults for upstream health checking
+const (
+	defaultProbeInterval      = 10 * time.Second
+	defaultProbeTimeout       = 2 * time.Second
+	defaultHealthyThreshold   = 2
+	defaultUnhealthyThreshold = 3
+	defaultMaxFailures        = 5
+	defaultBaseEjection       = 10 * time.Second
+	defaultMaxEjection        = 5 * time.Minute
+)
+
+// Client used for health probes; each probe sets its own timeout
+var probeClient = &http.Client{}
+
+// targetHealth tracks whether a target should receive traffic. A target is
+// taken out of rotation either by failing active probes or, passively, by
+// returning too many consecutive 5xx responses or connection errors.
+type targetHealth struct {
+	mu sync.Mutex
+
+	// Active probing
+	probeHealthy bool
+	probeStreak  int // consecutive probe results contradicting probeHealthy
+	lastProbe    time.Time
+	lastError    string
+
+	// Passive ejection
+	failures     int // consecutive failed requests
+	ejections    int // consecutive ejections, drives the backoff
+	ejectedUntil time.Time
+}
+
+// available reports whether the target may receive requests. An ejected
+// target becomes available again once its backoff expires; the next
+// request then decides whether it stays in rotation.
+func (t *upstreamTarget) available(now time.Time) bool {
+	t.health.mu.Lock()
+	defer t.health.mu.Unlock()
+	return t.health.probeHealthy && !now.Before(t.health.ejectedUntil)
+}
+
+// report records the outcome of a request proxied to the target.
+// Connection errors and 5xx responses count as failures.
+func (p *upstreamPool) report(t *upstreamTarget, err error, status int) {
+	failed := err != nil || status >= 500
+
+	t.health.mu.Lock()
+	defer t.health.mu.Unlock()
+
+	if !failed {
+		if t.health.ejections > 0 {
+			slog.Info("Upstream target recovered", "upstream", p.name, "target", t.url)
+		}
+		t.health.failures = 0
+		t.health.ejections = 0
+		return
+	}
+
+	t.health.failures++
+	if err != nil {
+		t.health.lastError = err.Error()
+	} else {
+		t.health.lastError = http.StatusText(status)
+	}
+
+	// A target that just came back from ejection is ejected again on its
+	// first failure; otherwise it gets max_failures attempts
+	if t.health.failures < p.passive.maxFailures && t.health.ejections == 0 {
+		return
+	}
+	if time.Now().Before(t.health.ejectedUntil) {
+		return
+	}
+
+	backoff := p.passive.baseEjection << t.health.ejections
+	if backoff > p.passive.maxEjection || backoff <= 0 {
+		backoff = p.passive.maxEjection
+	}
+	t.health.ejections++
+	t.health.failures = 0
+	t.health.ejectedUntil = time.Now().Add(backoff)
+	slog.Warn("Upstream target ejected", "upstream", p.name, "target", t.url, "ejection", backoff.String(), "error", t.health.lastError)
+}
+
+// passivePolicy holds the resolved passive ejection settings of a pool
+type passivePolicy struct {
+	maxFailures  int
+	baseEjection time.Duration
+	maxEjection  time.Duration
+}
+
+func newPassivePolicy(cfg *PassiveHealthConfig) passivePolicy {
+	policy := passivePolicy{
+		maxFailures:  defaultMaxFailures,
+		baseEjection: defaultBaseEjection,
+		maxEjection:  defaultMaxEjection,
+	}
+	if cfg == nil {
+		return policy
+	}
+	if cfg.MaxFailures > 0 {
+		policy.maxFailures = cfg.MaxFailures
+	}
+	if cfg.BaseEjection > 0 {
+		policy.baseEjection = time.Duration(cfg.BaseEjection)
+	}
+	if cfg.MaxEjection > 0 {
+		policy.maxEjection = time.Duration(cfg.MaxEjection)
+	}
+	return policy
+}
+
+// startHealthChecks probes every target of the pool until stop is closed
+func (p *upstreamPool) startHealthChecks(cfg *HealthCheckConfig, client *http.Client, stop <-chan struct{}) {
+	interval := time.Duration(cfg.Interval)
+	if interval <= 0 {
+		interval = defaultProbeInterval
+	}
+	timeout := time.Duration(cfg.Timeout)
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	healthyThreshold := cfg.HealthyThreshold
+	if healthyThreshold <= 0 {
+		healthyThreshold = defaultHealthyThreshold
+	}
+	unhealthyThreshold := cfg.UnhealthyThreshold
+	if unhealthyThreshold <= 0 {
+		unhealthyThreshold = defaultUnhealthyThreshold
+	}
+
+	for _, target := range p.targets {
+		go func(t *upstreamTarget) {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				p.probe(t, cfg.Path, timeout, client, healthyThreshold, unhealthyThreshold)
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+				}
+			}
+		}(target)
+	}
+}
+
+func (p *upstreamPool) probe(t *upstreamTarget, path string, timeout time.Duration, client *http.Client, healthyThreshold, unhealthyThreshold int) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var probeErr string
+	req, err := http.NewRequestWithContext(ctx, "GET", t.url+path, nil)
+	if err == nil {
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 400 {
+				probeErr = "health check returned " + resp.Status
+			}
+		}
+	}
+	if err != nil {
+		probeErr = err.Error()
+	}
+	ok := probeErr == ""
+
+	t.health.mu.Lock()
+	defer t.health.mu.Unlock()
+
+	t.health.lastProbe = time.Now()
+	if !ok {
+		t.health.lastError = probeErr
+	}
+	if ok == t.health.probeHealthy {
+		t.health.probeStreak = 0
+		return
+	}
+
+	t.health.probeStreak++
+	switch {
+	case ok && t.health.probeStreak >= healthyThreshold:
+		t.health.probeHealthy = true
+		t.health.probeStreak = 0
+		slog.Info("Upstream target passed health checks, back in rotation", "upstream", p.name, "target", t.url)
+	case !ok && t.health.probeStreak >= unhealthyThreshold:
+		t.health.probeHealthy = false
+		t.health.probeStreak = 0
+		slog.Warn("Upstream target failed health checks, out of rotation", "upstream", p.name, "target", t.url, "error", probeErr)
+	}
+}
+
+// targetStatus is the health of one target as reported by the admin endpoint
+type targetStatus struct {
+	URL                 string     `json:"url"`
+	Available           bool       `json:"available"`
+	HealthCheckPassing  bool       `json:"health_check_passing"`
+	LastProbe           *time.Time `json:"last_probe,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Ejections           int        `json:"ejections"`
+	EjectedUntil        *time.Time `json:"ejected_until,omitempty"`
+	ActiveRequests      int64      `json:"active_requests"`
+}
+
+// poolStatus is the health of one upstream as reported by the admin endpoint
+type poolStatus struct {
+	Balancer      string         `json:"balancer"`
+	HealthChecked bool           `json:"health_checked"`
+	Circuit       string         `json:"circuit,omitempty"`
+	Targets       []targetStatus `json:"targets"`
+}
+
+func (p *upstreamPool) status(now time.Time) poolStatus {
+	status := poolStatus{Balancer: p.balancer, HealthChecked: p.healthCheck != nil, Circuit: p.breaker.currentState()}
+	for _, t := range p.targets {
+		t.health.mu.Lock()
+		ts := targetStatus{
+			URL:                 t.url,
+			Available:           t.health.probeHealthy && !now.Before(t.health.ejectedUntil),
+			HealthCheckPassing:  t.health.probeHealthy,
+			LastError:           t.health.lastError,
+			ConsecutiveFailures: t.health.failures,
+			Ejections:           t.health.ejections,
+			ActiveRequests:      t.inFlight(),
+		}
+		if !t.health.lastProbe.IsZero() {
+			lastProbe := t.health.lastProbe
+			ts.LastProbe = &lastProbe
+		}
+		if now.Before(t.health.ejectedUntil) {
+			ejectedUntil := t.health.ejectedUntil
+			ts.EjectedUntil = &ejectedUntil
+		}
+		t.health.mu.Unlock()
+		status.Targets = append(status.Targets, ts)
+	}
+	return status
+}
+
+// Admin handler reporting the health of every upstream target
+func (g *Gateway) handleUpstreamHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		g.sendResponse(w, http.StatusMethodNotAllowed, nil, &ErrorInfo{
+			Code:    "METHOD_NOT_ALLOWED",
+			Message: "Method " + r.Method + " is not allowed",
+		})
+		return
+	}
+
+	now := time.Now()
+	upstreams := g.state.Load().upstreams
+	data := make(map[string]poolStatus, len(upstreams))
+	for name, pool := range upstreams {
+		data[name] = pool.status(now)
+	}
+	g.sendResponse(w, http.StatusOK, data, nil)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ejection returns how long the target stays ejected, rounded to the second
+func ejection(target *upstreamTarget) time.Duration {
+	target.health.mu.Lock()
+	defer target.health.mu.Unlock()
+	return time.Until(target.health.ejectedUntil).Round(time.Second)
+}
+
+// expire ends the target's current ejection
+func expire(target *upstreamTarget) {
+	target.health.mu.Lock()
+	target.health.ejectedUntil = time.Now().Add(-time.Millisecond)
+	target.health.mu.Unlock()
+}
+
+func TestPassiveEjectionBackoff(t *testing.T) {
+	pool := newUpstreamPool("backend", UpstreamConfig{
+		Targets: []string{"http://a", "http://b"},
+		PassiveHealth: &PassiveHealthConfig{
+			MaxFailures:  3,
+			BaseEjection: Duration(10 * time.Second),
+			MaxEjection:  Duration(35 * time.Second),
+		},
+	})
+	target := pool.targets[0]
+	refused := errors.New("connection refused")
+
+	// Client errors don't count; max_failures consecutive failures eject
+	pool.report(target, nil, http.StatusNotFound)
+	pool.report(target, refused, 0)
+	pool.report(target, nil, http.StatusBadGateway)
+	if !target.available(time.Now()) {
+		t.Fatal("ejected before max_failures")
+	}
+	pool.report(target, nil, http.StatusServiceUnavailable)
+	if target.available(time.Now()) || ejection(target) != 10*time.Second {
+		t.Fatalf("first ejection = %s", ejection(target))
+	}
+
+	// Failures reported while ejected, by requests already in flight,
+	// don't extend the ejection
+	pool.report(target, refused, 0)
+	if got := ejection(target); got != 10*time.Second {
+		t.Errorf("ejection after in-flight failure = %s", got)
+	}
+
+	// A target back from ejection is ejected again on its first failure,
+	// for twice as long, up to max_ejection
+	for _, want := range []time.Duration{20 * time.Second, 35 * time.Second, 35 * time.Second} {
+		expire(target)
+		if !target.available(time.Now()) {
+			t.Fatal("still ejected after backoff")
+		}
+		pool.report(target, nil, http.StatusInternalServerError)
+		if got := ejection(target); got != want {
+			t.Errorf("ejection = %s, want %s", got, want)
+		}
+	}
+	if status := pool.status(time.Now()); status.Targets[0].Ejections != 4 || status.Targets[0].EjectedUntil == nil || status.Targets[0].Available {
+		t.Errorf("status = %+v", status.Targets[0])
+	}
+
+	// A success resets the backoff
+	expire(target)
+	pool.report(target, nil, http.StatusOK)
+	pool.report(target, refused, 0)
+	pool.report(target, refused, 0)
+	if !target.available(time.Now()) {
+		t.Fatal("ejected on the first failures after recovering")
+	}
+	pool.report(target, refused, 0)
+	if got := ejection(target); got != 10*time.Second {
+		t.Errorf("ejection after recovery = %s", got)
+	}
+
+	// Other targets are unaffected
+	if !pool.targets[1].available(time.Now()) {
+		t.Error("other target ejected")
+	}
+}
+
+func TestPassivePolicyDefaults(t *testing.T) {
+	policy := newPassivePolicy(nil)
+	if policy.maxFailures != defaultMaxFailures || policy.baseEjection != defaultBaseEjection || policy.maxEjection != defaultMaxEjection {
+		t.Errorf("defaults = %+v", policy)
+	}
+	policy = newPassivePolicy(&PassiveHealthConfig{MaxFailures: 2})
+	if policy.maxFailures != 2 || policy.baseEjection != defaultBaseEjection {
+		t.Errorf("partial config = %+v", policy)
+	}
+
+	// Doubling never overflows past max_ejection
+	pool := newUpstreamPool("backend", UpstreamConfig{Targets: []string{"http://a", "http://b"}, PassiveHealth: &PassiveHealthConfig{MaxFailures: 1}})
+	target := pool.targets[0]
+	target.health.ejections = 70
+	pool.report(target, nil, http.StatusBadGateway)
+	if got := ejection(target); got != defaultMaxEjection {
+		t.Errorf("ejection after many = %s", got)
+	}
+}
+
+func TestActiveHealthChecks(t *testing.T) {
+	var failing atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" || failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+	pool := newUpstreamPool("backend", UpstreamConfig{Targets: []string{backend.URL, "http://b"}})
+	target := pool.targets[0]
+	probe := func() { pool.probe(target, "/health", time.Second, probeClient, 2, 3) }
+
+	probe()
+	if !target.available(time.Now()) {
+		t.Fatal("healthy target out of rotation")
+	}
+
+	// unhealthy_threshold consecutive failures take the target out
+	failing.Store(true)
+	probe()
+	probe()
+	if !target.available(time.Now()) {
+		t.Fatal("out of rotation before unhealthy_threshold")
+	}
+	probe()
+	if target.available(time.Now()) {
+		t.Fatal("still in rotation after unhealthy_threshold failures")
+	}
+	if status := pool.status(time.Now()); status.Targets[0].HealthCheckPassing || status.Targets[0].LastError != "health check returned 503 Service Unavailable" {
+		t.Errorf("status = %+v", status.Targets[0])
+	}
+
+	// A success in between restarts the count
+	failing.Store(false)
+	probe()
+	failing.Store(true)
+	probe()
+	failing.Store(false)
+	probe()
+	if target.available(time.Now()) {
+		t.Fatal("back in rotation without healthy_threshold consecutive successes")
+	}
+	probe()
+	if !target.available(time.Now()) {
+		t.Fatal("not back after healthy_threshold successes")
+	}
+
+	// Connection errors fail probes too
+	unreachable := newUpstreamPool("backend", UpstreamConfig{Targets: []string{"http://127.0.0.1:1", "http://b"}})
+	for i := 0; i < 3; i++ {
+		unreachable.probe(unreachable.targets[0], "/health", time.Second, probeClient, 2, 3)
+	}
+	if unreachable.targets[0].available(time.Now()) {
+		t.Error("unreachable target in rotation")
+	}
+}
+
+func TestUpstreamHealthEndpoint(t *testing.T) {
+	g := newTestGateway(t, `
+upstreams:
+  backend:
+    targets: [http://a.internal, http://b.internal]
+routes:
+  - name: backend
+    prefix: /
+    upstream: backend
+    auth: none
+`)
+	pool := g.state.Load().upstreams["backend"]
+	eject(pool.targets[1])
+
+	w := httptest.NewRecorder()
+	g.handleUpstreamHealth(w, httptest.NewRequest("GET", "/admin/upstreams", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	for _, want := range []string{`"url":"http://a.internal","available":true`, `"url":"http://b.internal","available":false`, `"balancer":"round_robin"`} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("body %s lacks %s", w.Body, want)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	g.handleUpstreamHealth(w, httptest.NewRequest("POST", "/admin/upstreams", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status = %d", w.Code)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Defaults for idempotency keys
+const (
+	defaultIdempotencyTTL         = 24 * time.Hour
+	defaultIdempotencyLockTimeout = time.Minute
+	maxIdempotencyKeyLength       = 255
+)
+
+// idempotencyStore remembers the responses to requests sent with an
+// Idempotency-Key so that a client retrying a checkout or deposit session
+// creation gets the original result instead of a second order
+type idempotencyStore struct {
+	store       kvStore
+	ttl         time.Duration
+	lockTimeout time.Duration
+}
+
+// idempotencyRecord is what the store keeps for a key: only the request
+// fingerprint while the first request is in flight, then its response
+type idempotencyRecord struct {
+	Fingerprint string `json:"fingerprint"`
+	Completed   bool   `json:"completed"`
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+func newIdempotencyStore(store kvStore, cfg *IdempotencyConfig) *idempotencyStore {
+	s := &idempotencyStore{
+		store:       store,
+		ttl:         defaultIdempotencyTTL,
+		lockTimeout: defaultIdempotencyLockTimeout,
+	}
+	if cfg != nil {
+		if cfg.TTL > 0 {
+			s.ttl = time.Duration(cfg.TTL)
+		}
+		if cfg.LockTimeout > 0 {
+			s.lockTimeout = time.Duration(cfg.LockTimeout)
+		}
+	}
+	return s
+}
+
+// idempotent wraps an API handler so that requests carrying an
+// Idempotency-Key are executed at most once per key and route
+func idempotent(handler func(g *Gateway, w http.ResponseWriter, r *http.Request)) func(g *Gateway, w http.ResponseWriter, r *http.Request) {
+	return func(g *Gateway, w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			handler(g, w, r)
+			return
+		}
+		g.serveIdempotent(handler, key, w, r)
+	}
+}
+
+func (g *Gateway) serveIdempotent(handler func(g *Gateway, w http.ResponseWriter, r *http.Request), key string, w http.ResponseWriter, r *http.Request) {
+	if len(key) > maxIdempotencyKeyLength {
+		g.sendResponse(w, http.StatusBadRequest, nil, &ErrorInfo{
+			Code:    "VALIDATION_ERROR",
+			Message: "Idempotency-Key must be at most 255 characters",
+		})
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if g.sendBodyTooLarge(w, err) {
+		return
+	}
+	if err != nil {
+		g.sendResponse(w, http.StatusBadRequest, nil, &ErrorInfo{
+			Code:    "VALIDATION_ERROR",
+			Message: "Invalid request body",
+		})
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	// Keys are scoped to the client and route; a different body on the same
+	// route is a client bug and is rejected rather than replayed
+	sum := sha256.Sum256(body)
+	fingerprint := hex.EncodeToString(sum[:])
+	client := requestAttr(r, "apiKey") + "/" + requestAttr(r, "customerId")
+	storeKey := "idempotency:" + client + ":" + r.Method + " " + r.URL.Path + ":" + key
+
+	// Store operations must finish even if the client goes away
+	ctx := context.WithoutCancel(r.Context())
+	idem := g.state.Load().idempotency
+
+	record, acquired, err := idem.begin(ctx, storeKey, fingerprint)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Idempotency store error", "method", r.Method, "path", r.URL.Path, "error", err)
+		g.sendResponse(w, http.StatusServiceUnavailable, nil, &ErrorInfo{
+			Code:    "IDEMPOTENCY_UNAVAILABLE",
+			Message: "Idempotency keys cannot be processed right now, try again later",
+		})
+		return
+	}
+
+	if !acquired {
+		switch {
+		case record.Fingerprint != fingerprint:
+			g.sendResponse(w, http.StatusConflict, nil, &ErrorInfo{
+				Code:    "IDEMPOTENCY_KEY_REUSED",
+				Message: "Idempotency-Key was already used with a different request body",
+			})
+		case !record.Completed:
+			w.Header().Set("Retry-After", "1")
+			g.sendResponse(w, http.StatusConflict, nil, &ErrorInfo{
+				Code:    "IDEMPOTENCY_REQUEST_IN_PROGRESS",
+				Message: "A request with this Idempotency-Key is still being processed",
+			})
+		default:
+			w.Header().Set("Content-Type", record.ContentType)
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(record.Status)
+			w.Write(record.Body)
+		}
+		return
+	}
+
+	// The key now guards the request, so its upstream calls may be retried
+	setRequestAttr(r, "idempotencyKey", key)
+
+	cw := &capturingWriter{ResponseWriter: w, statusCode: http.StatusOK}
+	completed := false
+	defer func() {
+		// Free the key if the handler panicked so the client can retry
+		if !completed {
+			idem.store.Delete(ctx, storeKey)
+		}
+	}()
+
+	handler(g, cw, r)
+
+	completed = true
+	if cw.statusCode >= 500 {
+		// Server errors are not final; let the client retry with the same key
+		if err := idem.store.Delete(ctx, storeKey); err != nil {
+			slog.ErrorContext(r.Context(), "Idempotency store error releasing key", "method", r.Method, "path", r.URL.Path, "error", err)
+		}
+		return
+	}
+	if err := idem.complete(ctx, storeKey, idempotencyRecord{
+		Fingerprint: fingerprint,
+		Completed:   true,
+		Status:      cw.statusCode,
+		ContentType: cw.Header().Get("Content-Type"),
+		Body:        cw.body.Bytes(),
+	}); err != nil {
+		slog.ErrorContext(r.Context(), "Idempotency store error saving response", "method", r.Method, "path", r.URL.Path, "error", err)
+	}
+}
+
+// begin claims key for a new request. If the key is already taken it
+// returns the existing record instead.
+func (s *idempotencyStore) begin(ctx context.Context, key, fingerprint string) (*idempotencyRecord, bool, error) {
+	pending, err := json.Marshal(idempotencyRecord{Fingerprint: fingerprint})
+	if err != nil {
+		return nil, false, err
+	}
+
+	// The existing record can expire between the two calls, so try twice
+	for i := 0; i < 2; i++ {
+		acquired, err := s.store.SetNX(ctx, key, pending, s.lockTimeout)
+		if err != nil || acquired {
+			return nil, acquired, err
+		}
+
+		data, ok, err := s.store.Get(ctx, key)
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			continue
+		}
+		var record idempotencyRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, false, err
+		}
+		return &record, false, nil
+	}
+	return &idempotencyRecord{Fingerprint: fingerprint}, false, nil
+}
+
+// complete stores the response of the request that claimed key
+func (s *idempotencyStore) complete(ctx context.Context, key string, record idempotencyRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.store.Set(ctx, key, data, s.ttl)
+}
+
+// capturingWriter passes a response through while keeping a copy of it
+type capturingWriter struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (cw *capturingWriter) WriteHeader(code int) {
+	cw.statusCode = code
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *capturingWriter) Write(b []byte) (int, error) {
+	cw.body.Write(b)
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *capturingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// idempotencyStores runs a test against the memory store and a Redis
+// store backed by a local fake server
+func idempotencyStores(t *testing.T, test func(t *testing.T, g *Gateway)) {
+	stores := map[string]func(t *testing.T) kvStore{
+		"memory": func(t *testing.T) kvStore { return newMemoryStore() },
+		"redis":  func(t *testing.T) kvStore { return newTestRedisStore(t, newFakeRedis(t, "")) },
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			g := &Gateway{}
+			g.state.Store(&gatewayState{
+				idempotency: newIdempotencyStore(newStore(t), &IdempotencyConfig{LockTimeout: Duration(time.Minute)}),
+			})
+			test(t, g)
+		})
+	}
+}
+
+// serveIdempotentRequest sends a POST with an Idempotency-Key through handler
+func serveIdempotentRequest(g *Gateway, handler func(g *Gateway, w http.ResponseWriter, r *http.Request), key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/gw/v1/cart/checkout", strings.NewReader(body))
+	r.Header.Set("Idempotency-Key", key)
+	w := httptest.NewRecorder()
+	idempotent(handler)(g, w, r)
+	return w
+}
+
+func envelopeErrorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var envelope ResponseEnvelope
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	if envelope.Error == nil {
+		return ""
+	}
+	return envelope.Error.Code
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	idempotencyStores(t, func(t *testing.T, g *Gateway) {
+		var calls atomic.Int32
+		handler := func(g *Gateway, w http.ResponseWriter, r *http.Request) {
+			n := calls.Add(1)
+			g.sendResponse(w, http.StatusCreated, map[string]int32{"order": n}, nil)
+		}
+
+		first := serveIdempotentRequest(g, handler, "key-1", `{"cartId":"c1"}`)
+		second := serveIdempotentRequest(g, handler, "key-1", `{"cartId":"c1"}`)
+		if n := calls.Load(); n != 1 {
+			t.Fatalf("handler ran %d times, want 1", n)
+		}
+		if second.Code != http.StatusCreated || second.Body.String() != first.Body.String() {
+			t.Errorf("replay = %d %q, want %d %q", second.Code, second.Body, first.Code, first.Body)
+		}
+		if second.Header().Get("Idempotent-Replayed") != "true" || first.Header().Get("Idempotent-Replayed") != "" {
+			t.Errorf("Idempotent-Replayed = %q then %q", first.Header().Get("Idempotent-Replayed"), second.Header().Get("Idempotent-Replayed"))
+		}
+		if ct := second.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("replayed Content-Type = %q", ct)
+		}
+
+		// Another key is another request
+		serveIdempotentRequest(g, handler, "key-2", `{"cartId":"c1"}`)
+		if n := calls.Load(); n != 2 {
+			t.Fatalf("handler ran %d times, want 2", n)
+		}
+	})
+}
+
+func TestIdempotentBodyMismatch(t *testing.T) {
+	idempotencyStores(t, func(t *testing.T, g *Gateway) {
+		var calls atomic.Int32
+		handler := func(g *Gateway, w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			g.sendResponse(w, http.StatusOK, map[string]string{}, nil)
+		}
+
+		serveIdempotentRequest(g, handler, "key-1", `{"cartId":"c1"}`)
+		w := serveIdempotentRequest(g, handler, "key-1", `{"cartId":"c2"}`)
+		if w.Code != http.StatusConflict || envelopeErrorCode(t, w) != "IDEMPOTENCY_KEY_REUSED" {
+			t.Fatalf("mismatch = %d %q", w.Code, w.Body)
+		}
+		if n := calls.Load(); n != 1 {
+			t.Fatalf("handler ran %d times, want 1", n)
+		}
+	})
+}
+
+func TestIdempotentInProgress(t *testing.T) {
+	idempotencyStores(t, func(t *testing.T, g *Gateway) {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		handler := func(g *Gateway, w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			g.sendResponse(w, http.StatusOK, map[string]string{}, nil)
+		}
+
+		done := make(chan *httptest.ResponseRecorder)
+		go func() { done <- serveIdempotentRequest(g, handler, "key-1", `{}`) }()
+		<-started
+
+		w := serveIdempotentRequest(g, handler, "key-1", `{}`)
+		if w.Code != http.StatusConflict || envelopeErrorCode(t, w) != "IDEMPOTENCY_REQUEST_IN_PROGRESS" {
+			t.Fatalf("concurrent request = %d %q", w.Code, w.Body)
+		}
+		if w.Header().Get("Retry-After") == "" {
+			t.Error("Retry-After missing")
+		}
+
+		close(release)
+		if first := <-done; first.Code != http.StatusOK {
+			t.Fatalf("first request = %d", first.Code)
+		}
+		if w := serveIdempotentRequest(g, handler, "key-1", `{}`); w.Header().Get("Idempotent-Replayed") != "true" {
+			t.Fatalf("request after completion = %d %q, want replay", w.Code, w.Body)
+		}
+	})
+}
+
+func TestIdempotentReleasesKeyOnServerError(t *testing.T) {
+	idempotencyStores(t, func(t *testing.T, g *Gateway) {
+		var calls atomic.Int32
+		handler := func(g *Gateway, w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) == 1 {
+				g.sendResponse(w, http.StatusBadGateway, nil, &ErrorInfo{Code: "BACKEND_ERROR", Message: "down"})
+				return
+			}
+			g.sendResponse(w, http.StatusOK, map[string]string{}, nil)
+		}
+
+		if w := serveIdempotentRequest(g, handler, "key-1", `{}`); w.Code != http.StatusBadGateway {
+			t.Fatalf("first = %d", w.Code)
+		}
+		w := serveIdempotentRequest(g, handler, "key-1", `{}`)
+		if w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+			t.Fatalf("retry = %d, replayed %q; want the handler to run again", w.Code, w.Header().Get("Idempotent-Replayed"))
+		}
+		if n := calls.Load(); n != 2 {
+			t.Fatalf("handler ran %d times, want 2", n)
+		}
+	})
+}
+
+func TestIdempotentReleasesKeyOnPanic(t *testing.T) {
+	idempotencyStores(t, func(t *testing.T, g *Gateway) {
+		var calls atomic.Int32
+		handler := func(g *Gateway, w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) == 1 {
+				panic("handler failed")
+			}
+			g.sendResponse(w, http.StatusOK, map[string]string{}, nil)
+		}
+
+		func() {
+			defer func() { recover() }()
+			serveIdempotentRequest(g, handler, "key-1", `{}`)
+		}()
+		if w := serveIdempotentRequest(g, handler, "key-1", `{}`); w.Code != http.StatusOK {
+			t.Fatalf("retry after panic = %d %q", w.Code, w.Body)
+		}
+	})
+}
+
+func TestIdempotentStoreUnavailable(t *testing.T) {
+	f := newFakeRedis(t, "")
+	g := &Gateway{}
+	g.state.Store(&gatewayState{idempotency: newIdempotencyStore(newTestRedisStore(t, f), nil)})
+	f.listener.Close()
+
+	handler := func(g *Gateway, w http.ResponseWriter, r *http.Request) {
+		t.Error("handler ran without the key being claimed")
+	}
+	w := serveIdempotentRequest(g, handler, "key-1", `{}`)
+	if w.Code != http.StatusServiceUnavailable || envelopeErrorCode(t, w) != "IDEMPOTENCY_UNAVAILABLE" {
+		t.Fatalf("store down = %d %q", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Defaults for JWKS loading
+const (
+	defaultJWKSRefreshInterval = 10 * time.Minute
+	// Unknown key IDs trigger a refresh, at most this often
+	minJWKSRefreshInterval = 30 * time.Second
+	maxJWKSSize            = 1 << 20
+)
+
+// Client used to fetch JWKS documents
+var jwksClient = &http.Client{Timeout: 5 * time.Second}
+
+// verificationKey is a public key (or HMAC secret) tokens can be signed with
+type verificationKey struct {
+	kid string
+	alg string // algorithm the key is restricted to, if any
+	key interface{}
+}
+
+// jwk is a JSON Web Key (RFC 7517) as found in a JWKS document
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// keySet is a JWKS loaded from a URL or a file. It is refreshed
+// periodically and whenever a token names a key it doesn't know, so the
+// identity provider can rotate keys without a gateway restart.
+type keySet struct {
+	source          string
+	fromURL         bool
+	refreshInterval time.Duration
+	static          []verificationKey
+
+	mu          sync.Mutex
+	keys        []verificationKey
+	fetchedAt   time.Time
+	lastAttempt time.Time
+	// refreshing is closed when the refresh in progress, if any, finishes
+	refreshing chan struct{}
+}
+
+// lookup returns the keys a token with the given key ID may be signed with.
+// Stale keys are refreshed in the background while the cached ones keep
+// being served; only a token naming an unknown key waits for the refresh.
+func (ks *keySet) lookup(kid string, now time.Time) []verificationKey {
+	if ks.source == "" {
+		return matchingKeys(ks.static, kid)
+	}
+
+	ks.mu.Lock()
+	stale := now.Sub(ks.fetchedAt) >= ks.refreshInterval
+	keys := matchingKeys(ks.keys, kid)
+	var refreshed chan struct{}
+	if (stale || len(keys) == 0) && (ks.refreshing != nil || now.Sub(ks.lastAttempt) >= minJWKSRefreshInterval) {
+		refreshed = ks.startRefresh(now)
+	}
+	ks.mu.Unlock()
+
+	if len(keys) == 0 && refreshed != nil {
+		<-refreshed
+		ks.mu.Lock()
+		keys = matchingKeys(ks.keys, kid)
+		ks.mu.Unlock()
+	}
+	return append(keys, matchingKeys(ks.static, kid)...)
+}
+
+// startRefresh reloads the key set in the background, or joins the refresh
+// already in progress; mu must be held. The returned channel is closed once
+// the refresh finishes.
+func (ks *keySet) startRefresh(now time.Time) chan struct{} {
+	if ks.refreshing != nil {
+		return ks.refreshing
+	}
+	ks.lastAttempt = now
+	done := make(chan struct{})
+	ks.refreshing = done
+
+	go func() {
+		keys, err := ks.load()
+		ks.mu.Lock()
+		if err != nil {
+			slog.Warn("JWKS refresh failed, keeping cached keys", "source", ks.source, "keys", len(ks.keys), "error", err)
+		} else {
+			ks.keys = keys
+			ks.fetchedAt = now
+		}
+		ks.refreshing = nil
+		ks.mu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// load reads and parses the key set from its source
+func (ks *keySet) load() ([]verificationKey, error) {
+	var data []byte
+	var err error
+	if ks.fromURL {
+		data, err = fetchJWKS(ks.source)
+	} else {
+		data, err = os.ReadFile(ks.source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+func fetchJWKS(url string) ([]byte, error) {
+	resp, err := jwksClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS endpoint returned %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+}
+
+func matchingKeys(keys []verificationKey, kid string) []verificationKey {
+	if kid == "" {
+		return keys
+	}
+	var matches []verificationKey
+	for _, k := range keys {
+		if k.kid == kid {
+			matches = append(matches, k)
+		}
+	}
+	return matches
+}
+
+// parseJWKS decodes the signature keys of a JWKS document. Encryption keys
+// and key types the gateway can't verify with are skipped.
+func parseJWKS(data []byte) ([]verificationKey, error) {
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parsing JWKS: %w", err)
+	}
+
+	var keys []verificationKey
+	for i, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("JWKS key %d (%s): %w", i, k.Kid, err)
+		}
+		if key != nil {
+			keys = append(keys, verificationKey{kid: k.Kid, alg: k.Alg, key: key})
+		}
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid n: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid e")
+		}
+		if n.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA keys must be at least 2048 bits")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, nil
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x: %w", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y: %w", err)
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on P-256")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(k.K)
+		if err != nil || len(secret) == 0 {
+			return nil, fmt.Errorf("invalid k")
+		}
+		return secret, nil
+	}
+	return nil, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Signing algorithms the gateway can verify
+const (
+	jwtAlgRS256 = "RS256"
+	jwtAlgES256 = "ES256"
+	jwtAlgHS256 = "HS256"
+)
+
+// Defaults for JWT validation
+const (
+	defaultJWTClockSkew       = time.Minute
+	defaultJWTCustomerIDClaim = "sub"
+	defaultJWTRolesClaim      = "roles"
+)
+
+// jwtClaims are the claims of a validated bearer token
+type jwtClaims struct {
+	Subject    string
+	CustomerID string
+	Roles      []string
+	ExpiresAt  time.Time
+	// All holds every claim of the token, for handlers needing custom ones
+	All map[string]interface{}
+}
+
+type jwtClaimsContextKey struct{}
+
+// withClaims attaches validated token claims to the request context
+func withClaims(r *http.Request, claims *jwtClaims) *http.Request {
+	setRequestAttr(r, "customerId", claims.CustomerID)
+	return r.WithContext(context.WithValue(r.Context(), jwtClaimsContextKey{}, claims))
+}
+
+// claimsFromContext returns the claims of the request's bearer token, or nil
+// if the request was not authenticated with one
+func claimsFromContext(ctx context.Context) *jwtClaims {
+	claims, _ := ctx.Value(jwtClaimsContextKey{}).(*jwtClaims)
+	return claims
+}
+
+// jwtVerifier validates bearer tokens issued by the shop's identity provider
+type jwtVerifier struct {
+	keys            *keySet
+	issuer          string
+	audience        string
+	algorithms      map[string]bool
+	clockSkew       time.Duration
+	customerIDClaim string
+	rolesClaim      string
+}
+
+func newJWTVerifier(cfg *JWTConfig) (*jwtVerifier, error) {
+	if !cfg.enabled() {
+		return nil, nil
+	}
+
+	v := &jwtVerifier{
+		issuer:          cfg.Issuer,
+		audience:        cfg.Audience,
+		algorithms:      map[string]bool{},
+		clockSkew:       time.Duration(cfg.ClockSkew),
+		customerIDClaim: cfg.CustomerIDClaim,
+		rolesClaim:      cfg.RolesClaim,
+		keys: &keySet{
+			source:          cfg.JWKSURL,
+			fromURL:         cfg.JWKSURL != "",
+			refreshInterval: time.Duration(cfg.RefreshInterval),
+		},
+	}
+	if cfg.JWKSFile != "" {
+		v.keys.source = cfg.JWKSFile
+	}
+	if v.keys.refreshInterval <= 0 {
+		v.keys.refreshInterval = defaultJWTRefreshInterval(v.keys.fromURL)
+	}
+	if cfg.Secret != "" {
+		v.keys.static = []verificationKey{{alg: jwtAlgHS256, key: []byte(cfg.Secret)}}
+	}
+	algorithms := cfg.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = []string{jwtAlgRS256, jwtAlgES256, jwtAlgHS256}
+	}
+	for _, alg := range algorithms {
+		v.algorithms[alg] = true
+	}
+	if v.clockSkew <= 0 {
+		v.clockSkew = defaultJWTClockSkew
+	}
+	if v.customerIDClaim == "" {
+		v.customerIDClaim = defaultJWTCustomerIDClaim
+	}
+	if v.rolesClaim == "" {
+		v.rolesClaim = defaultJWTRolesClaim
+	}
+
+	if v.keys.source != "" {
+		now := time.Now()
+		keys, err := v.keys.load()
+		v.keys.lastAttempt = now
+		if err == nil {
+			v.keys.keys, v.keys.fetchedAt = keys, now
+		}
+		switch {
+		case err != nil && !v.keys.fromURL:
+			return nil, fmt.Errorf("jwt: %w", err)
+		case err != nil:
+			// The identity provider may be briefly unreachable; tokens are
+			// rejected until the keys can be fetched
+			slog.Warn("Fetching JWKS failed, will retry", "source", v.keys.source, "error", err)
+		}
+	}
+	return v, nil
+}
+
+// Key files are cheap to re-read; remote key sets are cached longer
+func defaultJWTRefreshInterval(fromURL bool) time.Duration {
+	if fromURL {
+		return defaultJWKSRefreshInterval
+	}
+	return minJWKSRefreshInterval
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// verify checks the token's signature and registered claims and returns its claims
+func (v *jwtVerifier) verify(token string, now time.Time) (*jwtClaims, error) {
+	if v == nil {
+		// A reload removed the jwt settings while the request was routed
+		return nil, errors.New("token validation is not configured")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	if !v.algorithms[header.Alg] {
+		return nil, fmt.Errorf("signing algorithm %q is not accepted", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	keys := v.keys.lookup(header.Kid, now)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("unknown signing key %q", header.Kid)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range keys {
+		if key.alg != "" && key.alg != header.Alg {
+			continue
+		}
+		if verifySignature(header.Alg, key.key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("signature verification failed")
+	}
+
+	var raw map[string]interface{}
+	if err := decodeJWTSegment(parts[1], &raw); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	return v.checkClaims(raw, now)
+}
+
+// checkClaims validates the registered claims: exp is required, nbf, iss
+// and aud are checked when present or configured
+func (v *jwtVerifier) checkClaims(raw map[string]interface{}, now time.Time) (*jwtClaims, error) {
+	exp, ok := raw["exp"].(float64)
+	if !ok {
+		return nil, errors.New("token has no expiry")
+	}
+	expiresAt := time.Unix(int64(exp), 0)
+	if now.After(expiresAt.Add(v.clockSkew)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := raw["nbf"].(float64); ok && now.Add(v.clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if v.issuer != "" && raw["iss"] != v.issuer {
+		return nil, errors.New("unexpected token issuer")
+	}
+	if v.audience != "" && !hasAudience(raw["aud"], v.audience) {
+		return nil, errors.New("unexpected token audience")
+	}
+
+	claims := &jwtClaims{ExpiresAt: expiresAt, All: raw}
+	claims.Subject, _ = raw["sub"].(string)
+	claims.CustomerID = claimString(raw[v.customerIDClaim])
+	switch roles := raw[v.rolesClaim].(type) {
+	case []interface{}:
+		for _, role := range roles {
+			if s, ok := role.(string); ok {
+				claims.Roles = append(claims.Roles, s)
+			}
+		}
+	case string:
+		claims.Roles = strings.Fields(roles)
+	}
+	return claims, nil
+}
+
+// hasAudience reports whether an aud claim (a string or an array) contains audience
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimString renders a string or numeric claim, such as a numeric customer ID
+func claimString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return big.NewFloat(v).Text('f', -1)
+	}
+	return ""
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifySignature checks a signature made with alg. The key type must
+// match the algorithm, so an RSA public key can never be used as an HMAC
+// secret.
+func verifySignature(alg string, key interface{}, signed, signature []byte) bool {
+	switch alg {
+	case jwtAlgRS256:
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil
+	case jwtAlgES256:
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return false
+		}
+		digest := sha256.Sum256(signed)
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(pub, digest[:], r, s)
+	case jwtAlgHS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	}
+	return false
+}
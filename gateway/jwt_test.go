@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testJWTSecret = "test-secret-that-is-long-enough-for-hs256"
+
+var (
+	testKeysOnce sync.Once
+	testRSAKey   *rsa.PrivateKey
+	testECKey    *ecdsa.PrivateKey
+)
+
+// testKeys generates the RSA and EC keys shared by the tests
+func testKeys(t *testing.T) (*rsa.PrivateKey, *ecdsa.PrivateKey) {
+	t.Helper()
+	testKeysOnce.Do(func() {
+		var err error
+		if testRSAKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			panic(err)
+		}
+		if testECKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			panic(err)
+		}
+	})
+	return testRSAKey, testECKey
+}
+
+// signJWT builds a token with the given header fields and claims, signed
+// with key using alg
+func signJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	signed := encodeJWTSegment(t, header) + "." + encodeJWTSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch alg {
+	case jwtAlgRS256:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case jwtAlgES256:
+		r, s, err := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	case jwtAlgHS256:
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	default:
+		t.Fatalf("unsupported alg %s", alg)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func encodeJWTSegment(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// testJWKS renders the public halves of the test keys as a JWKS document
+func testJWKS(t *testing.T, rsaKid, ecKid string) []byte {
+	t.Helper()
+	rsaKey, ecKey := testKeys(t)
+	b64 := base64.RawURLEncoding.EncodeToString
+	var keys []jwk
+	if rsaKid != "" {
+		keys = append(keys, jwk{
+			Kty: "RSA", Kid: rsaKid, Use: "sig", Alg: jwtAlgRS256,
+			N: b64(rsaKey.N.Bytes()), E: b64([]byte{1, 0, 1}),
+		})
+	}
+	if ecKid != "" {
+		x, y := make([]byte, 32), make([]byte, 32)
+		ecKey.X.FillBytes(x)
+		ecKey.Y.FillBytes(y)
+		keys = append(keys, jwk{Kty: "EC", Kid: ecKid, Use: "sig", Crv: "P-256", X: b64(x), Y: b64(y)})
+	}
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// jwksServer serves the JWKS returned by doc and counts the fetches
+func jwksServer(t *testing.T, doc func() []byte) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc())
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &fetches
+}
+
+func newTestVerifier(t *testing.T, cfg *JWTConfig) *jwtVerifier {
+	t.Helper()
+	v, err := newJWTVerifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func validClaims(now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"sub":   "customer-42",
+		"iss":   "https://id.example.com/",
+		"aud":   "storefront",
+		"exp":   now.Add(time.Hour).Unix(),
+		"iat":   now.Unix(),
+		"roles": []string{"customer"},
+	}
+}
+
+func TestJWTVerifySignatures(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+	srv, _ := jwksServer(t, func() []byte { return testJWKS(t, "rsa-1", "ec-1") })
+	v := newTestVerifier(t, &JWTConfig{
+		JWKSURL:  srv.URL,
+		Secret:   testJWTSecret,
+		Issuer:   "https://id.example.com/",
+		Audience: "storefront",
+	})
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		alg  string
+		kid  string
+		key  interface{}
+	}{
+		{"RS256", jwtAlgRS256, "rsa-1", rsaKey},
+		{"ES256", jwtAlgES256, "ec-1", ecKey},
+		{"HS256", jwtAlgHS256, "", []byte(testJWTSecret)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := v.verify(signJWT(t, tt.alg, tt.kid, tt.key, validClaims(now)), now)
+			if err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+			if claims.CustomerID != "customer-42" || len(claims.Roles) != 1 || claims.Roles[0] != "customer" {
+				t.Errorf("claims = %+v", claims)
+			}
+		})
+	}
+}
+
+func TestJWTRejectsInvalidTokens(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+	otherRSA, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, _ := jwksServer(t, func() []byte { return testJWKS(t, "rsa-1", "ec-1") })
+	v := newTestVerifier(t, &JWTConfig{
+		JWKSURL:  srv.URL,
+		Secret:   testJWTSecret,
+		Issuer:   "https://id.example.com/",
+		Audience: "storefront",
+	})
+	now := time.Now()
+
+	with := func(changes map[string]interface{}) map[string]interface{} {
+		claims := validClaims(now)
+		for k, val := range changes {
+			if val == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = val
+			}
+		}
+		return claims
+	}
+	rsaPublicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"expired", signJWT(t, jwtAlgRS256, "rsa-1", rsaKey, with(map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()})), "token expired"},
+		{"no expiry", signJWT(t, jwtAlgRS256, "rsa-1", rsaKey, with(map[string]interface{}{"exp": nil})), "token has no expiry"},
+		{"not valid yet", signJWT(t, jwtAlgRS256, "rsa-1", rsaKey, with(map[string]interface{}{"nbf": now.Add(2 * time.Minute).Unix()})), "token not valid yet"},
+		{"wrong issuer", signJWT(t, jwtAlgES256, "ec-1", ecKey, with(map[string]interface{}{"iss": "https://evil.example.com/"})), "unexpected token issuer"},
+		{"missing issuer", signJWT(t, jwtAlgES256, "ec-1", ecKey, with(map[string]interface{}{"iss": nil})), "unexpected token issuer"},
+		{"wrong audience", signJWT(t, jwtAlgHS256, "", []byte(testJWTSecret), with(map[string]interface{}{"aud": "admin"})), "unexpected token audience"},
+		{"audience list without ours", signJWT(t, jwtAlgHS256, "", []byte(testJWTSecret), with(map[string]interface{}{"aud": []string{"admin", "pos"}})), "unexpected token audience"},
+		{"other RSA key", signJWT(t, jwtAlgRS256, "rsa-1", otherRSA, validClaims(now)), "signature verification failed"},
+		{"wrong HMAC secret", signJWT(t, jwtAlgHS256, "", []byte("another-secret-that-is-long-enough"), validClaims(now)), "signature verification failed"},
+		// The RSA public key is known to everyone; it must never work as an HMAC secret
+		{"HS256 with RSA public key", signJWT(t, jwtAlgHS256, "rsa-1", rsaPublicDER, validClaims(now)), "signature verification failed"},
+		{"HS256 with RSA modulus", signJWT(t, jwtAlgHS256, "rsa-1", rsaKey.N.Bytes(), validClaims(now)), "signature verification failed"},
+		// An ES256 signature checked against the RSA key of the same kid
+		{"ES256 naming RSA key", signJWT(t, jwtAlgES256, "rsa-1", ecKey, validClaims(now)), "signature verification failed"},
+		{"RS256 naming EC key", signJWT(t, jwtAlgRS256, "ec-1", rsaKey, validClaims(now)), "signature verification failed"},
+		{"alg none", encodeJWTSegment(t, map[string]string{"alg": "none"}) + "." + encodeJWTSegment(t, validClaims(now)) + ".", `signing algorithm "none" is not accepted`},
+		{"malformed", "not-a-token", "malformed token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := v.verify(tt.token, now)
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("verify error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestJWTClockSkew(t *testing.T) {
+	v := newTestVerifier(t, &JWTConfig{Secret: testJWTSecret, ClockSkew: Duration(30 * time.Second)})
+	secret := []byte(testJWTSecret)
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		exp     time.Duration
+		nbf     time.Duration
+		wantErr bool
+	}{
+		{"expired within skew", -20 * time.Second, 0, false},
+		{"expired beyond skew", -40 * time.Second, 0, true},
+		{"not before within skew", time.Hour, 20 * time.Second, false},
+		{"not before beyond skew", time.Hour, 40 * time.Second, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := map[string]interface{}{"sub": "c", "exp": now.Add(tt.exp).Unix()}
+			if tt.nbf != 0 {
+				claims["nbf"] = now.Add(tt.nbf).Unix()
+			}
+			_, err := v.verify(signJWT(t, jwtAlgHS256, "", secret, claims), now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verify error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJWTAlgorithmAllowList(t *testing.T) {
+	rsaKey, _ := testKeys(t)
+	srv, _ := jwksServer(t, func() []byte { return testJWKS(t, "rsa-1", "") })
+	v := newTestVerifier(t, &JWTConfig{JWKSURL: srv.URL, Secret: testJWTSecret, Algorithms: []string{jwtAlgRS256}})
+	now := time.Now()
+
+	if _, err := v.verify(signJWT(t, jwtAlgRS256, "rsa-1", rsaKey, validClaims(now)), now); err != nil {
+		t.Fatalf("RS256: %v", err)
+	}
+	_, err := v.verify(signJWT(t, jwtAlgHS256, "", []byte(testJWTSecret), validClaims(now)), now)
+	if err == nil || !strings.Contains(err.Error(), "not accepted") {
+		t.Fatalf("HS256 error = %v, want algorithm rejected", err)
+	}
+}
+
+func TestJWKSRotation(t *testing.T) {
+	rsaKey, ecKey := testKeys(t)
+	var rotated atomic.Bool
+	srv, fetches := jwksServer(t, func() []byte {
+		if rotated.Load() {
+			return testJWKS(t, "rsa-1", "ec-2")
+		}
+		return testJWKS(t, "rsa-1", "")
+	})
+	v := newTestVerifier(t, &JWTConfig{JWKSURL: srv.URL})
+	now := time.Now()
+
+	if _, err := v.verify(signJWT(t, jwtAlgRS256, "rsa-1", rsaKey, validClaims(now)), now); err != nil {
+		t.Fatalf("RS256: %v", err)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("fetches = %d, want 1", n)
+	}
+
+	// A token naming a new key fetches the key set again and waits for it
+	rotated.Store(true)
+	later := now.Add(minJWKSRefreshInterval)
+	if _, err := v.verify(signJWT(t, jwtAlgES256, "ec-2", ecKey, validClaims(later)), later); err != nil {
+		t.Fatalf("ES256 after rotation: %v", err)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("fetches = %d, want 2", n)
+	}
+
+	// Unknown key IDs don't refetch more often than minJWKSRefreshInterval
+	if _, err := v.verify(signJWT(t, jwtAlgES256, "ec-3", ecKey, validClaims(later)), later.Add(time.Second)); err == nil {
+		t.Fatal("unknown key accepted")
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("fetches = %d, want 2", n)
+	}
+}
+
+func TestJWKSSlowRefreshServesCachedKeys(t *testing.T) {
+	rsaKey, _ := testKeys(t)
+	release := make(chan struct{})
+	var slow atomic.Bool
+	doc := testJWKS(t, "rsa-1", "")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slow.Load() {
+			<-release
+		}
+		w.Write(doc)
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	v := newTestVerifier(t, &JWTConfig{JWKSURL: srv.URL, RefreshInterval: Duration(time.Minute)})
+	slow.Store(true)
+
+	// The cached keys are stale, so each call triggers a refresh that
+	// hangs; verification must not wait for it
+	stale := time.Now().Add(2 * time.Minute)
+	token := signJWT(t, jwtAlgRS256, "rsa-1", rsaKey, validClaims(stale))
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 10; i++ {
+			if _, err := v.verify(token, stale); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("verify: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("verification blocked on the JWKS refresh")
+	}
+}
+
+func TestJWKSUnreachableAtStartup(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+
+	v := newTestVerifier(t, &JWTConfig{JWKSURL: srv.URL})
+	rsaKey, _ := testKeys(t)
+	now := time.Now()
+	if _, err := v.verify(signJWT(t, jwtAlgRS256, "rsa-1", rsaKey, validClaims(now)), now); err == nil {
+		t.Fatal("token accepted without keys")
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// kvStore is a small key-value store with expiry for gateway features that
+// keep state between requests. The Redis backend shares that state across
+// gateway instances; the in-memory one is per process.
+type kvStore interface {
+	// Get returns the value of key, or ok=false if it doesn't exist
+	Get(ctx context.Context, key string) (value []byte, ok bool, err error)
+	// Set stores value under key for ttl
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// SetNX stores value under key only if key doesn't exist and reports whether it did
+	SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+	// Delete removes key
+	Delete(ctx context.Context, key string) error
+}
+
+// newKVStore creates the store described by cfg
+func newKVStore(cfg StoreConfig) (kvStore, error) {
+	switch cfg.Type {
+	case "", "memory":
+		return newMemoryStore(), nil
+	case "redis":
+		return newRedisStore(cfg.URL)
+	default:
+		return nil, fmt.Errorf("unknown store type %q", cfg.Type)
+	}
+}
+
+// kvStore returns the store for cfg, reusing the one created for an identical
+// configuration so state survives config reloads
+func (g *Gateway) kvStore(cfg StoreConfig) (kvStore, error) {
+	g.storesMu.Lock()
+	defer g.storesMu.Unlock()
+
+	key := cfg.Type + " " + cfg.URL
+	if store, ok := g.stores[key]; ok {
+		return store, nil
+	}
+	store, err := newKVStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if g.stores == nil {
+		g.stores = map[string]kvStore{}
+	}
+	g.stores[key] = store
+	return store, nil
+}
+
+// memoryStore is a kvStore kept in process memory
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	s := &memoryStore{entries: map[string]memoryEntry{}}
+	go s.sweep(time.Minute)
+	return s
+}
+
+// sweep periodically drops expired entries
+func (s *memoryStore) sweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		s.mu.Lock()
+		for key, entry := range s.entries {
+			if now.After(entry.expires) {
+				delete(s.entries, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false, nil
+	}
+	return entry.value, true, nil
+}
+
+func (s *memoryStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = memoryEntry{value: value, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *memoryStore) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.entries[key]; ok && !time.Now().After(entry.expires) {
+		return false, nil
+	}
+	s.entries[key] = memoryEntry{value: value, expires: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// Connection settings for the Redis store
+const (
+	redisPoolSize    = 8
+	redisDialTimeout = 2 * time.Second
+	redisIOTimeout   = 2 * time.Second
+)
+
+// redisStore is a kvStore backed by any server speaking the Redis protocol
+// (Redis, Valkey, KeyDB, Upstash...). It is configured with a URL such as
+// redis://:password@localhost:6379/0, or rediss:// for TLS.
+type redisStore struct {
+	addr     string
+	useTLS   bool
+	username string
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// errRedisNil is the reply to commands on missing keys
+var errRedisNil = errors.New("redis: nil")
+
+// errRedisConnClosed marks a command that got no reply because the server
+// had closed the connection: its write failed, or the reply read ended
+// before its first byte
+var errRedisConnClosed = errors.New("connection closed by server")
+
+func newRedisStore(rawURL string) (*redisStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+		return nil, fmt.Errorf("invalid redis url %q", redactURLPassword(rawURL))
+	}
+	s := &redisStore{
+		addr:   u.Host,
+		useTLS: u.Scheme == "rediss",
+		idle:   make(chan *redisConn, redisPoolSize),
+	}
+	if !strings.Contains(u.Host, ":") {
+		s.addr += ":6379"
+	}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	return s, nil
+}
+
+func (s *redisStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	reply, err := s.do(ctx, "GET", key)
+	if errors.Is(err, errRedisNil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected GET reply %v", reply)
+	}
+	return value, true, nil
+}
+
+func (s *redisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	_, err := s.do(ctx, "SET", key, string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+func (s *redisStore) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	_, err := s.do(ctx, "SET", key, string(value), "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if errors.Is(err, errRedisNil) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *redisStore) Delete(ctx context.Context, key string) error {
+	_, err := s.do(ctx, "DEL", key)
+	return err
+}
+
+// do runs one command on a pooled connection. A pooled connection the
+// server closed while it was idle fails on first use; the command is then
+// sent once more on a new connection.
+func (s *redisStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	var conn *redisConn
+	select {
+	case conn = <-s.idle:
+	default:
+	}
+	pooled := conn != nil
+
+	for {
+		if conn == nil {
+			var err error
+			if conn, err = s.dial(ctx); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := conn.do(ctx, args...)
+		if err != nil && !errors.Is(err, errRedisNil) && !isRedisError(err) {
+			// The connection is in an unknown state after I/O errors.
+			// Only a pooled connection the server had closed is retried:
+			// after a timeout the command may have run.
+			conn.conn.Close()
+			if pooled && errors.Is(err, errRedisConnClosed) {
+				conn, pooled = nil, false
+				continue
+			}
+			return nil, err
+		}
+		s.put(conn)
+		return reply, err
+	}
+}
+
+// dial opens a connection, authenticated and on the configured database
+func (s *redisStore) dial(ctx context.Context) (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisDialTimeout}
+	var conn net.Conn
+	var err error
+	if s.useTLS {
+		host, _, _ := net.SplitHostPort(s.addr)
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", s.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if s.password != "" {
+		auth := []string{"AUTH", s.password}
+		if s.username != "" {
+			auth = []string{"AUTH", s.username, s.password}
+		}
+		if _, err := rc.do(ctx, auth...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.db != 0 {
+		if _, err := rc.do(ctx, "SELECT", strconv.Itoa(s.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+func (s *redisStore) put(conn *redisConn) {
+	select {
+	case s.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+// redisError is an error reply sent by the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func isRedisError(err error) bool {
+	var re redisError
+	return errors.As(err, &re)
+}
+
+// do writes a command as a RESP array of bulk strings and reads the reply
+func (c *redisConn) do(ctx context.Context, args ...string) (interface{}, error) {
+	deadline := time.Now().Add(redisIOTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetDeadline(deadline)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, fmt.Errorf("redis: %w", connClosedError(err))
+	}
+	if _, err := c.reader.Peek(1); err != nil {
+		return nil, fmt.Errorf("redis: %w", connClosedError(err))
+	}
+	return c.readReply()
+}
+
+// connClosedError marks EOF and connection resets as errRedisConnClosed.
+// Timeouts are left as they are.
+func connClosedError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return fmt.Errorf("%w: %w", errRedisConnClosed, err)
+	}
+	return err
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return nil, fmt.Errorf("redis: %w", err)
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad array length %q", line)
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil && !errors.Is(err, errRedisNil) {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a RESP server implementing the commands redisStore uses
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu       sync.Mutex
+	entries  map[string]fakeRedisEntry
+	conns    map[net.Conn]bool
+	dials    int
+	commands [][]string
+	// stall makes the server read commands without replying
+	stall bool
+}
+
+type fakeRedisEntry struct {
+	value   string
+	expires time.Time
+}
+
+// newFakeRedis starts a server; with a password, clients must AUTH first
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{listener: listener, password: password, entries: map[string]fakeRedisEntry{}, conns: map[net.Conn]bool{}}
+	go f.serve()
+	t.Cleanup(func() {
+		listener.Close()
+		f.dropConnections()
+	})
+	return f
+}
+
+func (f *fakeRedis) url() string {
+	if f.password != "" {
+		return "redis://:" + f.password + "@" + f.listener.Addr().String() + "/2"
+	}
+	return "redis://" + f.listener.Addr().String()
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conns[conn] = true
+		f.dials++
+		f.mu.Unlock()
+		go f.handle(conn)
+	}
+}
+
+// dropConnections closes every client connection, as a server restart would
+func (f *fakeRedis) dropConnections() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for conn := range f.conns {
+		conn.Close()
+		delete(f.conns, conn)
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := f.password == ""
+	for {
+		args, err := readRESPCommand(reader)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, args)
+		stall := f.stall
+		f.mu.Unlock()
+		if stall {
+			continue
+		}
+
+		var reply string
+		switch {
+		case strings.EqualFold(args[0], "AUTH"):
+			if args[len(args)-1] == f.password {
+				authenticated = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		default:
+			reply = f.exec(args)
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) exec(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if len(args) > 1 && strings.HasPrefix(args[1], "wrongtype:") {
+		return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		entry, ok := f.entries[args[1]]
+		if !ok || (!entry.expires.IsZero() && now.After(entry.expires)) {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(entry.value), entry.value)
+	case "SET":
+		entry := fakeRedisEntry{value: args[2]}
+		nx := false
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "PX":
+				i++
+				ms, err := strconv.Atoi(args[i])
+				if err != nil || ms <= 0 {
+					return "-ERR invalid expire time in 'set' command\r\n"
+				}
+				entry.expires = now.Add(time.Duration(ms) * time.Millisecond)
+			default:
+				return "-ERR syntax error\r\n"
+			}
+		}
+		if existing, ok := f.entries[args[1]]; nx && ok && (existing.expires.IsZero() || now.Before(existing.expires)) {
+			return "$-1\r\n"
+		}
+		f.entries[args[1]] = entry
+		return "+OK\r\n"
+	case "DEL":
+		_, ok := f.entries[args[1]]
+		delete(f.entries, args[1])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+// lastCommand returns the last command received other than AUTH and SELECT
+func (f *fakeRedis) lastCommand() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := len(f.commands) - 1; i >= 0; i-- {
+		if name := strings.ToUpper(f.commands[i][0]); name != "AUTH" && name != "SELECT" {
+			return f.commands[i]
+		}
+	}
+	return nil
+}
+
+func (f *fakeRedis) dialCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dials
+}
+
+// readRESPCommand reads a command sent as a RESP array of bulk strings
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, errors.New("expected array")
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || n < 1 {
+		return nil, errors.New("bad array length")
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, errors.New("bad bulk length")
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func newTestRedisStore(t *testing.T, f *fakeRedis) *redisStore {
+	t.Helper()
+	store, err := newRedisStore(f.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestRedisStoreGetSetDelete(t *testing.T) {
+	f := newFakeRedis(t, "")
+	store := newTestRedisStore(t, f)
+	ctx := context.Background()
+
+	if _, ok, err := store.Get(ctx, "missing"); err != nil || ok {
+		t.Fatalf("Get missing = ok %v, err %v", ok, err)
+	}
+	value := "{\"status\":200,\"body\":\"line 1\\r\\nline 2\"}"
+	if err := store.Set(ctx, "k", []byte(value), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if got := f.lastCommand(); strings.Join(got, " ") != "SET k "+value+" PX 60000" {
+		t.Errorf("Set sent %q", got)
+	}
+	got, ok, err := store.Get(ctx, "k")
+	if err != nil || !ok || string(got) != value {
+		t.Fatalf("Get = %q, ok %v, err %v", got, ok, err)
+	}
+	if err := store.Delete(ctx, "k"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, ok, err := store.Get(ctx, "k"); err != nil || ok {
+		t.Fatalf("Get after Delete = ok %v, err %v", ok, err)
+	}
+	if n := f.dialCount(); n != 1 {
+		t.Errorf("dialed %d connections, want 1 reused", n)
+	}
+}
+
+func TestRedisStoreSetNX(t *testing.T) {
+	f := newFakeRedis(t, "")
+	store := newTestRedisStore(t, f)
+	ctx := context.Background()
+
+	acquired, err := store.SetNX(ctx, "lock", []byte("a"), 50*time.Millisecond)
+	if err != nil || !acquired {
+		t.Fatalf("first SetNX = %v, %v", acquired, err)
+	}
+	if got := f.lastCommand(); strings.Join(got, " ") != "SET lock a NX PX 50" {
+		t.Errorf("SetNX sent %q", got)
+	}
+	if acquired, err := store.SetNX(ctx, "lock", []byte("b"), time.Minute); err != nil || acquired {
+		t.Fatalf("second SetNX = %v, %v", acquired, err)
+	}
+	if got, _, _ := store.Get(ctx, "lock"); string(got) != "a" {
+		t.Errorf("value = %q, want the first one", got)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if acquired, err := store.SetNX(ctx, "lock", []byte("c"), time.Minute); err != nil || !acquired {
+		t.Fatalf("SetNX after expiry = %v, %v", acquired, err)
+	}
+}
+
+func TestRedisStoreErrorReply(t *testing.T) {
+	f := newFakeRedis(t, "")
+	store := newTestRedisStore(t, f)
+	ctx := context.Background()
+
+	_, _, err := store.Get(ctx, "wrongtype:k")
+	if !isRedisError(err) || !strings.Contains(err.Error(), "WRONGTYPE") {
+		t.Fatalf("Get error = %v, want WRONGTYPE reply", err)
+	}
+	if _, err := store.SetNX(ctx, "wrongtype:k", []byte("v"), time.Minute); !isRedisError(err) {
+		t.Fatalf("SetNX error = %v, want error reply", err)
+	}
+
+	// An error reply leaves the connection usable
+	if err := store.Set(ctx, "k", []byte("v"), time.Minute); err != nil {
+		t.Fatalf("Set after error reply: %v", err)
+	}
+	if n := f.dialCount(); n != 1 {
+		t.Errorf("dialed %d connections, want 1 reused", n)
+	}
+}
+
+func TestRedisStoreAuth(t *testing.T) {
+	f := newFakeRedis(t, "s3cret")
+	store := newTestRedisStore(t, f)
+	ctx := context.Background()
+
+	if err := store.Set(ctx, "k", []byte("v"), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	f.mu.Lock()
+	first := strings.Join(f.commands[0], " ")
+	second := strings.Join(f.commands[1], " ")
+	f.mu.Unlock()
+	if first != "AUTH s3cret" || second != "SELECT 2" {
+		t.Errorf("connection setup = %q, %q", first, second)
+	}
+
+	wrong, err := newRedisStore("redis://:wrong@" + f.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wrong.Set(ctx, "k", []byte("v"), time.Minute); !isRedisError(err) {
+		t.Fatalf("Set with wrong password error = %v", err)
+	}
+}
+
+func TestRedisStoreReconnect(t *testing.T) {
+	f := newFakeRedis(t, "")
+	store := newTestRedisStore(t, f)
+	ctx := context.Background()
+
+	if err := store.Set(ctx, "k", []byte("v"), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	f.dropConnections()
+
+	// The pooled connection is dead; the command is sent again on a new one
+	got, ok, err := store.Get(ctx, "k")
+	if err != nil || !ok || string(got) != "v" {
+		t.Fatalf("Get after drop = %q, ok %v, err %v", got, ok, err)
+	}
+	if n := f.dialCount(); n != 2 {
+		t.Errorf("dialed %d connections, want 2", n)
+	}
+}
+
+func TestRedisStoreNoRetryAfterTimeout(t *testing.T) {
+	f := newFakeRedis(t, "")
+	store := newTestRedisStore(t, f)
+
+	if err := store.Set(context.Background(), "k", []byte("v"), time.Minute); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	f.mu.Lock()
+	f.stall = true
+	f.mu.Unlock()
+
+	// The server may have run the command: sending it again would make a
+	// SET NX find its own key
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := store.SetNX(ctx, "lock", []byte("a"), time.Minute)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("SetNX error = %v, want a timeout", err)
+	}
+	if errors.Is(err, errRedisConnClosed) {
+		t.Errorf("timeout reported as a closed connection: %v", err)
+	}
+
+	f.mu.Lock()
+	sent := 0
+	for _, args := range f.commands {
+		if strings.Join(args, " ") == "SET lock a NX PX 60000" {
+			sent++
+		}
+	}
+	f.mu.Unlock()
+	if sent != 1 {
+		t.Errorf("SET NX sent %d times, want 1", sent)
+	}
+	if n := f.dialCount(); n != 1 {
+		t.Errorf("dialed %d connections, want 1", n)
+	}
+}
+
+func TestRedisStoreUnreachable(t *testing.T) {
+	f := newFakeRedis(t, "")
+	store := newTestRedisStore(t, f)
+	f.listener.Close()
+
+	if err := store.Set(context.Background(), "k", []byte("v"), time.Minute); err == nil {
+		t.Fatal("Set succeeded without a server")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// setupLogging installs the default slog logger: JSON lines (LOG_FORMAT=json,
+// the default) or logfmt-style text (LOG_FORMAT=text), at LOG_LEVEL (debug,
+// info, warn or error; default info). Lines logged with a request context
+// carry the request's attributes. The standard log package writes through
+// the same logger.
+func setupLogging() {
+	var level slog.Level
+	levelName := os.Getenv("LOG_LEVEL")
+	if levelName == "" {
+		levelName = "info"
+	}
+	levelErr := level.UnmarshalText([]byte(levelName))
+
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	format := strings.ToLower(os.Getenv("LOG_FORMAT"))
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	default:
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(requestLogHandler{handler}))
+
+	if levelErr != nil {
+		slog.Warn("Invalid LOG_LEVEL, using info", "value", levelName)
+	}
+	if format != "" && format != "text" && format != "json" {
+		slog.Warn("Invalid LOG_FORMAT, using json", "value", format)
+	}
+}
+
+// requestLogHandler adds the attributes of the request being served to
+// records logged with its context: the request and trace IDs and the
+// request attributes recorded so far, such as the route and cartId
+type requestLogHandler struct {
+	slog.Handler
+}
+
+// Request attributes included in log lines, with their log keys
+var loggedRequestAttrs = []struct{ attr, key string }{
+	{"route", "route"},
+	{"upstream", "upstream"},
+	{"apiKey", "api_key_name"},
+	{"cartId", "cart_id"},
+	{"sessionId", "session_id"},
+	{"orderId", "order_id"},
+	{"planId", "plan_id"},
+}
+
+func (h requestLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id, ok := ctx.Value(requestIDContextKey{}).(string); ok {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if s := spanFromContext(ctx); s != nil && s.sampled() {
+		record.AddAttrs(slog.String("trace_id", s.traceID()))
+	}
+	if attrs, ok := ctx.Value(requestAttrsContextKey{}).(*requestAttrs); ok {
+		attrs.mu.Lock()
+		for _, a := range loggedRequestAttrs {
+			if value := attrs.values[a.attr]; value != "" {
+				record.AddAttrs(slog.String(a.key, value))
+			}
+		}
+		attrs.mu.Unlock()
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestLogHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestLogHandler) WithGroup(name string) slog.Handler {
+	return requestLogHandler{h.Handler.WithGroup(name)}
+}
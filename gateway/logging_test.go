@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// restoreLogging puts the default loggers back once the test is done.
+// slog.SetDefault redirects the log package, so its output is restored too.
+func restoreLogging(t *testing.T) {
+	previous, writer, flags := slog.Default(), log.Writer(), log.Flags()
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+		log.SetOutput(writer)
+		log.SetFlags(flags)
+	})
+}
+
+// captureLogs sends the default logger's JSON lines to a buffer for the
+// rest of the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	restoreLogging(t)
+	var buf bytes.Buffer
+	slog.SetDefault(slog.New(requestLogHandler{slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})}))
+	return &buf
+}
+
+// logLines decodes the JSON lines logged with the given message
+func logLines(t *testing.T, buf *bytes.Buffer, msg string) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", line, err)
+		}
+		if entry["msg"] == msg {
+			lines = append(lines, entry)
+		}
+	}
+	return lines
+}
+
+func TestRequestLogHandler(t *testing.T) {
+	buf := captureLogs(t)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, "req-1"))
+	r = withRequestAttrs(r)
+	setRequestAttr(r, "route", "frontend")
+	setRequestAttr(r, "cartId", "cart-1")
+	setRequestAttr(r, "routeTemplate", "/api/gw/v1/cart")
+
+	slog.With("component", "test").InfoContext(r.Context(), "With request")
+	slog.Info("Without request")
+
+	with := logLines(t, buf, "With request")
+	if len(with) != 1 {
+		t.Fatalf("%d lines", len(with))
+	}
+	want := map[string]interface{}{"request_id": "req-1", "route": "frontend", "cart_id": "cart-1", "component": "test", "level": "INFO"}
+	for key, value := range want {
+		if with[0][key] != value {
+			t.Errorf("%s = %v, want %v", key, with[0][key], value)
+		}
+	}
+	if _, ok := with[0]["routeTemplate"]; ok {
+		t.Error("unlisted request attribute logged")
+	}
+
+	without := logLines(t, buf, "Without request")
+	if _, ok := without[0]["request_id"]; ok || len(without) != 1 {
+		t.Errorf("line without request = %v", without)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+	g := newTestGateway(t, proxyConfig(backend.URL))
+	buf := captureLogs(t)
+
+	r := httptest.NewRequest("POST", "/products?token=secret", strings.NewReader(`{"a":1}`))
+	r.Header.Set("X-Request-ID", "req-42")
+	r.Header.Set("User-Agent", "test-agent")
+	serveGateway(g, r)
+	serveGateway(g, httptest.NewRequest("GET", "/broken", nil))
+
+	lines := logLines(t, buf, "Request served")
+	if len(lines) != 2 {
+		t.Fatalf("%d access log lines:\n%s", len(lines), buf)
+	}
+	want := map[string]interface{}{
+		"level":         "INFO",
+		"method":        "POST",
+		"path":          "/products",
+		"status":        float64(200),
+		"ip":            "192.0.2.1",
+		"user_agent":    "test-agent",
+		"request_size":  float64(7),
+		"response_size": float64(5),
+		"request_id":    "req-42",
+		"route":         "backend",
+		"upstream":      "backend",
+	}
+	for key, value := range want {
+		if lines[0][key] != value {
+			t.Errorf("%s = %v, want %v", key, lines[0][key], value)
+		}
+	}
+	if _, ok := lines[0]["duration_ms"].(float64); !ok {
+		t.Errorf("duration_ms = %v", lines[0]["duration_ms"])
+	}
+	if strings.Contains(buf.String(), "secret") {
+		t.Error("query string logged")
+	}
+	if lines[1]["level"] != "WARN" || lines[1]["status"] != float64(502) {
+		t.Errorf("5xx line = %v", lines[1])
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	restoreLogging(t)
+	stderr := os.Stderr
+	t.Cleanup(func() { os.Stderr = stderr })
+
+	tests := []struct {
+		format, level string
+		check         func(out string) bool
+	}{
+		{"", "", func(out string) bool {
+			return strings.HasPrefix(out, `{"time":`) && strings.Contains(out, `"msg":"info line"`) && !strings.Contains(out, "debug line")
+		}},
+		{"TEXT", "debug", func(out string) bool {
+			return strings.Contains(out, `level=DEBUG msg="debug line"`) && strings.Contains(out, `level=INFO msg="info line"`)
+		}},
+		{"json", "warn", func(out string) bool {
+			return out == ""
+		}},
+		{"yaml", "loud", func(out string) bool {
+			return strings.Contains(out, `"msg":"Invalid LOG_LEVEL, using info","value":"loud"`) &&
+				strings.Contains(out, `"msg":"Invalid LOG_FORMAT, using json","value":"yaml"`) &&
+				strings.Contains(out, `"msg":"info line"`)
+		}},
+	}
+	for _, tt := range tests {
+		file, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Stderr = file
+		t.Setenv("LOG_FORMAT", tt.format)
+		t.Setenv("LOG_LEVEL", tt.level)
+		setupLogging()
+		slog.Debug("debug line")
+		slog.Info("info line")
+		file.Close()
+
+		out, _ := os.ReadFile(file.Name())
+		if !tt.check(string(out)) {
+			t.Errorf("LOG_FORMAT=%q LOG_LEVEL=%q:\n%s", tt.format, tt.level, out)
+		}
+	}
+
+	// The standard log package goes through slog
+	var buf bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	log.Print("from log")
+	if !strings.Contains(buf.String(), `"msg":"from log"`) {
+		t.Errorf("log.Print output: %s", buf.String())
+	}
+}
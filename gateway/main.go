@@ -2,13 +2,20 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"os"
-	"strings"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,105 +25,186 @@ type ResponseEnvelope struct {
 	Error *ErrorInfo  `json:"error"`
 }
 
+// ErrorInfo describes a failed request. Code is one of errorCatalog;
+// Retryable tells clients whether repeating the request unchanged may succeed.
 type ErrorInfo struct {
-	Code    string      `json:"code"`
-	Message string      `json:"message"`
-	Details interface{} `json:"details,omitempty"`
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Retryable bool        `json:"retryable"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"requestId,omitempty"`
 }
 
 type Gateway struct {
-	postgrestURL string
-	backendAPIURL string
-	mcpServiceURL string
-	workerServiceURL string
+	state        atomic.Pointer[gatewayState]
+	reloadMu     sync.Mutex
 	apiKey       string
 	client       *http.Client
+	proxyClient  *http.Client
+	stores       map[string]kvStore
+	storesMu     sync.Mutex
+	pools        map[string]*upstreamPool
+	poolsMu      sync.Mutex
+	limiters     map[string]*rateLimiter
+	limitersMu   sync.Mutex
+	tracing      *tracer
+	tracingMu    sync.Mutex
+	sinks        map[string]*captureSink
+	sinksMu      sync.Mutex
+	metrics      *gatewayMetrics
 }
 
-type LogEntry struct {
-	Timestamp   string      `json:"timestamp"`
-	Method      string      `json:"method"`
-	Path        string      `json:"path"`
-	Status      int         `json:"status"`
-	RequestID   string      `json:"request_id,omitempty"`
-	IP          string      `json:"ip"`
-	UserAgent   string      `json:"user_agent,omitempty"`
-	RequestSize int64       `json:"request_size,omitempty"`
-	ResponseSize int64      `json:"response_size,omitempty"`
-	Duration    string      `json:"duration"`
-}
-
-func NewGateway() *Gateway {
-	postgrestURL := os.Getenv("POSTGREST_URL")
-	if postgrestURL == "" {
-		postgrestURL = "https://postgrest-server.fly.dev"
-	}
-
-	backendAPIURL := os.Getenv("BACKEND_API_URL")
-	if backendAPIURL == "" {
-		backendAPIURL = "https://backend-api-dfcflow.fly.dev"
-	}
+func NewGateway(config *Config) (*Gateway, error) {
+	apiKey := os.Getenv("API_KEY")
 
-	mcpServiceURL := os.Getenv("MCP_SERVICE_URL")
-	if mcpServiceURL == "" {
-		mcpServiceURL = "https://mcp-service-dfcflow.fly.dev"
+	g := &Gateway{
+		apiKey: apiKey,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+		// Proxied responses stream for as long as the upstream sends them,
+		// so only the wait for their headers is bounded
+		proxyClient: &http.Client{
+			Transport: proxyTransport(),
+		},
+		metrics: newGatewayMetrics(),
 	}
-
-	workerServiceURL := os.Getenv("WORKER_SERVICE_URL")
-	if workerServiceURL == "" {
-		workerServiceURL = "https://worker-service-dfcflow.fly.dev"
+	state, err := g.newGatewayState(config)
+	if err != nil {
+		return nil, err
 	}
+	g.state.Store(state)
+	return g, nil
+}
 
-	apiKey := os.Getenv("API_KEY")
-	if apiKey == "" {
-		log.Println("WARNING: API_KEY not set, authentication disabled")
+// Routing middleware: matches the request against the route table
+func (g *Gateway) routeMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The route carries everything needed to serve the request, so a
+		// config reload never changes a request that is already in flight
+		route := g.state.Load().routes.match(r.Method, r.URL.Path)
+		if route == nil {
+			g.sendResponse(w, http.StatusNotFound, nil, &ErrorInfo{
+				Code:    "NOT_FOUND",
+				Message: "No route matches " + r.Method + " " + r.URL.Path,
+			})
+			return
+		}
+		setRequestAttr(r, "route", route.Name)
+		setRequestAttr(r, "upstream", route.Upstream)
+		setRequestAttr(r, "routeTemplate", route.template())
+		serverSpan := spanFromContext(r.Context())
+		serverSpan.setAttr("gateway.route", route.Name)
+		serverSpan.setRoute(route.template())
+		next(w, withRoute(r, route))
 	}
+}
 
-	return &Gateway{
-		postgrestURL:  postgrestURL,
-		backendAPIURL: backendAPIURL,
-		mcpServiceURL: mcpServiceURL,
-		workerServiceURL: workerServiceURL,
-		apiKey:        apiKey,
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+// Body limit middleware: applies the route's max_body_size. A larger
+// declared Content-Length is rejected up front; other bodies fail with
+// PAYLOAD_TOO_LARGE once the limit is read past.
+func (g *Gateway) bodyLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := routeFromContext(r.Context()).MaxBodySize
+		if limit > 0 {
+			if r.ContentLength > limit {
+				g.sendBodyTooLarge(w, &http.MaxBytesError{Limit: limit})
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next(w, r)
 	}
 }
 
-// Authentication middleware
+// Authentication middleware: applies the route's auth policy
 func (g *Gateway) authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if g.apiKey != "" {
-			providedKey := r.Header.Get("X-API-Key")
-			if providedKey == "" {
-				providedKey = r.URL.Query().Get("api_key")
-			}
+		route := routeFromContext(r.Context())
+		state := g.state.Load()
 
-			if providedKey != g.apiKey {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusUnauthorized)
-				json.NewEncoder(w).Encode(map[string]string{
-					"error": "Unauthorized: Invalid or missing API key",
-				})
+		switch route.Auth {
+		case authPolicyNone:
+			next(w, r)
+			return
+		case authPolicyJWT, authPolicyJWTOptional, authPolicyAPIKeyOrJWT:
+			// A bearer token that is sent must be valid, whatever the policy.
+			// Without jwt settings the optional policies ignore it.
+			if token, ok := bearerToken(r); ok && (state.jwt != nil || route.Auth == authPolicyJWT) {
+				claims, err := state.jwt.verify(token, time.Now())
+				if err != nil {
+					g.sendBearerChallenge(w, "invalid_token", "Unauthorized: invalid token: "+err.Error())
+					return
+				}
+				next(w, withClaims(r, claims))
+				return
+			}
+			if route.Auth == authPolicyJWT {
+				g.sendBearerChallenge(w, "", "Unauthorized: bearer token required")
+				return
+			}
+			if route.Auth == authPolicyJWTOptional {
+				next(w, r)
 				return
 			}
 		}
+
+		keys := state.apiKeys
+		if !keys.enabled() {
+			next(w, r)
+			return
+		}
+
+		providedKey := r.Header.Get("X-API-Key")
+		fromQuery := false
+		if providedKey == "" {
+			providedKey = r.URL.Query().Get("api_key")
+			fromQuery = providedKey != ""
+		}
+
+		key, err := keys.authenticate(providedKey, fromQuery, time.Now())
+		if err != nil {
+			g.sendResponse(w, http.StatusUnauthorized, nil, &ErrorInfo{
+				Code:    "UNAUTHORIZED",
+				Message: "Unauthorized: " + err.Error(),
+			})
+			return
+		}
+		if err := key.authorize(route, r.Method, r.URL.Path); err != nil {
+			slog.WarnContext(r.Context(), "Forbidden", "method", r.Method, "path", r.URL.Path, "error", err)
+			g.sendResponse(w, http.StatusForbidden, nil, &ErrorInfo{
+				Code:    "FORBIDDEN",
+				Message: err.Error(),
+			})
+			return
+		}
+		setRequestAttr(r, "apiKey", key.name)
 		next(w, r)
 	}
 }
 
+// 401 envelope for a missing or invalid bearer token (RFC 6750)
+func (g *Gateway) sendBearerChallenge(w http.ResponseWriter, errorCode, message string) {
+	challenge := `Bearer realm="gateway"`
+	if errorCode != "" {
+		challenge += `, error="` + errorCode + `"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	g.sendResponse(w, http.StatusUnauthorized, nil, &ErrorInfo{
+		Code:    "UNAUTHORIZED",
+		Message: message,
+	})
+}
+
 // Logging middleware
 func (g *Gateway) loggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+		r = withRequestAttrs(r)
 
-		// Read request body
-		var requestBody []byte
-		if r.Body != nil {
-			requestBody, _ = io.ReadAll(r.Body)
-			r.Body = io.NopCloser(bytes.NewBuffer(requestBody))
-		}
+		// Count the request body as it streams through
+		body := &countingBody{ReadCloser: r.Body}
+		r.Body = body
 
 		// Create response writer wrapper to capture status and size
 		ww := &responseWriter{
@@ -124,28 +212,43 @@ func (g *Gateway) loggingMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			statusCode:     http.StatusOK,
 		}
 
-		// Process request
-		next(ww, r)
-
-		// Calculate duration
-		duration := time.Since(start)
-
-		// Log entry
-		logEntry := LogEntry{
-			Timestamp:   start.Format(time.RFC3339),
-			Method:      r.Method,
-			Path:        r.URL.Path,
-			Status:      ww.statusCode,
-			IP:          getClientIP(r),
-			UserAgent:   r.UserAgent(),
-			RequestSize: int64(len(requestBody)),
-			ResponseSize: ww.size,
-			Duration:    duration.String(),
+		// Keep the start of both bodies when the request may be captured
+		capture := g.state.Load().capture
+		if capture.sampled() {
+			body.captureLimit = maxCaptureBodyRead
+			ww.captureLimit = maxCaptureBodyRead
 		}
 
-		// Log as JSON
-		logJSON, _ := json.Marshal(logEntry)
-		log.Println(string(logJSON))
+		// Deferred so requests aborted mid-response, such as proxied
+		// streams that break off, are logged too
+		defer func() {
+			// Calculate duration
+			duration := time.Since(start)
+
+			// Access log line; request ID, route and the identifiers handlers
+			// recorded are added by requestLogHandler
+			level := slog.LevelInfo
+			if ww.statusCode >= 500 {
+				level = slog.LevelWarn
+			}
+			slog.Log(r.Context(), level, "Request served",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", ww.statusCode,
+				"ip", getClientIP(r),
+				"user_agent", r.UserAgent(),
+				"request_size", body.bytesRead(),
+				"response_size", ww.size,
+				"duration_ms", float64(duration.Microseconds())/1000,
+			)
+
+			if ww.captureLimit > 0 {
+				capture.record(r, body, ww, duration)
+			}
+		}()
+
+		// Process request
+		next(ww, r)
 	}
 }
 
@@ -154,8 +257,8 @@ func (g *Gateway) corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, Prefer")
-		w.Header().Set("Access-Control-Expose-Headers", "Content-Range, Content-Encoding, Content-Length")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, Prefer, Idempotency-Key, X-Cart-Token, X-Deposit-Session-Token, X-Request-ID, traceparent, tracestate")
+		w.Header().Set("Access-Control-Expose-Headers", "Content-Range, Content-Encoding, Content-Length, Idempotent-Replayed, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, RateLimit-Policy, Retry-After, WWW-Authenticate, X-Request-ID")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -171,6 +274,10 @@ func (g *Gateway) sendResponse(w http.ResponseWriter, statusCode int, data inter
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 	
+	if err != nil {
+		err.Retryable = errorCatalog[err.Code].retryable
+		err.RequestID = w.Header().Get(requestIDHeader)
+	}
 	envelope := ResponseEnvelope{
 		Data:  data,
 		Error: err,
@@ -179,154 +286,163 @@ func (g *Gateway) sendResponse(w http.ResponseWriter, statusCode int, data inter
 	json.NewEncoder(w).Encode(envelope)
 }
 
+// Error envelope for an upstream call that did not produce a response
+func (g *Gateway) sendUpstreamError(w http.ResponseWriter, err error) {
+	var circuitErr *errCircuitOpen
+	if errors.As(err, &circuitErr) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(circuitErr.retryAfter.Seconds()))))
+	}
+	g.sendError(w, upstreamError(err))
+}
+
+// Frontend-facing API routes, relative to /api/gw/v1
+var frontendRoutes = func() *apiRouter {
+	ar := newAPIRouter("/api/gw/v1")
+	ar.handle("GET", "/cart", (*Gateway).handleGetCart)
+	ar.handle("POST", "/cart/items", (*Gateway).handleAddCartItem)
+	ar.handle("PUT", "/cart/items", (*Gateway).handleUpdateCartItem)
+	ar.handle("DELETE", "/cart/items", (*Gateway).handleRemoveCartItem)
+	ar.handle("POST", "/cart/merge", (*Gateway).handleMergeCart)
+	ar.handle("POST", "/cart/quotes", (*Gateway).handleCreateQuote)
+	ar.handle("POST", "/cart/checkout", idempotent((*Gateway).handleCheckout))
+	ar.handle("POST", "/deposit-sessions", idempotent((*Gateway).handleCreateDepositSession))
+	ar.handle("POST", "/deposit-sessions/create-from-cart", idempotent((*Gateway).handleCreateDepositSession))
+	ar.handle("GET", "/deposit-sessions/{sessionId}", (*Gateway).handleGetDepositSession)
+	ar.handle("POST", "/deposit-sessions/{sessionId}/checkout", idempotent((*Gateway).handleDepositSessionCheckout))
+	ar.handle("GET", "/deposit-plans", (*Gateway).handleGetDepositPlans)
+	ar.handle("GET", "/deposit-plans/default", (*Gateway).handleGetDefaultDepositPlan)
+	ar.handle("GET", "/deposit-plans/{planId}", (*Gateway).handleGetDepositPlan)
+	ar.handle("GET", "/orders/{orderId}", (*Gateway).handleGetOrderStatus)
+	ar.useSpec(frontendSpec)
+	return ar
+}()
+
 // Frontend-facing API handler for /api/gw/v1/*
 func (g *Gateway) frontendAPIHandler(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Path
-	
-	// Remove /api/gw/v1 prefix and route to backend API
-	backendPath := strings.TrimPrefix(path, "/api/gw/v1")
-	
-	// Map frontend paths to backend paths
-	switch {
-	case strings.HasPrefix(path, "/api/gw/v1/cart/items"):
-		if r.Method == "POST" {
-			g.handleAddCartItem(w, r)
-			return
-		} else if r.Method == "PUT" {
-			g.handleUpdateCartItem(w, r)
-			return
-		} else if r.Method == "DELETE" {
-			g.handleRemoveCartItem(w, r)
-			return
-		}
-	case strings.HasPrefix(path, "/api/gw/v1/cart") && r.Method == "GET":
-		g.handleGetCart(w, r)
-		return
-	case strings.HasPrefix(path, "/api/gw/v1/cart/checkout") && r.Method == "POST":
-		g.handleCheckout(w, r)
-		return
-	case strings.HasPrefix(path, "/api/gw/v1/deposit-sessions/create-from-cart") && r.Method == "POST":
-		g.handleCreateDepositSession(w, r)
-		return
-	case strings.HasPrefix(path, "/api/gw/v1/deposit-sessions/") && strings.Contains(path, "/checkout") && r.Method == "POST":
-		g.handleDepositSessionCheckout(w, r)
-		return
-	case strings.HasPrefix(path, "/api/gw/v1/deposit-sessions/") && r.Method == "GET":
-		g.handleGetDepositSession(w, r)
-		return
-	case strings.HasPrefix(path, "/api/gw/v1/deposit-plans/default") && r.Method == "GET":
-		g.handleGetDefaultDepositPlan(w, r)
-		return
-	case strings.HasPrefix(path, "/api/gw/v1/deposit-plans/") && r.Method == "GET":
-		g.handleGetDepositPlan(w, r)
-		return
-	case strings.HasPrefix(path, "/api/gw/v1/deposit-plans") && r.Method == "GET":
-		g.handleGetDepositPlans(w, r)
-		return
-	case strings.HasPrefix(path, "/api/gw/v1/orders/") && r.Method == "GET":
-		g.handleGetOrderStatus(w, r)
-		return
-	}
-	
-	// Default: proxy to backend API at /api/v1
-	targetURL := g.backendAPIURL + "/api/v1" + backendPath
-	g.proxyToBackend(w, r, targetURL)
+	g.serveAPI(frontendRoutes, w, r)
 }
 
 // Proxy handler with routing
 func (g *Gateway) proxyHandler(w http.ResponseWriter, r *http.Request) {
-	var targetURL string
+	route := routeFromContext(r.Context())
 	path := r.URL.Path
 
 	// Debug logging
-	log.Printf("Gateway received: %s %s", r.Method, path)
-
-	// Route based on path prefix
-	switch {
-	case strings.HasPrefix(path, "/api/gw/v1/"):
-		// Frontend-facing API - handle separately
-		log.Printf("Routing to frontend API handler: %s", path)
-		g.frontendAPIHandler(w, r)
+	slog.DebugContext(r.Context(), "Gateway received", "method", r.Method, "path", path)
+
+	if route.Handler != "" {
+		builtinHandlers[route.Handler].serve(g, w, r)
 		return
-	case strings.HasPrefix(path, "/rest/"):
-		// Route to PostgREST: /rest/* -> PostgREST
-		targetURL = g.postgrestURL + strings.TrimPrefix(path, "/rest")
-	case strings.HasPrefix(path, "/api/"):
-		// Route to Backend API: /api/* -> Backend API (strip /api prefix)
-		targetURL = g.backendAPIURL + strings.TrimPrefix(path, "/api")
-	case strings.HasPrefix(path, "/mcp/"):
-		// Route to MCP Service: /mcp/* -> MCP Service
-		// Health endpoint is at /health, other routes keep /mcp prefix
-		if path == "/mcp/health" {
-			targetURL = g.mcpServiceURL + "/health"
-		} else {
-			targetURL = g.mcpServiceURL + path
-		}
-	case strings.HasPrefix(path, "/worker/"):
-		// Route to Worker Service: /worker/* -> Worker Service (strip /worker prefix)
-		targetURL = g.workerServiceURL + strings.TrimPrefix(path, "/worker")
-	default:
-		// Default: route to PostgREST (backward compatibility)
-		targetURL = g.postgrestURL + path
 	}
 
+	targetPath := route.upstreamPath(path)
 	if r.URL.RawQuery != "" {
-		targetURL += "?" + r.URL.RawQuery
+		targetPath += "?" + r.URL.RawQuery
 	}
 
-	g.proxyToBackend(w, r, targetURL)
+	g.proxyToBackend(w, r, route.upstream, targetPath)
 }
 
-// Helper to proxy request to backend API
-func (g *Gateway) proxyToBackend(w http.ResponseWriter, r *http.Request, targetURL string) {
-	// Create request to target service
-	req, err := http.NewRequest(r.Method, targetURL, r.Body)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error creating request: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	// Copy headers (except Host)
-	for key, values := range r.Header {
-		if key != "Host" {
-			for _, value := range values {
-				req.Header.Add(key, value)
-			}
+// Helper for the typed handlers to call the upstream of the matched route
+func (g *Gateway) callUpstream(r *http.Request, method, path string, body []byte) (*http.Response, error) {
+	pool := routeFromContext(r.Context()).upstream
+	return g.roundTrip(r, pool, method, true, func(target *upstreamTarget) (*http.Request, error) {
+		var reqBody io.Reader
+		if body != nil {
+			reqBody = bytes.NewReader(body)
 		}
-	}
-
-	// Forward request
-	resp, err := g.client.Do(req)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error forwarding request: %v", err), http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Copy response headers (but skip CORS headers since gateway middleware sets them)
-	corsHeaders := map[string]bool{
-		"Access-Control-Allow-Origin":      true,
-		"Access-Control-Allow-Methods":    true,
-		"Access-Control-Allow-Headers":    true,
-		"Access-Control-Expose-Headers":   true,
-		"Access-Control-Allow-Credentials": true,
-		"Access-Control-Max-Age":          true,
-	}
-	for key, values := range resp.Header {
-		// Skip CORS headers - gateway middleware handles these
-		if corsHeaders[key] {
-			continue
+		req, err := http.NewRequest(method, target.url+path, reqBody)
+		if err != nil {
+			return nil, err
 		}
-		for _, value := range values {
-			w.Header().Add(key, value)
+		if method != "GET" {
+			req.Header.Set("Content-Type", "application/json")
 		}
+		if key := r.Header.Get("Idempotency-Key"); key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		return req, nil
+	})
+}
+
+// Helper to proxy request to backend API. Bodies stream through in both
+// directions; responses without a length, such as server-sent events, are
+// flushed as soon as upstream data arrives.
+func (g *Gateway) proxyToBackend(w http.ResponseWriter, r *http.Request, pool *upstreamPool, targetPath string) {
+	// Requests without a body can be replayed on retry
+	replayable := r.ContentLength == 0
+
+	proxy := &httputil.ReverseProxy{
+		// Hop-by-hop headers (RFC 9110 section 7.6.1) are already gone from
+		// pr.Out; request ID and trace headers are added per attempt
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pool.headers.filter(pr.Out.Header)
+			setForwardingHeaders(pr, g.state.Load().trusted)
+		},
+		// Each attempt goes through roundTrip, to the target it picks
+		Transport: roundTripperFunc(func(out *http.Request) (*http.Response, error) {
+			resp, err := g.roundTrip(r, pool, out.Method, replayable, func(target *upstreamTarget) (*http.Request, error) {
+				req, err := http.NewRequestWithContext(out.Context(), out.Method, target.url+targetPath, out.Body)
+				if err != nil {
+					return nil, err
+				}
+				req.ContentLength = out.ContentLength
+				req.Header = out.Header.Clone()
+				req.Trailer = out.Trailer
+				return req, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			// Upstream calls outlive the client, but a stream has no one to
+			// go to once the client is gone
+			stop := context.AfterFunc(r.Context(), func() { resp.Body.Close() })
+			resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { stop() }}
+			return resp, nil
+		}),
+		ModifyResponse: func(resp *http.Response) error {
+			// Skip CORS headers since gateway middleware sets them, and the
+			// request ID the gateway already returned
+			for _, key := range []string{
+				"Access-Control-Allow-Origin",
+				"Access-Control-Allow-Methods",
+				"Access-Control-Allow-Headers",
+				"Access-Control-Expose-Headers",
+				"Access-Control-Allow-Credentials",
+				"Access-Control-Max-Age",
+				requestIDHeader,
+			} {
+				resp.Header.Del(key)
+			}
+			return nil
+		},
+		ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+		// Proxied routes fail with the same envelopes as typed handlers; the
+		// error itself, which may name internal addresses, is only logged
+		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
+			if g.sendBodyTooLarge(w, err) {
+				return
+			}
+			slog.WarnContext(r.Context(), "Proxying request failed", "method", r.Method, "upstream_path", targetPath, "error", err)
+			g.sendUpstreamError(w, err)
+		},
 	}
+	proxy.ServeHTTP(w, r)
+}
+
+// proxyTransport is the default transport with a 30s limit on the wait for
+// response headers
+func proxyTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = 30 * time.Second
+	return transport
+}
 
-	// Set status code
-	w.WriteHeader(resp.StatusCode)
+// roundTripperFunc adapts a function to http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
 
-	// Copy response body
-	io.Copy(w, resp.Body)
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
 }
 
 // Response writer wrapper to capture status and size
@@ -334,6 +450,10 @@ type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
 	size       int64
+
+	// body keeps the first captureLimit bytes written, for body capture
+	captureLimit int
+	body         []byte
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
@@ -343,696 +463,546 @@ func (rw *responseWriter) WriteHeader(code int) {
 
 func (rw *responseWriter) Write(b []byte) (int, error) {
 	size, err := rw.ResponseWriter.Write(b)
+	if keep := min(size, rw.captureLimit-len(rw.body)); keep > 0 {
+		rw.body = append(rw.body, b[:keep]...)
+	}
 	rw.size += int64(size)
 	return size, err
 }
 
-// Get client IP address
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header (for fly.io)
-	forwarded := r.Header.Get("X-Forwarded-For")
-	if forwarded != "" {
-		return forwarded
-	}
+// Unwrap gives http.ResponseController, which the proxy flushes with, the
+// underlying writer
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
 
-	// Check X-Real-IP header
-	realIP := r.Header.Get("X-Real-IP")
-	if realIP != "" {
-		return realIP
+// Request body wrapper counting the bytes read, mirroring responseWriter.
+// The proxy transport may still read the body after the handler returns,
+// hence the lock.
+type countingBody struct {
+	io.ReadCloser
+	mu   sync.Mutex
+	size int64
+
+	// body keeps the first captureLimit bytes read, for body capture
+	captureLimit int
+	body         []byte
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	if keep := min(n, b.captureLimit-len(b.body)); keep > 0 {
+		b.body = append(b.body, p[:keep]...)
 	}
+	b.size += int64(n)
+	b.mu.Unlock()
+	return n, err
+}
 
-	// Fallback to RemoteAddr
-	return r.RemoteAddr
+// bytesRead returns the number of bytes read so far
+func (b *countingBody) bytesRead() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
 }
 
-// Validate cart item request
-func validateCartItemRequest(body map[string]interface{}) *ErrorInfo {
-	source, ok := body["source"].(string)
-	if !ok || (source != "shopify" && source != "external") {
-		return &ErrorInfo{
-			Code:    "VALIDATION_ERROR",
-			Message: "source must be 'shopify' or 'external'",
-		}
-	}
-	
-	if source == "external" {
-		if _, ok := body["externalId"].(string); !ok {
-			return &ErrorInfo{
-				Code:    "VALIDATION_ERROR",
-				Message: "externalId is required for external items",
-			}
-		}
-	} else {
-		if _, ok := body["variantId"].(string); !ok {
-			return &ErrorInfo{
-				Code:    "VALIDATION_ERROR",
-				Message: "variantId is required for shopify items",
-			}
-		}
-	}
-	
-	return nil
+// captured returns the kept start of the body and the bytes read so far
+func (b *countingBody) captured() ([]byte, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.body...), b.size
 }
 
 // Handle add cart item
 func (g *Gateway) handleAddCartItem(w http.ResponseWriter, r *http.Request) {
-	log.Printf("handleAddCartItem called")
-	var body map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		log.Printf("Error decoding body: %v", err)
-		g.sendResponse(w, http.StatusBadRequest, nil, &ErrorInfo{
-			Code:    "VALIDATION_ERROR",
-			Message: "Invalid request body",
-		})
+	slog.DebugContext(r.Context(), "handleAddCartItem called")
+	var body AddCartItemRequest
+	if !g.decodeRequest(w, r, &body) {
 		return
 	}
 	
-	if err := validateCartItemRequest(body); err != nil {
-		log.Printf("Validation error: %v", err)
-		g.sendResponse(w, http.StatusBadRequest, nil, err)
-		return
+	if body.Quantity == nil {
+		quantity := 1
+		body.Quantity = &quantity
+	}
+	// External items are priced by a signed quote, never by the client
+	if quotes := g.state.Load().quotes; quotes != nil && body.Source == "external" {
+		if err := quotes.applyQuote(&body, time.Now()); err != nil {
+			code := "INVALID_QUOTE"
+			switch err {
+			case errMissingQuote:
+				code = "VALIDATION_ERROR"
+			case errExpiredQuote:
+				code = "QUOTE_EXPIRED"
+			}
+			g.sendResponse(w, http.StatusBadRequest, nil, &ErrorInfo{
+				Code:    code,
+				Message: err.Error(),
+			})
+			return
+		}
+	}
+	if body.CartID != "" {
+		setRequestAttr(r, "cartId", body.CartID)
+		if !g.authorizeCart(w, r, body.CartID) {
+			return
+		}
+	}
+	// A new cart is bound to the signed-in customer; the client can't
+	// choose the customer itself while ownership is enforced
+	if claims := claimsFromContext(r.Context()); claims != nil && claims.CustomerID != "" {
+		body.CustomerID = claims.CustomerID
+	} else if g.state.Load().carts != nil {
+		body.CustomerID = ""
 	}
 	
 	// Forward to backend API
-	targetURL := g.backendAPIURL + "/api/v1/cart/items"
-	log.Printf("Calling backend API: %s", targetURL)
+	slog.DebugContext(r.Context(), "Calling backend API", "path", "/api/v1/cart/items")
 	bodyBytes, _ := json.Marshal(body)
-	req, _ := http.NewRequest("POST", targetURL, bytes.NewBuffer(bodyBytes))
-	req.Header.Set("Content-Type", "application/json")
-	
-	resp, err := g.client.Do(req)
+	resp, err := g.callUpstream(r, "POST", "/api/v1/cart/items", bodyBytes)
 	if err != nil {
-		log.Printf("Backend API error: %v", err)
-		g.sendResponse(w, http.StatusBadGateway, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: "Failed to connect to backend API",
-		})
+		slog.DebugContext(r.Context(), "Backend API error", "error", err)
+		g.sendUpstreamError(w, err)
 		return
 	}
 	defer resp.Body.Close()
 	
-	log.Printf("Backend API response status: %d", resp.StatusCode)
-	var backendResp map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&backendResp)
-	
+	slog.DebugContext(r.Context(), "Backend API response", "status", resp.StatusCode)
 	if resp.StatusCode >= 400 {
-		errorCode := "BACKEND_ERROR"
-		if code, ok := backendResp["code"].(string); ok {
-			errorCode = code
-		}
-		log.Printf("Backend API error response: %v", backendResp)
-		g.sendResponse(w, resp.StatusCode, nil, &ErrorInfo{
-			Code:    errorCode,
-			Message: fmt.Sprintf("%v", backendResp["message"]),
-			Details: backendResp["details"],
-		})
+		g.sendBackendError(w, resp, "CART_NOT_FOUND")
 		return
 	}
 	
-	// Transform response to envelope format
-	cartData := map[string]interface{}{
-		"cartId": backendResp["cartId"],
-		"cart":   backendResp["cart"],
+	var cartData CartResponse
+	if !g.decodeBackendResponse(w, resp, &cartData) {
+		return
 	}
+	// Anonymous carts are only usable with their cart token
+	if guard := g.state.Load().carts; guard != nil && body.CustomerID == "" {
+		cartData.CartToken = guard.token(cartData.CartID)
+	}
+	g.metrics.cartItemsAdded.inc(body.Source)
 	g.sendResponse(w, http.StatusOK, cartData, nil)
 }
 
 // Handle get cart
 func (g *Gateway) handleGetCart(w http.ResponseWriter, r *http.Request) {
 	cartId := r.URL.Query().Get("cartId")
-	if cartId == "" {
-		g.sendResponse(w, http.StatusBadRequest, nil, &ErrorInfo{
-			Code:    "VALIDATION_ERROR",
-			Message: "cartId query parameter is required",
-		})
-		return
-	}
+	setRequestAttr(r, "cartId", cartId)
 	
-	targetURL := g.backendAPIURL + "/api/v1/cart/" + cartId
-	req, _ := http.NewRequest("GET", targetURL, nil)
-	
-	resp, err := g.client.Do(req)
+	resp, err := g.callUpstream(r, "GET", "/api/v1/cart/" + url.PathEscape(cartId), nil)
 	if err != nil {
-		g.sendResponse(w, http.StatusBadGateway, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: "Failed to connect to backend API",
-		})
+		g.sendUpstreamError(w, err)
 		return
 	}
 	defer resp.Body.Close()
 	
-	var backendResp map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&backendResp)
-	
 	if resp.StatusCode >= 400 {
-		g.sendResponse(w, resp.StatusCode, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: fmt.Sprintf("%v", backendResp["message"]),
-		})
+		g.sendBackendError(w, resp, "CART_NOT_FOUND")
 		return
 	}
 	
-	cartData := map[string]interface{}{
-		"cartId": cartId,
-		"cart":   backendResp,
+	var cart Cart
+	if !g.decodeBackendResponse(w, resp, &cart) {
+		return
 	}
-	g.sendResponse(w, http.StatusOK, cartData, nil)
+	if err := g.state.Load().carts.check(r, cartId, string(cart.CustomerID)); err != nil {
+		g.sendResponse(w, http.StatusForbidden, nil, err)
+		return
+	}
+	
+	g.sendResponse(w, http.StatusOK, CartResponse{CartID: cartId, Cart: &cart}, nil)
 }
 
 // Handle update cart item
 func (g *Gateway) handleUpdateCartItem(w http.ResponseWriter, r *http.Request) {
-	var body map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		g.sendResponse(w, http.StatusBadRequest, nil, &ErrorInfo{
-			Code:    "VALIDATION_ERROR",
-			Message: "Invalid request body",
-		})
+	var body UpdateCartItemRequest
+	if !g.decodeRequest(w, r, &body) {
 		return
 	}
 	
-	if _, ok := body["cartId"].(string); !ok {
-		g.sendResponse(w, http.StatusBadRequest, nil, &ErrorInfo{
-			Code:    "VALIDATION_ERROR",
-			Message: "cartId is required",
-		})
+	setRequestAttr(r, "cartId", body.CartID)
+	if !g.authorizeCart(w, r, body.CartID) {
 		return
 	}
 	
-	if _, ok := body["lineId"].(string); !ok {
-		g.sendResponse(w, http.StatusBadRequest, nil, &ErrorInfo{
-			Code:    "VALIDATION_ERROR",
-			Message: "lineId is required",
-		})
-		return
-	}
-	
-	targetURL := g.backendAPIURL + "/api/v1/cart/items"
 	bodyBytes, _ := json.Marshal(body)
-	req, _ := http.NewRequest("PUT", targetURL, bytes.NewBuffer(bodyBytes))
-	req.Header.Set("Content-Type", "application/json")
-	
-	resp, err := g.client.Do(req)
+	resp, err := g.callUpstream(r, "PUT", "/api/v1/cart/items", bodyBytes)
 	if err != nil {
-		g.sendResponse(w, http.StatusBadGateway, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: "Failed to connect to backend API",
-		})
+		g.sendUpstreamError(w, err)
 		return
 	}
 	defer resp.Body.Close()
 	
-	var backendResp map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&backendResp)
-	
 	if resp.StatusCode >= 400 {
-		g.sendResponse(w, resp.StatusCode, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: fmt.Sprintf("%v", backendResp["message"]),
-		})
+		g.sendBackendError(w, resp, "CART_NOT_FOUND")
 		return
 	}
 	
-	cartData := map[string]interface{}{
-		"cartId": body["cartId"],
-		"cart":   backendResp,
+	var cart Cart
+	if !g.decodeBackendResponse(w, resp, &cart) {
+		return
 	}
-	g.sendResponse(w, http.StatusOK, cartData, nil)
+	g.sendResponse(w, http.StatusOK, CartResponse{CartID: body.CartID, Cart: &cart}, nil)
 }
 
 // Handle remove cart item
 func (g *Gateway) handleRemoveCartItem(w http.ResponseWriter, r *http.Request) {
-	var body map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		g.sendResponse(w, http.StatusBadRequest, nil, &ErrorInfo{
-			Code:    "VALIDATION_ERROR",
-			Message: "Invalid request body",
-		})
+	var body RemoveCartItemRequest
+	if !g.decodeRequest(w, r, &body) {
 		return
 	}
 	
-	if _, ok := body["cartId"].(string); !ok {
-		g.sendResponse(w, http.StatusBadRequest, nil, &ErrorInfo{
-			Code:    "VALIDATION_ERROR",
-			Message: "cartId is required",
-		})
+	setRequestAttr(r, "cartId", body.CartID)
+	if !g.authorizeCart(w, r, body.CartID) {
 		return
 	}
 	
-	if _, ok := body["lineId"].(string); !ok {
-		g.sendResponse(w, http.StatusBadRequest, nil, &ErrorInfo{
-			Code:    "VALIDATION_ERROR",
-			Message: "lineId is required",
-		})
-		return
-	}
-	
-	targetURL := g.backendAPIURL + "/api/v1/cart/items"
 	bodyBytes, _ := json.Marshal(body)
-	req, _ := http.NewRequest("DELETE", targetURL, bytes.NewBuffer(bodyBytes))
-	req.Header.Set("Content-Type", "application/json")
-	
-	resp, err := g.client.Do(req)
+	resp, err := g.callUpstream(r, "DELETE", "/api/v1/cart/items", bodyBytes)
 	if err != nil {
-		g.sendResponse(w, http.StatusBadGateway, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: "Failed to connect to backend API",
-		})
+		g.sendUpstreamError(w, err)
 		return
 	}
 	defer resp.Body.Close()
 	
-	var backendResp map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&backendResp)
-	
 	if resp.StatusCode >= 400 {
-		g.sendResponse(w, resp.StatusCode, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: fmt.Sprintf("%v", backendResp["message"]),
-		})
+		g.sendBackendError(w, resp, "CART_NOT_FOUND")
 		return
 	}
 	
-	cartData := map[string]interface{}{
-		"cartId": body["cartId"],
-		"cart":   backendResp,
+	var cart Cart
+	if !g.decodeBackendResponse(w, resp, &cart) {
+		return
 	}
-	g.sendResponse(w, http.StatusOK, cartData, nil)
+	g.sendResponse(w, http.StatusOK, CartResponse{CartID: body.CartID, Cart: &cart}, nil)
 }
 
 // Handle checkout
 func (g *Gateway) handleCheckout(w http.ResponseWriter, r *http.Request) {
-	var body map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		g.sendResponse(w, http.StatusBadRequest, nil, &ErrorInfo{
-			Code:    "VALIDATION_ERROR",
-			Message: "Invalid request body",
-		})
+	var body CheckoutRequest
+	if !g.decodeRequest(w, r, &body) {
 		return
 	}
 	
-	if _, ok := body["cartId"].(string); !ok {
-		g.sendResponse(w, http.StatusBadRequest, nil, &ErrorInfo{
-			Code:    "VALIDATION_ERROR",
-			Message: "cartId is required",
-		})
+	setRequestAttr(r, "cartId", body.CartID)
+	if !g.authorizeCart(w, r, body.CartID) {
 		return
 	}
 	
-	targetURL := g.backendAPIURL + "/api/v1/cart/checkout"
 	bodyBytes, _ := json.Marshal(body)
-	req, _ := http.NewRequest("POST", targetURL, bytes.NewBuffer(bodyBytes))
-	req.Header.Set("Content-Type", "application/json")
-	
-	resp, err := g.client.Do(req)
+	resp, err := g.callUpstream(r, "POST", "/api/v1/cart/checkout", bodyBytes)
 	if err != nil {
-		g.sendResponse(w, http.StatusBadGateway, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: "Failed to connect to backend API",
-		})
+		g.sendUpstreamError(w, err)
 		return
 	}
 	defer resp.Body.Close()
 	
-	var backendResp map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&backendResp)
-	
 	if resp.StatusCode >= 400 {
-		g.sendResponse(w, resp.StatusCode, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: fmt.Sprintf("%v", backendResp["message"]),
-		})
+		g.sendBackendError(w, resp, "CART_NOT_FOUND")
 		return
 	}
 	
-	g.sendResponse(w, http.StatusOK, backendResp, nil)
+	var checkout CheckoutResponse
+	if !g.decodeBackendResponse(w, resp, &checkout) {
+		return
+	}
+	g.metrics.checkouts.inc("cart")
+	g.sendResponse(w, http.StatusOK, checkout, nil)
 }
 
 // Handle create deposit session
 func (g *Gateway) handleCreateDepositSession(w http.ResponseWriter, r *http.Request) {
-	var body map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		g.sendResponse(w, http.StatusBadRequest, nil, &ErrorInfo{
-			Code:    "VALIDATION_ERROR",
-			Message: "Invalid request body",
-		})
+	var body CreateDepositSessionRequest
+	if !g.decodeRequest(w, r, &body) {
 		return
 	}
 	
-	if _, ok := body["cartId"].(string); !ok {
-		g.sendResponse(w, http.StatusBadRequest, nil, &ErrorInfo{
-			Code:    "VALIDATION_ERROR",
-			Message: "cartId is required",
-		})
+	setRequestAttr(r, "cartId", body.CartID)
+	if !g.authorizeCart(w, r, body.CartID) {
 		return
 	}
 	
-	targetURL := g.backendAPIURL + "/api/v1/deposit-sessions"
-	bodyBytes, _ := json.Marshal(body)
-	req, _ := http.NewRequest("POST", targetURL, bytes.NewBuffer(bodyBytes))
-	req.Header.Set("Content-Type", "application/json")
-	
-	resp, err := g.client.Do(req)
+	bodyBytes, _ := json.Marshal(backendDepositSessionRequest(body))
+	resp, err := g.callUpstream(r, "POST", "/api/v1/deposit-sessions", bodyBytes)
 	if err != nil {
-		g.sendResponse(w, http.StatusBadGateway, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: "Failed to connect to backend API",
-		})
+		g.sendUpstreamError(w, err)
 		return
 	}
 	defer resp.Body.Close()
 	
-	var backendResp map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&backendResp)
-	
+	// A 404 may be about the cart or the plan; the backend's code or
+	// message tells which
 	if resp.StatusCode >= 400 {
-		// Extract error code and message from backend response
-		errorCode := "BACKEND_ERROR"
-		errorMessage := "An error occurred"
-		
-		if code, ok := backendResp["code"].(string); ok {
-			errorCode = code
-		}
-		if message, ok := backendResp["message"].(string); ok {
-			errorMessage = message
-		} else if msg, ok := backendResp["error"].(string); ok {
-			errorMessage = msg
-		}
-		
-		log.Printf("Backend API error response: status=%d, code=%s, message=%s", resp.StatusCode, errorCode, errorMessage)
-		
-		g.sendResponse(w, resp.StatusCode, nil, &ErrorInfo{
-			Code:    errorCode,
-			Message: errorMessage,
-			Details: backendResp["details"],
-		})
+		g.sendBackendError(w, resp, "NOT_FOUND")
 		return
 	}
 	
-	// Extract session_id safely
-	sessionId, ok := backendResp["session_id"].(string)
-	if !ok {
-		// If session_id is missing, return the full backend response
-		log.Printf("Warning: session_id not found in backend response, returning full response")
-		g.sendResponse(w, http.StatusOK, backendResp, nil)
+	var created backendDepositSessionCreated
+	if !g.decodeBackendResponse(w, resp, &created) {
 		return
 	}
-	
-	responseData := map[string]interface{}{
-		"deposit_session_url": "/deposit-session/" + sessionId,
-		"session_id":          sessionId,
-	}
-	
-	// Include checkout_url if available (for new multi-order flow)
-	if checkoutUrl, ok := backendResp["checkout_url"].(string); ok && checkoutUrl != "" {
-		responseData["checkout_url"] = checkoutUrl
-	} else if checkoutUrl, ok := backendResp["checkoutUrl"].(string); ok && checkoutUrl != "" {
-		// Try camelCase version
-		responseData["checkout_url"] = checkoutUrl
+	if created.SessionID == "" {
+		g.sendUnexpectedBackendResponse(w, resp, errors.New("session_id is missing"))
+		return
 	}
-	
-	// Include draft order IDs and payment amounts if available
-	if draftOrderIds, ok := backendResp["draft_order_ids"].([]interface{}); ok {
-		responseData["draft_order_ids"] = draftOrderIds
-	} else if draftOrderIds, ok := backendResp["draftOrderIds"].([]interface{}); ok {
-		// Try camelCase version
-		responseData["draft_order_ids"] = draftOrderIds
+	sessionId := created.SessionID
+	paymentAmounts := make([]Money, len(created.PaymentAmounts))
+	for i, amount := range created.PaymentAmounts {
+		paymentAmounts[i] = backendMoney(amount)
 	}
 	
-	if firstDraftOrderId, ok := backendResp["first_draft_order_id"].(string); ok {
-		responseData["first_draft_order_id"] = firstDraftOrderId
-	} else if firstDraftOrderId, ok := backendResp["firstDraftOrderId"].(string); ok {
-		responseData["first_draft_order_id"] = firstDraftOrderId
+	responseData := DepositSessionCreated{
+		SessionID:         sessionId,
+		DepositSessionURL: "/deposit-session/" + sessionId,
+		CheckoutURL:       created.CheckoutURL,
+		DraftOrderIDs:     created.DraftOrderIDs,
+		FirstDraftOrderID: created.FirstDraftOrderID,
+		PaymentAmounts:    paymentAmounts,
 	}
-	
-	if paymentAmounts, ok := backendResp["payment_amounts"].([]interface{}); ok {
-		responseData["payment_amounts"] = paymentAmounts
-	} else if paymentAmounts, ok := backendResp["paymentAmounts"].([]interface{}); ok {
-		responseData["payment_amounts"] = paymentAmounts
+	// The session URL carries a signed, expiring token; reads and checkout
+	// of the session require it
+	if signer := g.state.Load().sessions; signer != nil {
+		token, expiresAt := signer.sign(sessionId, time.Now())
+		responseData.DepositSessionURL = "/deposit-session/" + url.PathEscape(sessionId) + "?token=" + url.QueryEscape(token)
+		responseData.SessionToken = token
+		responseData.SessionTokenExpiresAt = expiresAt.UTC().Format(time.RFC3339)
 	}
 	
-	log.Printf("Deposit session created: sessionId=%s, hasCheckoutUrl=%v", sessionId, responseData["checkout_url"] != nil)
+	setRequestAttr(r, "sessionId", sessionId)
+	slog.InfoContext(r.Context(), "Deposit session created", "has_checkout_url", responseData.CheckoutURL != "")
+	g.metrics.depositSessions.inc()
 	g.sendResponse(w, http.StatusOK, responseData, nil)
 }
 
 // Handle get deposit session
 func (g *Gateway) handleGetDepositSession(w http.ResponseWriter, r *http.Request) {
-	pathParts := strings.Split(r.URL.Path, "/")
-	if len(pathParts) < 4 {
-		g.sendResponse(w, http.StatusBadRequest, nil, &ErrorInfo{
-			Code:    "VALIDATION_ERROR",
-			Message: "sessionId is required",
-		})
+	sessionId := pathParam(r, "sessionId")
+	setRequestAttr(r, "sessionId", sessionId)
+	if !g.authorizeSession(w, r, sessionId) {
 		return
 	}
-	
-	sessionId := pathParts[3]
-	targetURL := g.backendAPIURL + "/api/v1/deposit-sessions/" + sessionId
-	req, _ := http.NewRequest("GET", targetURL, nil)
-	
-	resp, err := g.client.Do(req)
+	resp, err := g.callUpstream(r, "GET", "/api/v1/deposit-sessions/" + url.PathEscape(sessionId), nil)
 	if err != nil {
-		g.sendResponse(w, http.StatusBadGateway, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: "Failed to connect to backend API",
-		})
+		g.sendUpstreamError(w, err)
 		return
 	}
 	defer resp.Body.Close()
 	
-	var backendResp map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&backendResp)
-	
 	if resp.StatusCode >= 400 {
-		g.sendResponse(w, resp.StatusCode, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: fmt.Sprintf("%v", backendResp["message"]),
-		})
+		g.sendBackendError(w, resp, "DEPOSIT_SESSION_NOT_FOUND")
 		return
 	}
 	
-	responseData := map[string]interface{}{
-		"session": backendResp,
+	var session backendDepositSession
+	if !g.decodeBackendResponse(w, resp, &session) {
+		return
 	}
-	g.sendResponse(w, http.StatusOK, responseData, nil)
+	g.sendResponse(w, http.StatusOK, DepositSessionResponse{Session: session.model()}, nil)
 }
 
 // Handle deposit session checkout
 func (g *Gateway) handleDepositSessionCheckout(w http.ResponseWriter, r *http.Request) {
-	pathParts := strings.Split(r.URL.Path, "/")
-	if len(pathParts) < 4 {
-		g.sendResponse(w, http.StatusBadRequest, nil, &ErrorInfo{
-			Code:    "VALIDATION_ERROR",
-			Message: "sessionId is required",
-		})
+	sessionId := pathParam(r, "sessionId")
+	setRequestAttr(r, "sessionId", sessionId)
+	if !g.authorizeSession(w, r, sessionId) {
 		return
 	}
-	
-	sessionId := pathParts[3]
-	targetURL := g.backendAPIURL + "/api/v1/deposit-sessions/" + sessionId + "/checkout"
-	req, _ := http.NewRequest("POST", targetURL, nil)
-	req.Header.Set("Content-Type", "application/json")
-	
-	resp, err := g.client.Do(req)
+	resp, err := g.callUpstream(r, "POST", "/api/v1/deposit-sessions/" + url.PathEscape(sessionId) + "/checkout", nil)
 	if err != nil {
-		g.sendResponse(w, http.StatusBadGateway, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: "Failed to connect to backend API",
-		})
+		g.sendUpstreamError(w, err)
 		return
 	}
 	defer resp.Body.Close()
 	
-	var backendResp map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&backendResp)
-	
 	if resp.StatusCode >= 400 {
-		g.sendResponse(w, resp.StatusCode, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: fmt.Sprintf("%v", backendResp["message"]),
-		})
+		g.sendBackendError(w, resp, "DEPOSIT_SESSION_NOT_FOUND")
 		return
 	}
 	
-	g.sendResponse(w, http.StatusOK, backendResp, nil)
+	var checkout DepositCheckoutResponse
+	if !g.decodeBackendResponse(w, resp, &checkout) {
+		return
+	}
+	g.metrics.checkouts.inc("deposit_session")
+	g.sendResponse(w, http.StatusOK, checkout, nil)
 }
 
 // Handle get order status
 func (g *Gateway) handleGetOrderStatus(w http.ResponseWriter, r *http.Request) {
-	pathParts := strings.Split(r.URL.Path, "/")
-	if len(pathParts) < 4 {
-		g.sendResponse(w, http.StatusBadRequest, nil, &ErrorInfo{
-			Code:    "VALIDATION_ERROR",
-			Message: "orderId is required",
-		})
-		return
-	}
-	
-	orderId := pathParts[3]
-	targetURL := g.backendAPIURL + "/api/v1/orders/" + orderId
-	req, _ := http.NewRequest("GET", targetURL, nil)
-	
-	resp, err := g.client.Do(req)
+	orderId := pathParam(r, "orderId")
+	setRequestAttr(r, "orderId", orderId)
+	resp, err := g.callUpstream(r, "GET", "/api/v1/orders/" + url.PathEscape(orderId), nil)
 	if err != nil {
-		g.sendResponse(w, http.StatusBadGateway, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: "Failed to connect to backend API",
-		})
+		g.sendUpstreamError(w, err)
 		return
 	}
 	defer resp.Body.Close()
 	
-	var backendResp map[string]interface{}
-	json.NewDecoder(resp.Body).Decode(&backendResp)
-	
 	if resp.StatusCode >= 400 {
-		g.sendResponse(w, resp.StatusCode, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: fmt.Sprintf("%v", backendResp["message"]),
-		})
+		g.sendBackendError(w, resp, "ORDER_NOT_FOUND")
 		return
 	}
 	
-	g.sendResponse(w, http.StatusOK, backendResp, nil)
+	var status OrderStatus
+	if !g.decodeBackendResponse(w, resp, &status) {
+		return
+	}
+	g.sendResponse(w, http.StatusOK, status, nil)
 }
 
 // Handle get deposit plans
 func (g *Gateway) handleGetDepositPlans(w http.ResponseWriter, r *http.Request) {
-	targetURL := g.backendAPIURL + "/api/v1/deposit-plans"
-	req, _ := http.NewRequest("GET", targetURL, nil)
-	
-	resp, err := g.client.Do(req)
+	resp, err := g.callUpstream(r, "GET", "/api/v1/deposit-plans", nil)
 	if err != nil {
-		g.sendResponse(w, http.StatusBadGateway, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: "Failed to connect to backend API",
-		})
+		g.sendUpstreamError(w, err)
 		return
 	}
 	defer resp.Body.Close()
 	
-	var backendResp interface{}
-	json.NewDecoder(resp.Body).Decode(&backendResp)
-	
 	if resp.StatusCode >= 400 {
-		errorResp, _ := backendResp.(map[string]interface{})
-		g.sendResponse(w, resp.StatusCode, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: fmt.Sprintf("%v", errorResp["message"]),
-		})
+		g.sendBackendError(w, resp, "NOT_FOUND")
 		return
 	}
 	
-	g.sendResponse(w, http.StatusOK, backendResp, nil)
+	var backendPlans []backendDepositPlan
+	if !g.decodeBackendResponse(w, resp, &backendPlans) {
+		return
+	}
+	plans := make([]DepositPlan, 0, len(backendPlans))
+	for _, plan := range backendPlans {
+		plans = append(plans, plan.DepositPlan)
+	}
+	g.sendResponse(w, http.StatusOK, plans, nil)
 }
 
 // Handle get default deposit plan
 func (g *Gateway) handleGetDefaultDepositPlan(w http.ResponseWriter, r *http.Request) {
-	targetURL := g.backendAPIURL + "/api/v1/deposit-plans/default"
-	req, _ := http.NewRequest("GET", targetURL, nil)
-	
-	resp, err := g.client.Do(req)
+	resp, err := g.callUpstream(r, "GET", "/api/v1/deposit-plans/default", nil)
 	if err != nil {
-		g.sendResponse(w, http.StatusBadGateway, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: "Failed to connect to backend API",
-		})
+		g.sendUpstreamError(w, err)
 		return
 	}
 	defer resp.Body.Close()
 	
-	var backendResp interface{}
-	json.NewDecoder(resp.Body).Decode(&backendResp)
-	
 	if resp.StatusCode >= 400 {
-		errorResp, _ := backendResp.(map[string]interface{})
-		g.sendResponse(w, resp.StatusCode, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: fmt.Sprintf("%v", errorResp["message"]),
-		})
+		g.sendBackendError(w, resp, "PLAN_NOT_FOUND")
 		return
 	}
 	
-	g.sendResponse(w, http.StatusOK, backendResp, nil)
+	var plan backendDepositPlan
+	if !g.decodeBackendResponse(w, resp, &plan) {
+		return
+	}
+	g.sendResponse(w, http.StatusOK, plan.DepositPlan, nil)
 }
 
 // Handle get specific deposit plan
 func (g *Gateway) handleGetDepositPlan(w http.ResponseWriter, r *http.Request) {
-	pathParts := strings.Split(r.URL.Path, "/")
-	if len(pathParts) < 4 {
-		g.sendResponse(w, http.StatusBadRequest, nil, &ErrorInfo{
-			Code:    "VALIDATION_ERROR",
-			Message: "planId is required",
-		})
-		return
-	}
-	
-	planId := pathParts[3]
-	targetURL := g.backendAPIURL + "/api/v1/deposit-plans/" + planId
-	req, _ := http.NewRequest("GET", targetURL, nil)
-	
-	resp, err := g.client.Do(req)
+	planId := pathParam(r, "planId")
+	setRequestAttr(r, "planId", planId)
+	resp, err := g.callUpstream(r, "GET", "/api/v1/deposit-plans/" + url.PathEscape(planId), nil)
 	if err != nil {
-		g.sendResponse(w, http.StatusBadGateway, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: "Failed to connect to backend API",
-		})
+		g.sendUpstreamError(w, err)
 		return
 	}
 	defer resp.Body.Close()
 	
-	var backendResp interface{}
-	json.NewDecoder(resp.Body).Decode(&backendResp)
-	
 	if resp.StatusCode >= 400 {
-		errorResp, _ := backendResp.(map[string]interface{})
-		g.sendResponse(w, resp.StatusCode, nil, &ErrorInfo{
-			Code:    "BACKEND_ERROR",
-			Message: fmt.Sprintf("%v", errorResp["message"]),
-		})
+		g.sendBackendError(w, resp, "PLAN_NOT_FOUND")
 		return
 	}
 	
-	g.sendResponse(w, http.StatusOK, backendResp, nil)
+	var plan backendDepositPlan
+	if !g.decodeBackendResponse(w, resp, &plan) {
+		return
+	}
+	g.sendResponse(w, http.StatusOK, plan.DepositPlan, nil)
+}
+
+// handler returns the gateway's middleware chain ending in the proxy
+func (g *Gateway) handler() http.HandlerFunc {
+	return g.requestIDMiddleware(
+		g.clientIPMiddleware(
+			g.tracingMiddleware(
+				g.corsMiddleware(
+					g.loggingMiddleware(
+						g.routeMiddleware(
+							g.metricsMiddleware(
+								g.bodyLimitMiddleware(
+									g.authMiddleware(
+										g.rateLimitMiddleware(
+											g.proxyHandler,
+										),
+									),
+								),
+							),
+						),
+					),
+				),
+			),
+		),
+	)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hash-key" {
+		if err := hashKeyCommand(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+
+	setupLogging()
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
-	gateway := NewGateway()
+	config, err := LoadConfig()
+	if err != nil {
+		slog.Error("Invalid gateway configuration", "error", err)
+		os.Exit(1)
+	}
 
-	// Setup routes with middleware chain
-	handler := gateway.corsMiddleware(
-		gateway.loggingMiddleware(
-			gateway.authMiddleware(
-				gateway.proxyHandler,
-			),
-		),
-	)
+	gateway, err := NewGateway(config)
+	if err != nil {
+		slog.Error("Failed to start gateway", "error", err)
+		os.Exit(1)
+	}
 
-	http.HandleFunc("/", handler)
-
-	log.Printf("API Gateway starting on port %s", port)
-	log.Printf("PostgREST backend: %s", gateway.postgrestURL)
-	log.Printf("Backend API: %s", gateway.backendAPIURL)
-	log.Printf("MCP Service: %s", gateway.mcpServiceURL)
-	log.Printf("Worker Service: %s", gateway.workerServiceURL)
-	log.Println("Routing:")
-	log.Println("  /api/gw/v1/* -> Frontend API (Gateway)")
-	log.Println("  /rest/*       -> PostgREST")
-	log.Println("  /api/*        -> Backend API")
-	log.Println("  /mcp/*        -> MCP Service")
-	log.Println("  /worker/*     -> Worker Service")
-	if gateway.apiKey != "" {
-		log.Println("Authentication: Enabled (API Key)")
+	gateway.watchConfig(configPollInterval())
+	if config.Metrics.enabled() {
+		go gateway.serveMetrics(config.Metrics.Listen)
+	}
+
+	http.HandleFunc("/", gateway.handler())
+
+	slog.Info("API Gateway starting", "port", port)
+	upstreams := gateway.state.Load().upstreams
+	for _, name := range sortedKeys(upstreams) {
+		slog.Info("Upstream", "name", name, "targets", upstreams[name].describe())
+	}
+	for _, route := range gateway.state.Load().routes.routes {
+		slog.Info("Route", "name", route.Name, "route", route.describe())
+	}
+	if path := configPath(); path != "" {
+		slog.Info("Config loaded, reloaded on change or SIGHUP", "path", path)
+	} else {
+		slog.Info("Config: built-in defaults")
+	}
+	if keys := gateway.state.Load().apiKeys; keys.enabled() {
+		slog.Info("Authentication enabled", "api_keys", len(*keys.keys.Load()))
 	} else {
-		log.Println("Authentication: Disabled")
+		slog.Warn("No API keys configured (API_KEY or api_keys.file), authentication disabled")
 	}
 
 	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+		slog.Error("Server failed to start", "error", err)
+		os.Exit(1)
 	}
 }
 
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestGateway builds a gateway from a YAML configuration, without the
+// API_KEY of the environment running the tests
+func newTestGateway(t *testing.T, config string) *Gateway {
+	t.Helper()
+	t.Setenv("API_KEY", "")
+	cfg, err := parseConfig([]byte(config), ".yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewGateway(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { g.state.Load().close() })
+	return g
+}
+
+// serveGateway sends a request through the whole middleware chain
+func serveGateway(g *Gateway, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	g.handler()(w, r)
+	return w
+}
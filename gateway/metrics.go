@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Latency buckets in seconds, the Prometheus client defaults
+var defaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// gatewayMetrics holds everything served on the metrics endpoint. It lives
+// on the Gateway, so counters keep counting across config reloads.
+type gatewayMetrics struct {
+	requests         *metricVec
+	requestDuration  *metricVec
+	requestsInFlight *metricVec
+	upstreamDuration *metricVec
+	upstreamErrors   *metricVec
+	cartItemsAdded   *metricVec
+	checkouts        *metricVec
+	depositSessions  *metricVec
+}
+
+func newGatewayMetrics() *gatewayMetrics {
+	m := &gatewayMetrics{
+		requests: newMetricVec("gateway_http_requests_total", "counter",
+			"Requests served, by route template, method, status class and upstream.",
+			"route", "method", "status_class", "upstream"),
+		requestDuration: newHistogramVec("gateway_http_request_duration_seconds",
+			"Time to serve requests, by route template, method, status class and upstream.",
+			defaultLatencyBuckets, "route", "method", "status_class", "upstream"),
+		requestsInFlight: newMetricVec("gateway_http_requests_in_flight", "gauge",
+			"Requests being served, by route template, method and upstream.",
+			"route", "method", "upstream"),
+		upstreamDuration: newHistogramVec("gateway_upstream_request_duration_seconds",
+			"Duration of upstream call attempts, by upstream, method and status class (error when no response was received).",
+			defaultLatencyBuckets, "upstream", "method", "status_class"),
+		upstreamErrors: newMetricVec("gateway_upstream_errors_total", "counter",
+			"Failed upstream calls, by upstream and the error code sent to the client.",
+			"upstream", "code"),
+		cartItemsAdded: newMetricVec("gateway_cart_items_added_total", "counter",
+			"Items added to carts, by item source.",
+			"source"),
+		checkouts: newMetricVec("gateway_checkouts_total", "counter",
+			"Checkouts started, by flow (cart or deposit_session).",
+			"flow"),
+		depositSessions: newMetricVec("gateway_deposit_sessions_created_total", "counter",
+			"Deposit sessions created."),
+	}
+	// Business counters are exported from the start, so rates work before
+	// the first event
+	m.cartItemsAdded.add(0, "shopify")
+	m.cartItemsAdded.add(0, "external")
+	m.checkouts.add(0, "cart")
+	m.checkouts.add(0, "deposit_session")
+	m.depositSessions.add(0)
+	return m
+}
+
+// metricVec is a Prometheus metric family: one series per combination of
+// label values
+type metricVec struct {
+	name    string
+	kind    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels []string
+	value  float64
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newMetricVec(name, kind, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, kind: kind, help: help, labels: labels, series: map[string]*metricSeries{}}
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *metricVec {
+	m := newMetricVec(name, "histogram", help, labels...)
+	m.buckets = buckets
+	return m
+}
+
+func (m *metricVec) get(labels []string) *metricSeries {
+	key := strings.Join(labels, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labels: labels}
+		if m.buckets != nil {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add adds delta to a counter or gauge
+func (m *metricVec) add(delta float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labels).value += delta
+}
+
+func (m *metricVec) inc(labels ...string) {
+	m.add(1, labels...)
+}
+
+// observe records a histogram sample
+func (m *metricVec) observe(v float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labels)
+	for i, bound := range m.buckets {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+// write renders the family in the Prometheus text exposition format
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	b.WriteString("# HELP " + m.name + " " + m.help + "\n")
+	b.WriteString("# TYPE " + m.name + " " + m.kind + "\n")
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			b.WriteString(m.name + formatLabels(m.labels, s.labels, "") + " " + formatValue(s.value) + "\n")
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += s.counts[i]
+			b.WriteString(m.name + "_bucket" + formatLabels(m.labels, s.labels, formatValue(bound)) + " " + strconv.FormatUint(cumulative, 10) + "\n")
+		}
+		b.WriteString(m.name + "_bucket" + formatLabels(m.labels, s.labels, "+Inf") + " " + strconv.FormatUint(s.count, 10) + "\n")
+		b.WriteString(m.name + "_sum" + formatLabels(m.labels, s.labels, "") + " " + formatValue(s.sum) + "\n")
+		b.WriteString(m.name + "_count" + formatLabels(m.labels, s.labels, "") + " " + strconv.FormatUint(s.count, 10) + "\n")
+	}
+	io.WriteString(w, b.String())
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders {name="value",...}, with an le label for histogram buckets
+func formatLabels(names, values []string, le string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelValueEscaper.Replace(values[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// statusClass groups status codes for labels: 2xx, 4xx, ...
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// metricMethod keeps label cardinality bounded whatever method clients send
+func metricMethod(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+		return method
+	}
+	return "OTHER"
+}
+
+// metricsMiddleware counts and times requests. It runs right after
+// routeMiddleware; the route label is the API route template when the
+// frontend router matched one, and the route's path template otherwise.
+func (g *Gateway) metricsMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := routeFromContext(r.Context())
+		method := metricMethod(r.Method)
+
+		inFlight := []string{route.template(), method, route.Upstream}
+		g.metrics.requestsInFlight.add(1, inFlight...)
+		ww := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		// Deferred so requests aborted mid-response are counted and leave
+		// the in-flight gauge
+		defer func() {
+			g.metrics.requestsInFlight.add(-1, inFlight...)
+			labels := []string{requestAttr(r, "routeTemplate"), method, statusClass(ww.statusCode), route.Upstream}
+			g.metrics.requests.inc(labels...)
+			g.metrics.requestDuration.observe(time.Since(start).Seconds(), labels...)
+		}()
+		next(ww, r)
+	}
+}
+
+type upstreamNameContextKey struct{}
+
+// withUpstreamName tags an outbound request with the upstream it is sent
+// to, so errors read from its response can be counted per upstream
+func withUpstreamName(req *http.Request, name string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), upstreamNameContextKey{}, name))
+}
+
+func upstreamName(req *http.Request) string {
+	name, _ := req.Context().Value(upstreamNameContextKey{}).(string)
+	return name
+}
+
+// observeUpstreamAttempt records the duration and outcome of one upstream call attempt
+func (g *Gateway) observeUpstreamAttempt(upstream, method string, status int, elapsed time.Duration) {
+	class := "error"
+	if status != 0 {
+		class = statusClass(status)
+	}
+	g.metrics.upstreamDuration.observe(elapsed.Seconds(), upstream, metricMethod(method), class)
+}
+
+// countUpstreamError counts an upstream call that failed without a
+// response; calls abandoned because the client went away are not errors
+func (g *Gateway) countUpstreamError(upstream string, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	g.metrics.upstreamErrors.inc(upstream, upstreamError(err).Code)
+}
+
+// serveMetrics serves the metrics endpoint on its own listener, so it is
+// reachable by the scraper without going through the routing table and
+// never exposed on the public port
+func (g *Gateway) serveMetrics(addr string) {
+	slog.Info("Metrics listening", "addr", addr)
+	if err := http.ListenAndServe(addr, http.HandlerFunc(g.handleMetrics)); err != nil {
+		slog.Error("Metrics listener stopped", "error", err)
+	}
+}
+
+// handleMetrics renders all metrics in the Prometheus text format. The
+// path and token come from the active configuration.
+func (g *Gateway) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	cfg := g.state.Load().config.Metrics
+	if cfg == nil || r.URL.Path != cfg.path() {
+		http.NotFound(w, r)
+		return
+	}
+	if cfg.Token != "" {
+		token, _ := bearerToken(r)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m := g.metrics
+	for _, family := range []*metricVec{
+		m.requests, m.requestDuration, m.requestsInFlight,
+		m.upstreamDuration, m.upstreamErrors,
+		m.cartItemsAdded, m.checkouts, m.depositSessions,
+	} {
+		family.write(w)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterExposition(t *testing.T) {
+	m := newMetricVec("gateway_test_total", "counter", "Test events, by kind.", "kind", "note")
+	m.inc("b", "plain")
+	m.add(2.5, "a", `quote " backslash \ newline `+"\n")
+	m.inc("b", "plain")
+
+	var b strings.Builder
+	m.write(&b)
+	want := `# HELP gateway_test_total Test events, by kind.
+# TYPE gateway_test_total counter
+gateway_test_total{kind="a",note="quote \" backslash \\ newline \n"} 2.5
+gateway_test_total{kind="b",note="plain"} 2
+`
+	if got := b.String(); got != want {
+		t.Errorf("exposition:\n%s\nwant:\n%s", got, want)
+	}
+
+	unlabelled := newMetricVec("gateway_events_total", "counter", "Events.")
+	unlabelled.add(0)
+	b.Reset()
+	unlabelled.write(&b)
+	if got := b.String(); !strings.HasSuffix(got, "\ngateway_events_total 0\n") {
+		t.Errorf("unlabelled exposition:\n%s", got)
+	}
+}
+
+func TestHistogramExposition(t *testing.T) {
+	m := newHistogramVec("gateway_test_seconds", "Test durations.", []float64{.1, .5, 1}, "route")
+	for _, v := range []float64{.05, .1, .3, 2} {
+		m.observe(v, "/cart")
+	}
+
+	var b strings.Builder
+	m.write(&b)
+	want := `# HELP gateway_test_seconds Test durations.
+# TYPE gateway_test_seconds histogram
+gateway_test_seconds_bucket{route="/cart",le="0.1"} 2
+gateway_test_seconds_bucket{route="/cart",le="0.5"} 3
+gateway_test_seconds_bucket{route="/cart",le="1"} 3
+gateway_test_seconds_bucket{route="/cart",le="+Inf"} 4
+gateway_test_seconds_sum{route="/cart"} 2.45
+gateway_test_seconds_count{route="/cart"} 4
+`
+	if got := b.String(); got != want {
+		t.Errorf("exposition:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestMetricLabels(t *testing.T) {
+	for status, want := range map[int]string{200: "2xx", 204: "2xx", 301: "3xx", 404: "4xx", 503: "5xx"} {
+		if got := statusClass(status); got != want {
+			t.Errorf("statusClass(%d) = %s", status, got)
+		}
+	}
+	for method, want := range map[string]string{"GET": "GET", "DELETE": "DELETE", "PROPFIND": "OTHER", "get": "OTHER", "": "OTHER"} {
+		if got := metricMethod(method); got != want {
+			t.Errorf("metricMethod(%q) = %s", method, got)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer backend.Close()
+	g := newTestGateway(t, proxyConfig(backend.URL)+`
+metrics:
+  listen: 127.0.0.1:0
+  path: /internal/metrics
+  token: scrape-token
+`)
+	serveGateway(g, httptest.NewRequest("GET", "/products", nil))
+	serveGateway(g, httptest.NewRequest("GET", "/products", nil))
+	serveGateway(g, httptest.NewRequest("GET", "/missing", nil))
+	serveGateway(g, httptest.NewRequest("PROPFIND", "/products", nil))
+
+	scrape := func(method, path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		g.handleMetrics(w, r)
+		return w
+	}
+
+	w := scrape("GET", "/internal/metrics", "scrape-token")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Fatalf("scrape: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		`gateway_http_requests_total{route="/*",method="GET",status_class="2xx",upstream="backend"} 2`,
+		`gateway_http_requests_total{route="/*",method="GET",status_class="4xx",upstream="backend"} 1`,
+		`gateway_http_requests_total{route="/*",method="OTHER",status_class="2xx",upstream="backend"} 1`,
+		`gateway_http_request_duration_seconds_count{route="/*",method="GET",status_class="2xx",upstream="backend"} 2`,
+		`gateway_http_requests_in_flight{route="/*",method="GET",upstream="backend"} 0`,
+		`gateway_upstream_request_duration_seconds_count{upstream="backend",method="GET",status_class="4xx"} 1`,
+		`gateway_cart_items_added_total{source="shopify"} 0`,
+		`gateway_checkouts_total{flow="deposit_session"} 0`,
+		"\ngateway_deposit_sessions_created_total 0\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("scrape lacks %s", want)
+		}
+	}
+
+	// Every series belongs to a family with one HELP and one TYPE line
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, _, _ := strings.Cut(line, "{")
+		name, _, _ = strings.Cut(name, " ")
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if family := strings.TrimSuffix(name, suffix); family != name && strings.Contains(body, "# TYPE "+family+" histogram") {
+				name = family
+			}
+		}
+		if strings.Count(body, "# TYPE "+name+" ") != 1 || strings.Count(body, "# HELP "+name+" ") != 1 {
+			t.Errorf("family of %q not announced exactly once", line)
+		}
+	}
+
+	if w := scrape("GET", "/internal/metrics", ""); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("without token: %d", w.Code)
+	}
+	if w := scrape("GET", "/internal/metrics", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: %d", w.Code)
+	}
+	if w := scrape("GET", "/metrics", "scrape-token"); w.Code != http.StatusNotFound {
+		t.Errorf("other path: %d", w.Code)
+	}
+	if w := scrape("POST", "/internal/metrics", "scrape-token"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: %d", w.Code)
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Request and response models of the /api/gw/v1 frontend API. Requests and
+// backend responses are decoded strictly: unknown fields are rejected, so a
+// misspelled field from the storefront is a VALIDATION_ERROR and a change in
+// the shape of backend-api responses is caught here instead of being passed
+// on. Everything the gateway returns uses camelCase field names.
+
+// Money is an amount in a currency, as in Shopify's MoneyV2. The amount is a
+// decimal string so prices aren't subject to float rounding.
+type Money struct {
+	Amount       string `json:"amount"`
+	CurrencyCode string `json:"currencyCode"`
+}
+
+// backendCurrency is the currency of the deposit amounts backend-api sends
+// as plain numbers
+const backendCurrency = "USD"
+
+// backendMoney converts a backend-api amount, rounded to cents
+func backendMoney(amount float64) Money {
+	return Money{Amount: strconv.FormatFloat(amount, 'f', 2, 64), CurrencyCode: backendCurrency}
+}
+
+type CartAttribute struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type CartLine struct {
+	ID         string          `json:"id"`
+	Source     string          `json:"source"`
+	ProductID  string          `json:"productId,omitempty"`
+	VariantID  string          `json:"variantId,omitempty"`
+	ExternalID string          `json:"externalId,omitempty"`
+	Title      string          `json:"title"`
+	ImageURL   string          `json:"imageUrl,omitempty"`
+	Price      Money           `json:"price"`
+	Quantity   int             `json:"quantity"`
+	Attributes []CartAttribute `json:"attributes"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+}
+
+type CartCost struct {
+	SubtotalAmount  Money  `json:"subtotalAmount"`
+	TotalAmount     Money  `json:"totalAmount"`
+	TotalTaxAmount  *Money `json:"totalTaxAmount"`
+	TotalDutyAmount *Money `json:"totalDutyAmount"`
+}
+
+type Cart struct {
+	ID            string     `json:"id"`
+	CustomerID    flexibleID `json:"customerId,omitempty"`
+	TotalQuantity int        `json:"totalQuantity"`
+	TotalAmount   float64    `json:"totalAmount"`
+	Lines         []CartLine `json:"lines"`
+	Cost          CartCost   `json:"cost"`
+}
+
+// CartResponse is returned by every cart endpoint. CartToken is only set for
+// a new anonymous cart while cart ownership is enforced.
+type CartResponse struct {
+	CartID    string `json:"cartId"`
+	Cart      *Cart  `json:"cart"`
+	CartToken string `json:"cartToken,omitempty"`
+}
+
+type AddCartItemRequest struct {
+	CartID        string          `json:"cartId,omitempty"`
+	Source        string          `json:"source"`
+	VariantID     string          `json:"variantId,omitempty"`
+	ExternalID    string          `json:"externalId,omitempty"`
+	ProductHandle string          `json:"productHandle,omitempty"`
+	Title         string          `json:"title,omitempty"`
+	ImageURL      string          `json:"imageUrl,omitempty"`
+	Price         *Money          `json:"price"`
+	Quantity      *int            `json:"quantity"`
+	Attributes    []CartAttribute `json:"attributes,omitempty"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+	CustomerID    string          `json:"customerId,omitempty"`
+	Quote         string          `json:"quote,omitempty"`
+}
+
+type UpdateCartItemRequest struct {
+	CartID   string `json:"cartId"`
+	LineID   string `json:"lineId"`
+	Quantity *int   `json:"quantity"`
+}
+
+type RemoveCartItemRequest struct {
+	CartID string `json:"cartId"`
+	LineID string `json:"lineId"`
+}
+
+type CheckoutRequest struct {
+	CartID string `json:"cartId"`
+}
+
+type CheckoutResponse struct {
+	CartID      string `json:"cartId"`
+	CheckoutURL string `json:"checkoutUrl"`
+}
+
+type MergeCartRequest struct {
+	CartID         string `json:"cartId"`
+	CustomerCartID string `json:"customerCartId,omitempty"`
+}
+
+type CreateQuoteRequest struct {
+	ExternalID string `json:"externalId"`
+	Collection string `json:"collection,omitempty"`
+}
+
+type QuoteResponse struct {
+	Quote      string `json:"quote"`
+	ExternalID string `json:"externalId"`
+	Collection string `json:"collection"`
+	Price      Money  `json:"price"`
+	ExpiresAt  string `json:"expiresAt"`
+}
+
+// DepositSessionItem is a cart line as recorded in a deposit session
+type DepositSessionItem struct {
+	VariantID string `json:"variantId,omitempty"`
+	ProductID string `json:"productId,omitempty"`
+	Title     string `json:"title"`
+	Price     Money  `json:"price"`
+	ImageURL  string `json:"imageUrl,omitempty"`
+	Quantity  int    `json:"quantity"`
+}
+
+// CreateDepositSessionRequest creates a deposit session for a cart; planId
+// defaults to the default plan. Lines and amounts always come from the cart,
+// whose external items were priced from verified quotes, so clients can't
+// send their own.
+type CreateDepositSessionRequest struct {
+	CartID     string `json:"cartId"`
+	CustomerID string `json:"customerId,omitempty"`
+	PlanID     string `json:"planId,omitempty"`
+}
+
+type DepositSessionCreated struct {
+	SessionID             string   `json:"sessionId"`
+	DepositSessionURL     string   `json:"depositSessionUrl"`
+	SessionToken          string   `json:"sessionToken,omitempty"`
+	SessionTokenExpiresAt string   `json:"sessionTokenExpiresAt,omitempty"`
+	CheckoutURL           string   `json:"checkoutUrl,omitempty"`
+	DraftOrderIDs         []string `json:"draftOrderIds"`
+	FirstDraftOrderID     string   `json:"firstDraftOrderId,omitempty"`
+	PaymentAmounts        []Money  `json:"paymentAmounts"`
+}
+
+type PaymentSchedule struct {
+	ID                  flexibleID `json:"id"`
+	InstallmentNumber   int        `json:"installmentNumber"`
+	InstallmentType     string     `json:"installmentType"`
+	Amount              float64    `json:"amount"`
+	ShopifyDraftOrderID string     `json:"shopifyDraftOrderId,omitempty"`
+	CheckoutURL         string     `json:"checkoutUrl,omitempty"`
+	Status              string     `json:"status"`
+	DueDate             *time.Time `json:"dueDate"`
+	PaidAmount          float64    `json:"paidAmount"`
+	PaidAt              *time.Time `json:"paidAt"`
+}
+
+type DepositSession struct {
+	SessionID         string               `json:"sessionId"`
+	CartID            string               `json:"cartId"`
+	CustomerID        flexibleID           `json:"customerId,omitempty"`
+	PlanID            string               `json:"planId,omitempty"`
+	Items             []DepositSessionItem `json:"items"`
+	TotalAmount       float64              `json:"totalAmount"`
+	PaymentStatus     string               `json:"paymentStatus"`
+	TotalInstallments int                  `json:"totalInstallments"`
+	PaidInstallments  int                  `json:"paidInstallments"`
+	CheckoutURL       string               `json:"checkoutUrl,omitempty"`
+	CreatedAt         *time.Time           `json:"createdAt"`
+	ExpiresAt         *time.Time           `json:"expiresAt"`
+	PaymentSchedules  []PaymentSchedule    `json:"paymentSchedules"`
+}
+
+type DepositSessionResponse struct {
+	Session DepositSession `json:"session"`
+}
+
+type DepositCheckoutResponse struct {
+	CheckoutURL string `json:"checkoutUrl"`
+}
+
+type DepositPlan struct {
+	ID                  string     `json:"id"`
+	Name                string     `json:"name"`
+	Description         *string    `json:"description"`
+	Type                string     `json:"type"`
+	Percentage          *float64   `json:"percentage"`
+	FixedAmount         *float64   `json:"fixedAmount"`
+	NumberOfInstalments int        `json:"numberOfInstalments"`
+	MinDeposit          *float64   `json:"minDeposit"`
+	MaxDeposit          *float64   `json:"maxDeposit"`
+	IsDefault           bool       `json:"isDefault"`
+	Active              bool       `json:"active"`
+	CreatedAt           *time.Time `json:"createdAt"`
+	UpdatedAt           *time.Time `json:"updatedAt"`
+}
+
+type OrderStatus struct {
+	OrderID         string  `json:"orderId"`
+	Status          string  `json:"status"`
+	DepositAmount   float64 `json:"depositAmount"`
+	RemainingAmount float64 `json:"remainingAmount"`
+	DepositPaid     bool    `json:"depositPaid"`
+	RemainingPaid   bool    `json:"remainingPaid"`
+	PaymentLink     *string `json:"paymentLink"`
+}
+
+// Shapes backend-api uses in snake_case, converted to the models above
+
+type backendDepositSessionRequest struct {
+	CartID     string `json:"cartId"`
+	CustomerID string `json:"customer_id,omitempty"`
+	PlanID     string `json:"plan_id,omitempty"`
+}
+
+type backendDepositSessionCreated struct {
+	SessionID         string    `json:"session_id"`
+	DraftOrderIDs     []string  `json:"draft_order_ids"`
+	FirstDraftOrderID string    `json:"first_draft_order_id"`
+	CheckoutURL       string    `json:"checkout_url"`
+	PaymentAmounts    []float64 `json:"payment_amounts"`
+}
+
+type backendPaymentSchedule struct {
+	ID                  flexibleID `json:"id"`
+	InstallmentNumber   int        `json:"installment_number"`
+	InstallmentType     string     `json:"installment_type"`
+	Amount              float64    `json:"amount"`
+	ShopifyDraftOrderID string     `json:"shopify_draft_order_id"`
+	CheckoutURL         string     `json:"checkout_url"`
+	Status              string     `json:"status"`
+	DueDate             *time.Time `json:"due_date"`
+	PaidAmount          float64    `json:"paid_amount"`
+	PaidAt              *time.Time `json:"paid_at"`
+}
+
+type backendDepositSession struct {
+	SessionID         string                   `json:"session_id"`
+	CartID            string                   `json:"cart_id"`
+	CustomerID        flexibleID               `json:"customer_id"`
+	PlanID            string                   `json:"plan_id"`
+	Items             []DepositSessionItem     `json:"items"`
+	TotalAmount       float64                  `json:"total_amount"`
+	PaymentStatus     string                   `json:"payment_status"`
+	TotalInstallments int                      `json:"total_installments"`
+	PaidInstallments  int                      `json:"paid_installments"`
+	CheckoutURL       string                   `json:"checkout_url"`
+	CreatedAt         *time.Time               `json:"created_at"`
+	ExpiresAt         *time.Time               `json:"expires_at"`
+	PaymentSchedules  []backendPaymentSchedule `json:"payment_schedules"`
+}
+
+func (s *backendDepositSession) model() DepositSession {
+	session := DepositSession{
+		SessionID:         s.SessionID,
+		CartID:            s.CartID,
+		CustomerID:        s.CustomerID,
+		PlanID:            s.PlanID,
+		Items:             s.Items,
+		TotalAmount:       s.TotalAmount,
+		PaymentStatus:     s.PaymentStatus,
+		TotalInstallments: s.TotalInstallments,
+		PaidInstallments:  s.PaidInstallments,
+		CheckoutURL:       s.CheckoutURL,
+		CreatedAt:         s.CreatedAt,
+		ExpiresAt:         s.ExpiresAt,
+		PaymentSchedules:  []PaymentSchedule{},
+	}
+	for _, schedule := range s.PaymentSchedules {
+		session.PaymentSchedules = append(session.PaymentSchedules, PaymentSchedule(schedule))
+	}
+	return session
+}
+
+// backendDepositPlan is a plan as backend-api sends it: the number of
+// instalments is repeated under two legacy names
+type backendDepositPlan struct {
+	DepositPlan
+	LegacyNumberOfInstalments int `json:"number_of_instalments"`
+	TotalInstallments         int `json:"total_installments"`
+}
+
+// flexibleID is an identifier the backend may send as a JSON string or
+// number, depending on the column type
+type flexibleID string
+
+func (id *flexibleID) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	if strings.HasPrefix(string(data), `"`) {
+		var s string
+		err := json.Unmarshal(data, &s)
+		*id = flexibleID(s)
+		return err
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*id = flexibleID(n)
+	return nil
+}
+
+func validationError(field, message string) *ErrorInfo {
+	return validationErrors([]validationIssue{{Field: field, Message: message}})
+}
+
+// validationErrors reports every problem found in a request; the message is
+// the first one's
+func validationErrors(issues []validationIssue) *ErrorInfo {
+	return &ErrorInfo{
+		Code:    "VALIDATION_ERROR",
+		Message: issues[0].Message,
+		Details: map[string]interface{}{"errors": issues},
+	}
+}
+
+// decodeStrict decodes a single JSON value into v, rejecting unknown fields
+// and trailing data
+func decodeStrict(body io.Reader, v interface{}) error {
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after JSON value")
+	}
+	return nil
+}
+
+// decodeRequest decodes a request body into its model, replying with a
+// VALIDATION_ERROR envelope naming the offending field if it doesn't fit
+func (g *Gateway) decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := decodeStrict(r.Body, v)
+	if err == nil {
+		return true
+	}
+	if g.sendBodyTooLarge(w, err) {
+		return false
+	}
+	slog.InfoContext(r.Context(), "Invalid request body", "method", r.Method, "path", r.URL.Path, "error", err)
+
+	errInfo := &ErrorInfo{
+		Code:    "VALIDATION_ERROR",
+		Message: "Invalid request body",
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		errInfo = validationError(typeErr.Field, typeErr.Field+" must be "+jsonTypeName(typeErr.Type))
+	} else if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		field, _ = strconv.Unquote(field)
+		errInfo = validationError(field, "Unknown field "+strconv.Quote(field))
+	}
+	g.sendResponse(w, http.StatusBadRequest, nil, errInfo)
+	return false
+}
+
+// decodeBackendResponse decodes a successful backend response into its
+// model, replying with a BACKEND_ERROR envelope if the response doesn't fit
+func (g *Gateway) decodeBackendResponse(w http.ResponseWriter, resp *http.Response, v interface{}) bool {
+	if err := decodeStrict(resp.Body, v); err != nil {
+		g.sendUnexpectedBackendResponse(w, resp, err)
+		return false
+	}
+	return true
+}
+
+func (g *Gateway) sendUnexpectedBackendResponse(w http.ResponseWriter, resp *http.Response, err error) {
+	slog.ErrorContext(resp.Request.Context(), "Unexpected backend response", "method", resp.Request.Method, "backend_path", resp.Request.URL.Path, "error", err)
+	g.sendResponse(w, http.StatusBadGateway, nil, &ErrorInfo{
+		Code:    "BACKEND_ERROR",
+		Message: "Unexpected response from backend API",
+	})
+}
+
+// jsonTypeName describes the JSON value expected for a Go type
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonTypeName(t.Elem())
+	case reflect.String:
+		return "a string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	}
+	return "valid JSON"
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBackendMoney(t *testing.T) {
+	tests := []struct {
+		amount float64
+		want   string
+	}{
+		{1171.42, "1171.42"},
+		{2733.3, "2733.30"},
+		{100, "100.00"},
+		{0.1 + 0.2, "0.30"},
+		{0, "0.00"},
+	}
+	for _, tt := range tests {
+		if got := backendMoney(tt.amount); got.Amount != tt.want || got.CurrencyCode != "USD" {
+			t.Errorf("backendMoney(%v) = %+v, want %s USD", tt.amount, got, tt.want)
+		}
+	}
+}
+
+func TestCreateDepositSessionPaymentAmounts(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api/v1/deposit-sessions" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, `{"session_id":"deposit_1","draft_order_ids":["gid://shopify/DraftOrder/1","gid://shopify/DraftOrder/2"],`+
+			`"first_draft_order_id":"gid://shopify/DraftOrder/1","checkout_url":"https://shop.example/invoices/1","payment_amounts":[1171.42,2733.3]}`)
+	}))
+	defer backend.Close()
+	g := newTestGateway(t, `
+upstreams:
+  backend:
+    url: `+backend.URL+`
+routes:
+  - name: frontend
+    prefix: /api/gw/v1/
+    handler: frontend
+    upstream: backend
+    auth: none
+`)
+
+	r := httptest.NewRequest("POST", "/api/gw/v1/deposit-sessions", strings.NewReader(`{"cartId":"cart-1"}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := serveGateway(g, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var envelope struct {
+		Data DepositSessionCreated `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatal(err)
+	}
+	want := []Money{{"1171.42", "USD"}, {"2733.30", "USD"}}
+	got := envelope.Data.PaymentAmounts
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("paymentAmounts = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// openAPIYAML documents the frontend API (/api/gw/v1). It is served to
+// clients and requests are validated against it, so it can't drift from
+// what the gateway accepts.
+//
+//go:embed openapi.yaml
+var openAPIYAML []byte
+
+var frontendSpec = mustLoadOpenAPI(openAPIYAML)
+
+// openAPISpec is the part of an OpenAPI 3.0 document needed to validate
+// requests, along with the document itself rendered as JSON
+type openAPISpec struct {
+	json       []byte
+	operations map[string]*openAPIOperation // keyed by "METHOD /path/{param}"
+	schemas    map[string]*jsonSchema
+}
+
+type openAPIDocument struct {
+	Paths      map[string]openAPIPathItem `yaml:"paths"`
+	Components struct {
+		Schemas    map[string]*jsonSchema       `yaml:"schemas"`
+		Parameters map[string]*openAPIParameter `yaml:"parameters"`
+	} `yaml:"components"`
+}
+
+type openAPIPathItem struct {
+	Get    *openAPIOperation `yaml:"get"`
+	Post   *openAPIOperation `yaml:"post"`
+	Put    *openAPIOperation `yaml:"put"`
+	Patch  *openAPIOperation `yaml:"patch"`
+	Delete *openAPIOperation `yaml:"delete"`
+}
+
+type openAPIOperation struct {
+	OperationID string              `yaml:"operationId"`
+	Parameters  []*openAPIParameter `yaml:"parameters"`
+	RequestBody *struct {
+		Required bool `yaml:"required"`
+		Content  map[string]struct {
+			Schema *jsonSchema `yaml:"schema"`
+		} `yaml:"content"`
+	} `yaml:"requestBody"`
+}
+
+type openAPIParameter struct {
+	Ref      string      `yaml:"$ref"`
+	Name     string      `yaml:"name"`
+	In       string      `yaml:"in"`
+	Required bool        `yaml:"required"`
+	Schema   *jsonSchema `yaml:"schema"`
+}
+
+// jsonSchema is the subset of OpenAPI schema objects the validator
+// understands. Keywords it doesn't know, such as format or example, are
+// documentation only.
+type jsonSchema struct {
+	Ref                  string                 `yaml:"$ref"`
+	Type                 string                 `yaml:"type"`
+	Nullable             bool                   `yaml:"nullable"`
+	Properties           map[string]*jsonSchema `yaml:"properties"`
+	Required             []string               `yaml:"required"`
+	AdditionalProperties *bool                  `yaml:"additionalProperties"`
+	Items                *jsonSchema            `yaml:"items"`
+	Enum                 []interface{}          `yaml:"enum"`
+	Minimum              *float64               `yaml:"minimum"`
+	Maximum              *float64               `yaml:"maximum"`
+	MinLength            *int                   `yaml:"minLength"`
+	MaxLength            *int                   `yaml:"maxLength"`
+	Pattern              string                 `yaml:"pattern"`
+	MinItems             *int                   `yaml:"minItems"`
+	AllOf                []*jsonSchema          `yaml:"allOf"`
+	OneOf                []*jsonSchema          `yaml:"oneOf"`
+	Discriminator        *struct {
+		PropertyName string            `yaml:"propertyName"`
+		Mapping      map[string]string `yaml:"mapping"`
+	} `yaml:"discriminator"`
+
+	pattern *regexp.Regexp
+}
+
+// validationIssue is one problem found in a request, reported in the
+// details.errors list of a VALIDATION_ERROR
+type validationIssue struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// mustLoadOpenAPI parses the embedded document; it panics on errors since
+// the document is part of the build
+func mustLoadOpenAPI(data []byte) *openAPISpec {
+	spec, err := loadOpenAPI(data)
+	if err != nil {
+		panic(fmt.Sprintf("invalid OpenAPI document: %v", err))
+	}
+	return spec
+}
+
+func loadOpenAPI(data []byte) (*openAPISpec, error) {
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	rendered, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc openAPIDocument
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	spec := &openAPISpec{
+		json:       rendered,
+		operations: map[string]*openAPIOperation{},
+		schemas:    doc.Components.Schemas,
+	}
+
+	var check func(s *jsonSchema) error
+	check = func(s *jsonSchema) error {
+		if s == nil {
+			return nil
+		}
+		if s.Ref != "" {
+			if _, ok := spec.schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]; !ok {
+				return fmt.Errorf("unknown schema %s", s.Ref)
+			}
+		}
+		if s.Pattern != "" {
+			pattern, err := regexp.Compile(s.Pattern)
+			if err != nil {
+				return err
+			}
+			s.pattern = pattern
+		}
+		if s.Discriminator != nil {
+			for _, ref := range s.Discriminator.Mapping {
+				if err := check(&jsonSchema{Ref: ref}); err != nil {
+					return err
+				}
+			}
+		}
+		children := []*jsonSchema{s.Items}
+		children = append(children, s.AllOf...)
+		children = append(children, s.OneOf...)
+		for _, child := range s.Properties {
+			children = append(children, child)
+		}
+		for _, child := range children {
+			if err := check(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for name, s := range spec.schemas {
+		if err := check(s); err != nil {
+			return nil, fmt.Errorf("schema %s: %w", name, err)
+		}
+	}
+
+	for path, item := range doc.Paths {
+		methods := map[string]*openAPIOperation{
+			"GET": item.Get, "POST": item.Post, "PUT": item.Put, "PATCH": item.Patch, "DELETE": item.Delete,
+		}
+		for method, op := range methods {
+			if op == nil {
+				continue
+			}
+			key := method + " " + path
+			for i, param := range op.Parameters {
+				if param.Ref != "" {
+					resolved, ok := doc.Components.Parameters[strings.TrimPrefix(param.Ref, "#/components/parameters/")]
+					if !ok {
+						return nil, fmt.Errorf("%s: unknown parameter %s", key, param.Ref)
+					}
+					op.Parameters[i], param = resolved, resolved
+				}
+				if err := check(param.Schema); err != nil {
+					return nil, fmt.Errorf("%s: parameter %s: %w", key, param.Name, err)
+				}
+			}
+			if op.RequestBody != nil {
+				if _, ok := op.RequestBody.Content["application/json"]; !ok {
+					return nil, fmt.Errorf("%s: only application/json request bodies are supported", key)
+				}
+				if err := check(op.RequestBody.Content["application/json"].Schema); err != nil {
+					return nil, fmt.Errorf("%s: request body: %w", key, err)
+				}
+			}
+			spec.operations[key] = op
+		}
+	}
+	return spec, nil
+}
+
+// useSpec validates requests to the router's routes against the spec. It
+// panics unless every route is documented and every operation routed.
+func (ar *apiRouter) useSpec(spec *openAPISpec) {
+	for _, route := range ar.routes {
+		path := ""
+		for _, seg := range route.segments {
+			if seg.param != "" {
+				path += "/{" + seg.param + "}"
+			} else {
+				path += "/" + seg.literal
+			}
+		}
+		op, ok := spec.operations[route.method+" "+path]
+		if !ok {
+			panic(fmt.Sprintf("route %s %s is missing from the OpenAPI document", route.method, route.template))
+		}
+		route.operation = op
+	}
+	if len(spec.operations) != len(ar.routes) {
+		panic(fmt.Sprintf("OpenAPI document has %d operations for %d routes", len(spec.operations), len(ar.routes)))
+	}
+	ar.spec = spec
+}
+
+// validateRequest checks the parameters and body of a request against its
+// operation, replying with a VALIDATION_ERROR envelope listing every problem
+// found. The body is left in place for the handler.
+func (g *Gateway) validateRequest(spec *openAPISpec, op *openAPIOperation, w http.ResponseWriter, r *http.Request) bool {
+	var issues []validationIssue
+
+	query := r.URL.Query()
+	for _, param := range op.Parameters {
+		var values []string
+		switch param.In {
+		case "query":
+			values = query[param.Name]
+		case "header":
+			values = r.Header.Values(param.Name)
+		case "path":
+			if v := pathParam(r, param.Name); v != "" {
+				values = []string{v}
+			}
+		}
+		if len(values) == 0 {
+			if param.Required {
+				issues = append(issues, validationIssue{param.Name, param.Name + " is required"})
+			}
+			continue
+		}
+		spec.validateValue(param.Schema, parameterValue(param.Schema, spec, values[0]), param.Name, &issues)
+	}
+
+	if op.RequestBody != nil {
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if g.sendBodyTooLarge(w, err) {
+			return false
+		}
+		switch {
+		case err != nil:
+			issues = append(issues, validationIssue{"", "Request body could not be read"})
+		case len(bytes.TrimSpace(body)) == 0:
+			if op.RequestBody.Required {
+				issues = append(issues, validationIssue{"", "Request body is required"})
+			}
+		default:
+			value, err := decodeJSONValue(body)
+			if err != nil {
+				issues = append(issues, validationIssue{"", "Request body is not valid JSON"})
+				break
+			}
+			spec.validateValue(op.RequestBody.Content["application/json"].Schema, value, "", &issues)
+		}
+	}
+
+	if len(issues) == 0 {
+		return true
+	}
+	slog.InfoContext(r.Context(), "Invalid request", "method", r.Method, "path", r.URL.Path, "operation", op.OperationID, "error", issues[0].Message)
+	g.sendResponse(w, http.StatusBadRequest, nil, validationErrors(issues))
+	return false
+}
+
+// decodeJSONValue decodes a single JSON value, keeping numbers as json.Number
+// so integers can be told apart from fractions
+func decodeJSONValue(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return value, nil
+}
+
+// parameterValue converts a query, header or path parameter to the JSON
+// value its schema expects; values that don't parse are left as strings so
+// they fail the type check
+func parameterValue(s *jsonSchema, spec *openAPISpec, value string) interface{} {
+	switch spec.resolve(s).Type {
+	case "integer", "number":
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			return json.Number(value)
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return value
+}
+
+func (spec *openAPISpec) resolve(s *jsonSchema) *jsonSchema {
+	for s != nil && s.Ref != "" {
+		s = spec.schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+// validateValue checks a decoded JSON value against a schema, appending a
+// problem for every violation. field is the path of the value, such as
+// lines[0].price.amount, or empty for the whole body.
+func (spec *openAPISpec) validateValue(s *jsonSchema, value interface{}, field string, issues *[]validationIssue) {
+	s = spec.resolve(s)
+	if s == nil {
+		return
+	}
+	name := field
+	if name == "" {
+		name = "Request body"
+	}
+	fail := func(field, message string) {
+		*issues = append(*issues, validationIssue{field, message})
+	}
+
+	if value == nil && (s.Nullable || (s.Type == "" && len(s.AllOf) == 0 && len(s.OneOf) == 0)) {
+		return
+	}
+	if len(s.OneOf) > 0 {
+		spec.validateOneOf(s, value, field, issues)
+		return
+	}
+	for _, sub := range s.AllOf {
+		spec.validateValue(sub, value, field, issues)
+	}
+	if s.Type != "" && !jsonTypeMatches(s.Type, value) {
+		fail(field, name+" must be "+schemaTypeName(s.Type))
+		return
+	}
+	if len(s.Enum) > 0 {
+		allowed := make([]string, 0, len(s.Enum))
+		found := false
+		for _, e := range s.Enum {
+			found = found || fmt.Sprint(e) == fmt.Sprint(value)
+			allowed = append(allowed, fmt.Sprint(e))
+		}
+		if !found {
+			fail(field, name+" must be one of "+strings.Join(allowed, ", "))
+			return
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		length := len([]rune(v))
+		switch {
+		case s.MinLength != nil && length < *s.MinLength && *s.MinLength == 1:
+			fail(field, name+" must not be empty")
+		case s.MinLength != nil && length < *s.MinLength:
+			fail(field, fmt.Sprintf("%s must be at least %d characters", name, *s.MinLength))
+		case s.MaxLength != nil && length > *s.MaxLength:
+			fail(field, fmt.Sprintf("%s must be at most %d characters", name, *s.MaxLength))
+		case s.pattern != nil && !s.pattern.MatchString(v):
+			fail(field, name+" must match "+s.Pattern)
+		}
+	case json.Number:
+		n, _ := v.Float64()
+		switch {
+		case s.Minimum != nil && n < *s.Minimum:
+			fail(field, name+" must be at least "+strconv.FormatFloat(*s.Minimum, 'f', -1, 64))
+		case s.Maximum != nil && n > *s.Maximum:
+			fail(field, name+" must be at most "+strconv.FormatFloat(*s.Maximum, 'f', -1, 64))
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail(field, fmt.Sprintf("%s must have at least %d items", name, *s.MinItems))
+		}
+		for i, item := range v {
+			spec.validateValue(s.Items, item, fmt.Sprintf("%s[%d]", field, i), issues)
+		}
+	case map[string]interface{}:
+		for _, key := range s.Required {
+			if _, ok := v[key]; !ok {
+				fail(joinField(field, key), joinField(field, key)+" is required")
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			child, ok := s.Properties[key]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					fail(joinField(field, key), "Unknown field "+strconv.Quote(joinField(field, key)))
+				}
+				continue
+			}
+			spec.validateValue(child, v[key], joinField(field, key), issues)
+		}
+	}
+}
+
+// validateOneOf picks the schema named by the discriminator property, or
+// otherwise requires exactly one of the schemas to match
+func (spec *openAPISpec) validateOneOf(s *jsonSchema, value interface{}, field string, issues *[]validationIssue) {
+	if d := s.Discriminator; d != nil {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			name := field
+			if name == "" {
+				name = "Request body"
+			}
+			*issues = append(*issues, validationIssue{field, name + " must be an object"})
+			return
+		}
+		prop := joinField(field, d.PropertyName)
+		kind, present := obj[d.PropertyName]
+		if !present {
+			*issues = append(*issues, validationIssue{prop, prop + " is required"})
+			return
+		}
+		name, _ := kind.(string)
+		ref, ok := d.Mapping[name]
+		if !ok {
+			kinds := make([]string, 0, len(d.Mapping))
+			for k := range d.Mapping {
+				kinds = append(kinds, k)
+			}
+			sort.Strings(kinds)
+			*issues = append(*issues, validationIssue{prop, prop + " must be one of " + strings.Join(kinds, ", ")})
+			return
+		}
+		spec.validateValue(&jsonSchema{Ref: ref}, value, field, issues)
+		return
+	}
+
+	matched := 0
+	for _, sub := range s.OneOf {
+		var subIssues []validationIssue
+		spec.validateValue(sub, value, field, &subIssues)
+		if len(subIssues) == 0 {
+			matched++
+		}
+	}
+	if matched != 1 {
+		name := field
+		if name == "" {
+			name = "Request body"
+		}
+		*issues = append(*issues, validationIssue{field, name + " must match exactly one of the allowed shapes"})
+	}
+}
+
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+func jsonTypeMatches(typ string, value interface{}) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return typ == "object"
+	case []interface{}:
+		return typ == "array"
+	case string:
+		return typ == "string"
+	case bool:
+		return typ == "boolean"
+	case json.Number:
+		if typ == "integer" {
+			_, err := strconv.ParseInt(string(v), 10, 64)
+			return err == nil
+		}
+		return typ == "number"
+	}
+	return false
+}
+
+func schemaTypeName(typ string) string {
+	switch typ {
+	case "object", "array", "integer":
+		return "an " + typ
+	default:
+		return "a " + typ
+	}
+}
+
+// Handle OpenAPI document: serves the frontend API description so clients
+// can be generated from it
+func (g *Gateway) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		g.sendResponse(w, http.StatusMethodNotAllowed, nil, &ErrorInfo{
+			Code:    "METHOD_NOT_ALLOWED",
+			Message: "Method " + r.Method + " is not allowed",
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(frontendSpec.json)
+}
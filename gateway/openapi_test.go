@@ -0,0 +1,401 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testOpenAPIYAML = `
+openapi: 3.0.3
+paths:
+  /carts:
+    post:
+      operationId: createCart
+      requestBody:
+        required: true
+        content:
+          application/json:
+            schema:
+              $ref: '#/components/schemas/Cart'
+  /carts/{cartId}:
+    get:
+      operationId: getCart
+      parameters:
+        - $ref: '#/components/parameters/CartId'
+components:
+  parameters:
+    CartId:
+      name: cartId
+      in: path
+      required: true
+      schema:
+        type: string
+  schemas:
+    Money:
+      type: object
+      required: [amount, currencyCode]
+      additionalProperties: false
+      properties:
+        amount:
+          type: string
+          pattern: '^\d+\.\d{2}$'
+        currencyCode:
+          type: string
+          enum: [USD, EUR]
+    Line:
+      type: object
+      required: [quantity]
+      properties:
+        quantity:
+          type: integer
+          minimum: 1
+          maximum: 10
+        weight:
+          type: number
+        price:
+          $ref: '#/components/schemas/Money'
+        note:
+          type: string
+          nullable: true
+          maxLength: 5
+        giftWrap:
+          type: boolean
+    Cart:
+      type: object
+      required: [lines]
+      additionalProperties: false
+      properties:
+        lines:
+          type: array
+          minItems: 1
+          items:
+            $ref: '#/components/schemas/Line'
+        email:
+          type: string
+          minLength: 1
+        code:
+          type: string
+          minLength: 3
+        metadata: {}
+    Card:
+      type: object
+      required: [kind, last4]
+      properties:
+        kind:
+          type: string
+        last4:
+          type: string
+          pattern: '^\d{4}$'
+    Wire:
+      type: object
+      required: [kind, iban]
+      properties:
+        kind:
+          type: string
+        iban:
+          type: string
+    Payment:
+      oneOf:
+        - $ref: '#/components/schemas/Card'
+        - $ref: '#/components/schemas/Wire'
+      discriminator:
+        propertyName: kind
+        mapping:
+          card: '#/components/schemas/Card'
+          wire: '#/components/schemas/Wire'
+    Reference:
+      oneOf:
+        - type: string
+        - type: integer
+    Amount:
+      oneOf:
+        - type: number
+        - type: integer
+    Discounted:
+      allOf:
+        - $ref: '#/components/schemas/Money'
+        - type: object
+          required: [amount]
+`
+
+func newTestSpec(t *testing.T) *openAPISpec {
+	t.Helper()
+	spec, err := loadOpenAPI([]byte(testOpenAPIYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+// validate checks a JSON document against a named schema of spec
+func validate(t *testing.T, spec *openAPISpec, schema, body string) []validationIssue {
+	t.Helper()
+	value, err := decodeJSONValue([]byte(body))
+	if err != nil {
+		t.Fatalf("%s: %v", body, err)
+	}
+	var issues []validationIssue
+	spec.validateValue(&jsonSchema{Ref: "#/components/schemas/" + schema}, value, "", &issues)
+	return issues
+}
+
+func TestValidateValue(t *testing.T) {
+	spec := newTestSpec(t)
+
+	tests := []struct {
+		name   string
+		schema string
+		body   string
+		want   []validationIssue // nil when valid
+	}{
+		{"valid cart", "Cart", `{"lines":[{"quantity":2,"weight":1.5,"price":{"amount":"10.00","currencyCode":"USD"},"note":null}],"metadata":{"any":[1]}}`, nil},
+		{"body of the wrong type", "Cart", `[]`, []validationIssue{{"", "Request body must be an object"}}},
+		{"required field", "Cart", `{}`, []validationIssue{{"lines", "lines is required"}}},
+		{"nested required field", "Cart", `{"lines":[{"price":{"amount":"1.00"}}]}`, []validationIssue{
+			{"lines[0].quantity", "lines[0].quantity is required"},
+			{"lines[0].price.currencyCode", "lines[0].price.currencyCode is required"},
+		}},
+		{"unknown fields are listed in order", "Cart", `{"lines":[{"quantity":1}],"zeta":1,"alpha":2}`, []validationIssue{
+			{"alpha", `Unknown field "alpha"`},
+			{"zeta", `Unknown field "zeta"`},
+		}},
+		{"unknown nested field", "Cart", `{"lines":[{"quantity":1,"price":{"amount":"1.00","currencyCode":"USD","cents":100}}]}`, []validationIssue{
+			{"lines[0].price.cents", `Unknown field "lines[0].price.cents"`},
+		}},
+		{"additional properties allowed by default", "Line", `{"quantity":1,"sku":"R-1"}`, nil},
+		{"integer rejects fractions", "Line", `{"quantity":1.5}`, []validationIssue{{"quantity", "quantity must be an integer"}}},
+		{"integer rejects exponents", "Line", `{"quantity":1e2}`, []validationIssue{{"quantity", "quantity must be an integer"}}},
+		{"integer rejects strings", "Line", `{"quantity":"1"}`, []validationIssue{{"quantity", "quantity must be an integer"}}},
+		{"number accepts integers", "Line", `{"quantity":1,"weight":2}`, nil},
+		{"number rejects strings", "Line", `{"quantity":1,"weight":"2.5"}`, []validationIssue{{"weight", "weight must be a number"}}},
+		{"boolean", "Line", `{"quantity":1,"giftWrap":"yes"}`, []validationIssue{{"giftWrap", "giftWrap must be a boolean"}}},
+		{"minimum", "Line", `{"quantity":0}`, []validationIssue{{"quantity", "quantity must be at least 1"}}},
+		{"maximum", "Line", `{"quantity":11}`, []validationIssue{{"quantity", "quantity must be at most 10"}}},
+		{"null where not nullable", "Line", `{"quantity":null}`, []validationIssue{{"quantity", "quantity must be an integer"}}},
+		{"maxLength counts characters", "Line", `{"quantity":1,"note":"émeraude"}`, []validationIssue{{"note", "note must be at most 5 characters"}}},
+		{"maxLength with multibyte characters", "Line", `{"quantity":1,"note":"ééééé"}`, nil},
+		{"empty string", "Cart", `{"lines":[{"quantity":1}],"email":""}`, []validationIssue{{"email", "email must not be empty"}}},
+		{"minLength", "Cart", `{"lines":[{"quantity":1}],"code":"ab"}`, []validationIssue{{"code", "code must be at least 3 characters"}}},
+		{"minItems", "Cart", `{"lines":[]}`, []validationIssue{{"lines", "lines must have at least 1 items"}}},
+		{"pattern", "Money", `{"amount":"10.5","currencyCode":"USD"}`, []validationIssue{{"amount", `amount must match ^\d+\.\d{2}$`}}},
+		{"anchored pattern", "Money", `{"amount":"x10.50","currencyCode":"USD"}`, []validationIssue{{"amount", `amount must match ^\d+\.\d{2}$`}}},
+		{"enum", "Money", `{"amount":"10.50","currencyCode":"GBP"}`, []validationIssue{{"currencyCode", "currencyCode must be one of USD, EUR"}}},
+		{"every issue is reported", "Cart", `{"lines":[{"quantity":0},{"quantity":"x"}],"email":""}`, []validationIssue{
+			{"email", "email must not be empty"},
+			{"lines[0].quantity", "lines[0].quantity must be at least 1"},
+			{"lines[1].quantity", "lines[1].quantity must be an integer"},
+		}},
+		{"allOf", "Discounted", `{"currencyCode":"USD"}`, []validationIssue{
+			{"amount", "amount is required"},
+			{"amount", "amount is required"},
+		}},
+	}
+	for _, tt := range tests {
+		got := validate(t, spec, tt.schema, tt.body)
+		if !equalIssues(got, tt.want) {
+			t.Errorf("%s: issues = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateOneOf(t *testing.T) {
+	spec := newTestSpec(t)
+
+	tests := []struct {
+		name   string
+		schema string
+		body   string
+		want   []validationIssue
+	}{
+		{"discriminator picks the schema", "Payment", `{"kind":"card","last4":"4242"}`, nil},
+		{"other mapped schema", "Payment", `{"kind":"wire","iban":"FR76"}`, nil},
+		{"chosen schema's rules apply", "Payment", `{"kind":"card","last4":"42"}`, []validationIssue{{"last4", `last4 must match ^\d{4}$`}}},
+		{"fields of the other schema don't count", "Payment", `{"kind":"wire","last4":"4242"}`, []validationIssue{{"iban", "iban is required"}}},
+		{"missing discriminator", "Payment", `{"last4":"4242"}`, []validationIssue{{"kind", "kind is required"}}},
+		{"unknown discriminator value", "Payment", `{"kind":"cash"}`, []validationIssue{{"kind", "kind must be one of card, wire"}}},
+		{"discriminator of the wrong type", "Payment", `{"kind":1}`, []validationIssue{{"kind", "kind must be one of card, wire"}}},
+		{"discriminated value must be an object", "Payment", `"card"`, []validationIssue{{"", "Request body must be an object"}}},
+		{"exactly one match", "Reference", `"R-1"`, nil},
+		{"the other match", "Reference", `12`, nil},
+		{"no match", "Reference", `1.5`, []validationIssue{{"", "Request body must match exactly one of the allowed shapes"}}},
+		{"several matches", "Amount", `12`, []validationIssue{{"", "Request body must match exactly one of the allowed shapes"}}},
+		{"one match of overlapping shapes", "Amount", `1.5`, nil},
+	}
+	for _, tt := range tests {
+		got := validate(t, spec, tt.schema, tt.body)
+		if !equalIssues(got, tt.want) {
+			t.Errorf("%s: issues = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Nested values report their path
+	var issues []validationIssue
+	value, _ := decodeJSONValue([]byte(`{"kind":"cash"}`))
+	spec.validateValue(&jsonSchema{Ref: "#/components/schemas/Payment"}, value, "payments[2]", &issues)
+	if want := []validationIssue{{"payments[2].kind", "payments[2].kind must be one of card, wire"}}; !equalIssues(issues, want) {
+		t.Errorf("nested issues = %v", issues)
+	}
+}
+
+func equalIssues(a, b []validationIssue) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParameterValue(t *testing.T) {
+	spec := newTestSpec(t)
+	tests := []struct {
+		typ   string
+		value string
+		valid bool
+	}{
+		{"integer", "42", true},
+		{"integer", "4.2", false},
+		{"integer", "x", false},
+		{"number", "4.2", true},
+		{"boolean", "true", true},
+		{"boolean", "yes", false},
+		{"string", "42", true},
+	}
+	for _, tt := range tests {
+		s := &jsonSchema{Type: tt.typ}
+		var issues []validationIssue
+		spec.validateValue(s, parameterValue(s, spec, tt.value), "limit", &issues)
+		if valid := len(issues) == 0; valid != tt.valid {
+			t.Errorf("%s parameter %q: issues %v", tt.typ, tt.value, issues)
+		}
+	}
+}
+
+func TestLoadOpenAPIErrors(t *testing.T) {
+	tests := map[string]string{
+		"unknown schema": `
+components:
+  schemas:
+    Cart:
+      properties:
+        price:
+          $ref: '#/components/schemas/Price'`,
+		"invalid pattern": `
+components:
+  schemas:
+    Code:
+      type: string
+      pattern: '('`,
+		"unknown discriminator mapping": `
+components:
+  schemas:
+    Payment:
+      oneOf: [{type: object}]
+      discriminator:
+        propertyName: kind
+        mapping:
+          card: '#/components/schemas/Card'`,
+		"unknown parameter": `
+paths:
+  /carts/{cartId}:
+    get:
+      parameters:
+        - $ref: '#/components/parameters/CartId'`,
+		"non-JSON request body": `
+paths:
+  /carts:
+    post:
+      requestBody:
+        content:
+          application/x-www-form-urlencoded:
+            schema: {type: object}`,
+	}
+	for name, doc := range tests {
+		if _, err := loadOpenAPI([]byte(doc)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func noopHandler(g *Gateway, w http.ResponseWriter, r *http.Request) {}
+
+func TestUseSpec(t *testing.T) {
+	spec := newTestSpec(t)
+
+	ar := newAPIRouter("/api")
+	ar.handle("POST", "/carts", noopHandler)
+	ar.handle("GET", "/carts/{cartId}", noopHandler)
+	ar.useSpec(spec)
+	if ar.spec != spec || ar.routes[1].operation.OperationID != "getCart" {
+		t.Errorf("operations not attached: %+v", ar.routes[1].operation)
+	}
+
+	// Typed parameters are documented by name only
+	ar = newAPIRouter("/api")
+	ar.handle("POST", "/carts", noopHandler)
+	ar.handle("GET", "/carts/{cartId:uuid}", noopHandler)
+	ar.useSpec(spec)
+
+	tests := []struct {
+		name   string
+		routes [][2]string
+		panic  string
+	}{
+		{"undocumented route", [][2]string{{"POST", "/carts"}, {"GET", "/carts/{cartId}"}, {"DELETE", "/carts/{cartId}"}}, "route DELETE /carts/{cartId} is missing from the OpenAPI document"},
+		{"undocumented method", [][2]string{{"PUT", "/carts"}, {"GET", "/carts/{cartId}"}}, "route PUT /carts is missing from the OpenAPI document"},
+		{"parameter named differently", [][2]string{{"POST", "/carts"}, {"GET", "/carts/{id}"}}, "route GET /carts/{id} is missing from the OpenAPI document"},
+		{"unrouted operation", [][2]string{{"POST", "/carts"}}, "OpenAPI document has 2 operations for 1 routes"},
+	}
+	for _, tt := range tests {
+		ar := newAPIRouter("/api")
+		for _, route := range tt.routes {
+			ar.handle(route[0], route[1], noopHandler)
+		}
+		func() {
+			defer func() {
+				if got := recover(); got != tt.panic {
+					t.Errorf("%s: panic = %v, want %q", tt.name, got, tt.panic)
+				}
+			}()
+			ar.useSpec(spec)
+		}()
+	}
+}
+
+func TestFrontendValidationError(t *testing.T) {
+	g := newTestGateway(t, `
+upstreams:
+  backend:
+    url: http://localhost:3001
+routes:
+  - name: frontend
+    prefix: /api/gw/v1/
+    handler: frontend
+    upstream: backend
+    auth: none
+`)
+
+	r := httptest.NewRequest("POST", "/api/gw/v1/deposit-sessions", strings.NewReader(`{"cartId":"","extra":true}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := serveGateway(g, r)
+	if w.Code != http.StatusBadRequest || envelopeErrorCode(t, w) != "VALIDATION_ERROR" {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	body := w.Body.String()
+	for _, issue := range []string{`{"field":"cartId","message":"cartId must not be empty"}`, `{"field":"extra","message":"Unknown field \"extra\""}`} {
+		if !strings.Contains(body, issue) {
+			t.Errorf("body = %s, want %s", body, issue)
+		}
+	}
+
+	r = httptest.NewRequest("POST", "/api/gw/v1/deposit-sessions", strings.NewReader(`{"cartId":`))
+	r.Header.Set("Content-Type", "application/json")
+	if w := serveGateway(g, r); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Request body is not valid JSON") {
+		t.Errorf("invalid JSON: status = %d: %s", w.Code, w.Body)
+	}
+}
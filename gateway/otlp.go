@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// OTLP transports the exporter can send over
+const (
+	otlpProtocolProtobuf = "http/protobuf"
+	otlpProtocolGRPC     = "grpc"
+)
+
+// Batching of exported spans
+const (
+	defaultTracingServiceName = "gateway"
+	otlpQueueSize             = 2048
+	otlpBatchSize             = 512
+	otlpFlushInterval         = 5 * time.Second
+	otlpExportTimeout         = 10 * time.Second
+)
+
+func init() {
+	// Export errors are reported by the SDK through its global handler
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Warn("Tracing export failed", "error", err)
+	}))
+}
+
+// otlpTracesURL returns the traces URL for an OTLP/HTTP endpoint: like
+// OTEL_EXPORTER_OTLP_ENDPOINT, a base URL gets /v1/traces appended
+func otlpTracesURL(endpoint string) string {
+	endpoint = strings.TrimRight(endpoint, "/")
+	if strings.HasSuffix(endpoint, "/v1/traces") {
+		return endpoint
+	}
+	return endpoint + "/v1/traces"
+}
+
+// newExporter returns the OTLP exporter for cfg. Neither exporter connects
+// before its first export. Failed batches are not retried: spans are
+// diagnostics and must not pile up in memory.
+func newExporter(cfg TracingConfig) (sdktrace.SpanExporter, error) {
+	ctx := context.Background()
+	if cfg.Protocol == otlpProtocolGRPC {
+		// An http:// endpoint is dialed without TLS
+		return otlptracegrpc.New(ctx,
+			otlptracegrpc.WithEndpointURL(cfg.Endpoint),
+			otlptracegrpc.WithHeaders(cfg.Headers),
+			otlptracegrpc.WithTimeout(otlpExportTimeout),
+			otlptracegrpc.WithRetry(otlptracegrpc.RetryConfig{Enabled: false}),
+		)
+	}
+	return otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpointURL(otlpTracesURL(cfg.Endpoint)),
+		otlptracehttp.WithHeaders(cfg.Headers),
+		otlptracehttp.WithTimeout(otlpExportTimeout),
+		otlptracehttp.WithRetry(otlptracehttp.RetryConfig{Enabled: false}),
+	)
+}
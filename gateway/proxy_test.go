@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// limitedProxyConfig routes everything to backendURL with a 16-byte body limit
+func limitedProxyConfig(backendURL string) string {
+	return proxyConfig(backendURL) + "    max_body_size: 16\n"
+}
+
+func TestProxyBodyTooLarge(t *testing.T) {
+	var calls atomic.Int32
+	var received atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		received.Store(string(body))
+	}))
+	defer backend.Close()
+	g := newTestGateway(t, limitedProxyConfig(backend.URL))
+
+	tests := []struct {
+		name    string
+		body    string
+		chunked bool
+		status  int
+	}{
+		{"declared length over the limit", strings.Repeat("x", 17), false, http.StatusRequestEntityTooLarge},
+		{"streamed body over the limit", strings.Repeat("x", 64<<10), true, http.StatusRequestEntityTooLarge},
+		{"streamed body at the limit", strings.Repeat("x", 16), true, http.StatusOK},
+		{"declared length at the limit", strings.Repeat("x", 16), false, http.StatusOK},
+	}
+	for _, tt := range tests {
+		calls.Store(0)
+		r := httptest.NewRequest("POST", "/upload", strings.NewReader(tt.body))
+		if tt.chunked {
+			// Without a length the body is only known to be too large once
+			// the proxy has read past the limit
+			r.ContentLength = -1
+			r.Body = io.NopCloser(strings.NewReader(tt.body))
+		}
+		w := serveGateway(g, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d: %s", tt.name, w.Code, w.Body)
+			continue
+		}
+		if tt.status == http.StatusOK {
+			if got, _ := received.Load().(string); got != tt.body {
+				t.Errorf("%s: backend received %d bytes", tt.name, len(got))
+			}
+			continue
+		}
+
+		var envelope struct {
+			Error struct {
+				Code    string                 `json:"code"`
+				Details map[string]interface{} `json:"details"`
+			} `json:"error"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &envelope)
+		if envelope.Error.Code != "PAYLOAD_TOO_LARGE" || envelope.Error.Details["limit"] != float64(16) {
+			t.Errorf("%s: error = %+v", tt.name, envelope.Error)
+		}
+		if !tt.chunked && calls.Load() != 0 {
+			t.Errorf("%s: backend called", tt.name)
+		}
+	}
+}
+
+func TestProxyStreamsBodyTooLargeOverNetwork(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+	g := newTestGateway(t, limitedProxyConfig(backend.URL))
+	gateway := httptest.NewServer(g.handler())
+	defer gateway.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < 8; i++ {
+			if _, err := pw.Write([]byte("0123456789")); err != nil {
+				return
+			}
+		}
+		pw.Close()
+	}()
+	resp, err := http.Post(gateway.URL+"/upload", "application/octet-stream", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d", resp.StatusCode)
+	}
+}
+
+func TestProxyStreamsResponses(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "data: second\n\n")
+	}))
+	defer backend.Close()
+	defer close(release)
+	g := newTestGateway(t, proxyConfig(backend.URL))
+	gateway := httptest.NewServer(g.handler())
+	defer gateway.Close()
+
+	resp, err := http.Get(gateway.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// The first event arrives while the backend is still writing
+	lines := make(chan string)
+	go func() {
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		if line != "data: first\n" {
+			t.Errorf("first line = %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("response buffered until the backend finished")
+	}
+}
+
+func TestProxyStreamsRequestBodies(t *testing.T) {
+	firstChunk := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 5)
+		io.ReadFull(r.Body, buf)
+		firstChunk <- string(buf)
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+	g := newTestGateway(t, proxyConfig(backend.URL))
+	gateway := httptest.NewServer(g.handler())
+	defer gateway.Close()
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.Post(gateway.URL+"/upload", "application/octet-stream", pr)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+
+	// The backend sees the start of the body before the client has sent the rest
+	pw.Write([]byte("hello"))
+	select {
+	case got := <-firstChunk:
+		if got != "hello" {
+			t.Errorf("first chunk = %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request body buffered until the client finished")
+	}
+	pw.Write([]byte(" world"))
+	pw.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
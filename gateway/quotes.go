@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for price quotes
+const (
+	defaultQuoteTTL      = 15 * time.Minute
+	defaultQuoteCurrency = "USD"
+	maxCatalogItemSize   = 1 << 20
+)
+
+// Cart item attribute naming the catalog collection of an external item.
+// The backend records the item under it, labgrown when it is missing.
+const (
+	sourceTypeAttribute      = "_source_type"
+	defaultCatalogSourceType = "labgrown"
+)
+
+// Catalog collections and document fields holding an item's price, used
+// unless configured otherwise
+var (
+	defaultCatalogCollections = []string{"labgrown", "natural"}
+	defaultCatalogPriceFields = []string{"total_price", "totalPrice", "Total Price"}
+)
+
+// Quote failures
+var (
+	errMissingQuote  = errors.New("quote is required for external items")
+	errInvalidQuote  = errors.New("invalid quote")
+	errExpiredQuote  = errors.New("quote expired, request a new one")
+	errQuoteMismatch = errors.New("quote was issued for another item")
+)
+
+// priceQuote is the price the gateway vouches for an external item of a
+// catalog collection until it expires
+type priceQuote struct {
+	ExternalID   string `json:"externalId"`
+	Collection   string `json:"collection"`
+	Amount       string `json:"amount"`
+	CurrencyCode string `json:"currencyCode"`
+	ExpiresAt    int64  `json:"exp"`
+}
+
+// quoteSigner issues price quotes from the catalog and verifies them when
+// external items are added to a cart. A quote is
+// <key id>.<base64url JSON quote>.<HMAC>, so the price can't be changed by
+// the client.
+type quoteSigner struct {
+	keys    []signingKey
+	ttl     time.Duration
+	catalog CatalogConfig
+}
+
+// newQuoteSigner returns nil when quotes are disabled
+func newQuoteSigner(cfg *QuotesConfig) *quoteSigner {
+	if !cfg.enabled() {
+		return nil
+	}
+	q := &quoteSigner{keys: newKeyring(cfg.Secrets), ttl: time.Duration(cfg.TTL), catalog: cfg.Catalog}
+	if q.ttl <= 0 {
+		q.ttl = defaultQuoteTTL
+	}
+	if len(q.catalog.Collections) == 0 {
+		q.catalog.Collections = defaultCatalogCollections
+	}
+	if len(q.catalog.PriceFields) == 0 {
+		q.catalog.PriceFields = defaultCatalogPriceFields
+	}
+	if q.catalog.Currency == "" {
+		q.catalog.Currency = defaultQuoteCurrency
+	}
+	return q
+}
+
+func (q *quoteSigner) sign(quote priceQuote) string {
+	payload, _ := json.Marshal(quote)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	key := q.keys[0]
+	return key.id + "." + encoded + "." + key.mac("quote:"+encoded)
+}
+
+// verify checks a quote's signature and expiry and returns its contents
+func (q *quoteSigner) verify(token string, now time.Time) (*priceQuote, error) {
+	if token == "" {
+		return nil, errMissingQuote
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidQuote
+	}
+	key, ok := lookupKey(q.keys, parts[0])
+	if !ok || !key.verify("quote:"+parts[1], parts[2]) {
+		return nil, errInvalidQuote
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidQuote
+	}
+	var quote priceQuote
+	if err := json.Unmarshal(payload, &quote); err != nil {
+		return nil, errInvalidQuote
+	}
+	if now.Unix() >= quote.ExpiresAt {
+		return nil, errExpiredQuote
+	}
+	return &quote, nil
+}
+
+// applyQuote replaces the client's price of an external cart item with the
+// quoted one, after checking the quote is valid for the item. The same ID
+// may exist in several collections, so the item's _source_type must be the
+// quoted collection; it is set to it when missing.
+func (q *quoteSigner) applyQuote(req *AddCartItemRequest, now time.Time) error {
+	quote, err := q.verify(req.Quote, now)
+	if err != nil {
+		return err
+	}
+	if req.ExternalID != quote.ExternalID {
+		return errQuoteMismatch
+	}
+	sourceType := ""
+	for _, attr := range req.Attributes {
+		if attr.Key == sourceTypeAttribute {
+			sourceType = attr.Value
+		}
+	}
+	switch {
+	case sourceType == "" && quote.Collection != defaultCatalogSourceType:
+		req.Attributes = append(req.Attributes, CartAttribute{Key: sourceTypeAttribute, Value: quote.Collection})
+	case sourceType != "" && sourceType != quote.Collection:
+		return errQuoteMismatch
+	}
+	req.Price = &Money{Amount: quote.Amount, CurrencyCode: quote.CurrencyCode}
+	req.Quote = ""
+	return nil
+}
+
+// catalogPrice looks up the current price of an external item in the catalog.
+// found is false when the catalog doesn't have the item.
+func (g *Gateway) catalogPrice(r *http.Request, q *quoteSigner, collection, externalId string) (amount string, found bool, err error) {
+	pool := g.state.Load().upstreams[q.catalog.Upstream]
+	path := strings.NewReplacer(
+		"{collection}", url.PathEscape(collection),
+		"{externalId}", url.PathEscape(externalId),
+	).Replace(q.catalog.Path)
+
+	resp, err := g.roundTrip(r, pool, "GET", true, func(target *upstreamTarget) (*http.Request, error) {
+		req, err := http.NewRequest("GET", target.url+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if q.catalog.APIKey != "" {
+			req.Header.Set("X-API-Key", q.catalog.APIKey)
+		}
+		return req, nil
+	})
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", false, nil
+	case resp.StatusCode >= 400:
+		return "", false, fmt.Errorf("catalog returned %s for %s", resp.Status, externalId)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCatalogItemSize))
+	if err != nil {
+		return "", false, err
+	}
+	// The document may be wrapped as {"document": {...}}
+	var item struct {
+		Document map[string]interface{} `json:"document"`
+	}
+	if err := json.Unmarshal(data, &item); err != nil {
+		return "", false, fmt.Errorf("parsing catalog item %s: %w", externalId, err)
+	}
+	doc := item.Document
+	if doc == nil {
+		json.Unmarshal(data, &doc)
+	}
+
+	for _, field := range q.catalog.PriceFields {
+		var price float64
+		switch v := doc[field].(type) {
+		case float64:
+			price = v
+		case string:
+			price, _ = strconv.ParseFloat(strings.TrimSpace(v), 64)
+		}
+		if price > 0 {
+			return strconv.FormatFloat(price, 'f', 2, 64), true, nil
+		}
+	}
+	return "", false, fmt.Errorf("catalog item %s has no price", externalId)
+}
+
+// Handle create quote: signs the catalog price of an external item so it can
+// be added to a cart
+func (g *Gateway) handleCreateQuote(w http.ResponseWriter, r *http.Request) {
+	q := g.state.Load().quotes
+	if q == nil {
+		g.sendResponse(w, http.StatusNotFound, nil, &ErrorInfo{
+			Code:    "NOT_FOUND",
+			Message: "Price quotes are not enabled",
+		})
+		return
+	}
+
+	var body CreateQuoteRequest
+	if !g.decodeRequest(w, r, &body) {
+		return
+	}
+	if body.Collection == "" {
+		body.Collection = q.catalog.Collections[0]
+	}
+	known := false
+	for _, c := range q.catalog.Collections {
+		known = known || c == body.Collection
+	}
+	if !known {
+		g.sendResponse(w, http.StatusBadRequest, nil, validationError("collection", "collection must be one of "+strings.Join(q.catalog.Collections, ", ")))
+		return
+	}
+
+	amount, found, err := g.catalogPrice(r, q, body.Collection, body.ExternalID)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Catalog lookup failed", "error", err)
+		g.sendUpstreamError(w, err)
+		return
+	}
+	if !found {
+		g.sendResponse(w, http.StatusNotFound, nil, &ErrorInfo{
+			Code:    "NOT_FOUND",
+			Message: "Item " + body.ExternalID + " not found in the catalog",
+		})
+		return
+	}
+
+	quote := priceQuote{
+		ExternalID:   body.ExternalID,
+		Collection:   body.Collection,
+		Amount:       amount,
+		CurrencyCode: q.catalog.Currency,
+		ExpiresAt:    time.Now().Add(q.ttl).Unix(),
+	}
+	g.sendResponse(w, http.StatusOK, QuoteResponse{
+		Quote:      q.sign(quote),
+		ExternalID: quote.ExternalID,
+		Collection: quote.Collection,
+		Price:      Money{Amount: quote.Amount, CurrencyCode: quote.CurrencyCode},
+		ExpiresAt:  time.Unix(quote.ExpiresAt, 0).UTC().Format(time.RFC3339),
+	}, nil)
+}
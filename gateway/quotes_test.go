@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testQuoteSecret = "quote-secret-that-is-at-least-32-chars"
+
+func newTestQuoteSigner(secrets ...string) *quoteSigner {
+	return newQuoteSigner(&QuotesConfig{Secrets: secrets, Catalog: CatalogConfig{Upstream: "catalog", Path: "/search/{collection}/{externalId}"}})
+}
+
+func externalItem(externalID, quote string, attributes ...CartAttribute) *AddCartItemRequest {
+	return &AddCartItemRequest{
+		Source:     "external",
+		ExternalID: externalID,
+		Price:      &Money{Amount: "1.00", CurrencyCode: "USD"},
+		Attributes: attributes,
+		Quote:      quote,
+	}
+}
+
+func TestQuoteSignVerify(t *testing.T) {
+	q := newTestQuoteSigner(testQuoteSecret)
+	now := time.Now()
+	quote := priceQuote{ExternalID: "D-1", Collection: "natural", Amount: "4200.00", CurrencyCode: "USD", ExpiresAt: now.Add(time.Minute).Unix()}
+	token := q.sign(quote)
+
+	got, err := q.verify(token, now)
+	if err != nil || *got != quote {
+		t.Fatalf("verify = %+v, %v; want %+v", got, err, quote)
+	}
+
+	parts := strings.Split(token, ".")
+	cheaper := quote
+	cheaper.Amount = "1.00"
+	payload, _ := json.Marshal(cheaper)
+	forged := parts[0] + "." + encodeJWTSegment(t, json.RawMessage(payload)) + "." + parts[2]
+
+	tests := []struct {
+		name  string
+		token string
+		now   time.Time
+		want  error
+	}{
+		{"missing", "", now, errMissingQuote},
+		{"malformed", "quote", now, errInvalidQuote},
+		{"changed price", forged, now, errInvalidQuote},
+		{"unknown key", "unknown." + parts[1] + "." + parts[2], now, errInvalidQuote},
+		{"other secret", newTestQuoteSigner(testSessionSecret).sign(quote), now, errInvalidQuote},
+		{"expired", token, now.Add(time.Minute), errExpiredQuote},
+	}
+	for _, tt := range tests {
+		if _, err := q.verify(tt.token, tt.now); err != tt.want {
+			t.Errorf("%s: verify = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// Quotes of the previous secret stay valid after rotation
+	rotated := newTestQuoteSigner(testSessionSecret, testQuoteSecret)
+	if _, err := rotated.verify(token, now); err != nil {
+		t.Errorf("quote after rotation: %v", err)
+	}
+}
+
+func TestApplyQuote(t *testing.T) {
+	q := newTestQuoteSigner(testQuoteSecret)
+	now := time.Now()
+	sign := func(externalID, collection string) string {
+		return q.sign(priceQuote{ExternalID: externalID, Collection: collection, Amount: "4200.00", CurrencyCode: "USD", ExpiresAt: now.Add(time.Minute).Unix()})
+	}
+	natural := CartAttribute{Key: sourceTypeAttribute, Value: "natural"}
+	labgrown := CartAttribute{Key: sourceTypeAttribute, Value: "labgrown"}
+
+	req := externalItem("D-1", sign("D-1", "natural"), natural)
+	if err := q.applyQuote(req, now); err != nil {
+		t.Fatalf("applyQuote: %v", err)
+	}
+	if req.Price.Amount != "4200.00" || req.Quote != "" {
+		t.Errorf("item after applyQuote: price %v, quote %q", req.Price, req.Quote)
+	}
+
+	// Without a _source_type the item is recorded in the quoted collection
+	req = externalItem("D-1", sign("D-1", "natural"))
+	if err := q.applyQuote(req, now); err != nil {
+		t.Fatalf("applyQuote without _source_type: %v", err)
+	}
+	if len(req.Attributes) != 1 || req.Attributes[0] != natural {
+		t.Errorf("attributes = %v, want %v", req.Attributes, natural)
+	}
+	req = externalItem("D-1", sign("D-1", "labgrown"))
+	if err := q.applyQuote(req, now); err != nil || len(req.Attributes) != 0 {
+		t.Errorf("labgrown quote without _source_type: %v, attributes %v", err, req.Attributes)
+	}
+
+	for name, req := range map[string]*AddCartItemRequest{
+		"other item":       externalItem("D-2", sign("D-1", "natural"), natural),
+		"other collection": externalItem("D-1", sign("D-1", "labgrown"), natural),
+		"natural item, labgrown quote by default": externalItem("D-1", sign("D-1", "natural"), labgrown),
+	} {
+		if err := q.applyQuote(req, now); err != errQuoteMismatch {
+			t.Errorf("%s: applyQuote = %v, want %v", name, err, errQuoteMismatch)
+		}
+	}
+}
+
+func TestCreateQuote(t *testing.T) {
+	catalog := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/search/natural/D-1":
+			io.WriteString(w, `{"document":{"id":"D-1","total_price":"4200"}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer catalog.Close()
+	g := newTestGateway(t, `
+upstreams:
+  catalog:
+    url: `+catalog.URL+`
+quotes:
+  secrets: [`+testQuoteSecret+`]
+  catalog:
+    upstream: catalog
+    path: /search/{collection}/{externalId}
+routes:
+  - name: frontend-cart
+    prefix: /api/gw/v1/cart
+    handler: frontend
+    upstream: catalog
+`)
+
+	request := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/gw/v1/cart/quotes", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		return serveGateway(g, r)
+	}
+	w := request(`{"externalId":"D-1","collection":"natural"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("quote = %d %s", w.Code, w.Body)
+	}
+	var envelope struct {
+		Data QuoteResponse `json:"data"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &envelope)
+	quote, err := g.state.Load().quotes.verify(envelope.Data.Quote, time.Now())
+	if err != nil {
+		t.Fatalf("issued quote: %v", err)
+	}
+	if quote.Collection != "natural" || quote.Amount != "4200.00" || envelope.Data.Collection != "natural" {
+		t.Errorf("quote = %+v, response %+v", quote, envelope.Data)
+	}
+
+	// The same ID in the other collection isn't in the catalog
+	if w := request(`{"externalId":"D-1","collection":"labgrown"}`); w.Code != http.StatusNotFound {
+		t.Errorf("quote from the other collection = %d %s", w.Code, w.Body)
+	}
+}
+
+func TestBackendAddCartItemDenied(t *testing.T) {
+	g := newTestGateway(t, string(defaultConfigYAML))
+	r := httptest.NewRequest("POST", "/api/api/v1/cart/items", strings.NewReader(`{"source":"external","externalId":"D-1","price":{"amount":"1.00"}}`))
+	if w := serveGateway(g, r); w.Code != http.StatusForbidden {
+		t.Errorf("POST /api/api/v1/cart/items = %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What a rate limit counts requests by
+const (
+	rateLimitKeyAPIKey = "api_key"
+	rateLimitKeyIP     = "ip"
+	rateLimitKeyCartID = "cartId"
+)
+
+// Largest request body inspected when looking for a cartId
+const maxRateLimitBodyPeek = 1 << 20
+
+// Idle buckets are dropped at most this often
+const rateLimitSweepInterval = time.Minute
+
+// rateLimiter is a named token bucket policy. Every route referencing the
+// policy shares its buckets, so a policy limits a group of routes together.
+// Buckets are kept per gateway instance.
+type rateLimiter struct {
+	name   string
+	config RateLimitConfig
+	burst  float64
+	rate   float64 // tokens added per second
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimitResult is the outcome of taking a token, used for the RateLimit-* headers
+type rateLimitResult struct {
+	allowed    bool
+	remaining  int
+	reset      time.Duration // until the bucket is full again
+	retryAfter time.Duration // until the next request is allowed
+}
+
+func newRateLimiter(name string, cfg RateLimitConfig) *rateLimiter {
+	l := &rateLimiter{
+		name:      name,
+		config:    cfg,
+		burst:     float64(cfg.Burst),
+		rate:      float64(cfg.Limit) / time.Duration(cfg.Period).Seconds(),
+		buckets:   map[string]*tokenBucket{},
+		lastSweep: time.Now(),
+	}
+	if l.burst <= 0 {
+		l.burst = float64(cfg.Limit)
+	}
+	return l
+}
+
+// rateLimiter returns the limiter for a policy, reusing the existing one when
+// the policy is unchanged so a config reload doesn't reset every bucket
+func (g *Gateway) rateLimiter(name string, cfg RateLimitConfig) *rateLimiter {
+	g.limitersMu.Lock()
+	defer g.limitersMu.Unlock()
+
+	if l, ok := g.limiters[name]; ok && l.config == cfg {
+		return l
+	}
+	l := newRateLimiter(name, cfg)
+	if g.limiters == nil {
+		g.limiters = map[string]*rateLimiter{}
+	}
+	g.limiters[name] = l
+	return l
+}
+
+// take spends a token from the bucket of key if one is available
+func (l *rateLimiter) take(key string, now time.Time) rateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		l.sweep(now)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+
+	result := rateLimitResult{allowed: bucket.tokens >= 1}
+	if result.allowed {
+		bucket.tokens--
+	} else {
+		result.retryAfter = l.timeToRefill(1 - bucket.tokens)
+	}
+	result.remaining = int(bucket.tokens)
+	result.reset = l.timeToRefill(l.burst - bucket.tokens)
+	return result
+}
+
+// sweep drops buckets that have refilled completely; mu must be held
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+func (l *rateLimiter) timeToRefill(tokens float64) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// requestKey returns the bucket a request counts against. Requests without
+// the configured key (no authenticated API key, no cartId) are counted by client IP.
+func (l *rateLimiter) requestKey(r *http.Request) string {
+	switch l.config.Key {
+	case rateLimitKeyAPIKey:
+		if name := requestAttr(r, "apiKey"); name != "" {
+			return "key:" + name
+		}
+	case rateLimitKeyCartID:
+		if cartID := requestCartID(r); cartID != "" {
+			return "cart:" + cartID
+		}
+	}
+	return "ip:" + getClientIP(r)
+}
+
+// requestCartID finds the cartId of a frontend API request before its handler
+// runs: from the query string, or from the JSON body
+func requestCartID(r *http.Request) string {
+	if cartID := r.URL.Query().Get("cartId"); cartID != "" {
+		return cartID
+	}
+	if r.Body == nil || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		return ""
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRateLimitBodyPeek))
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+	if err != nil {
+		return ""
+	}
+	var fields struct {
+		CartID string `json:"cartId"`
+	}
+	json.Unmarshal(body, &fields)
+	return fields.CartID
+}
+
+// setHeaders describes the caller's quota using the RateLimit header fields
+func (l *rateLimiter) setHeaders(h http.Header, result rateLimitResult) {
+	h.Set("RateLimit-Limit", strconv.Itoa(int(l.burst)))
+	h.Set("RateLimit-Remaining", strconv.Itoa(result.remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.reset)))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d", l.config.Limit, ceilSeconds(time.Duration(l.config.Period)), int(l.burst)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// Rate limiting middleware: applies the route's rate limit policies, if
+// any. A request must fit every policy; the headers describe the one that
+// refused it or, when allowed, the one with the fewest requests left.
+func (g *Gateway) rateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limiters := routeFromContext(r.Context()).rateLimits
+		if len(limiters) == 0 {
+			next(w, r)
+			return
+		}
+
+		now := time.Now()
+		var tightest *rateLimiter
+		var tightestResult rateLimitResult
+		for _, limiter := range limiters {
+			key := limiter.requestKey(r)
+			result := limiter.take(key, now)
+			if !result.allowed {
+				limiter.setHeaders(w.Header(), result)
+				retryAfter := ceilSeconds(result.retryAfter)
+				slog.InfoContext(r.Context(), "Rate limit exceeded", "rate_limit", limiter.name, "key", key, "method", r.Method, "path", r.URL.Path)
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				g.sendResponse(w, http.StatusTooManyRequests, nil, &ErrorInfo{
+					Code:    "RATE_LIMITED",
+					Message: fmt.Sprintf("Too many requests, retry in %d seconds", retryAfter),
+					Details: map[string]interface{}{
+						"policy":      limiter.name,
+						"retry_after": retryAfter,
+					},
+				})
+				return
+			}
+			if tightest == nil || result.remaining < tightestResult.remaining {
+				tightest, tightestResult = limiter, result
+			}
+		}
+		tightest.setHeaders(w.Header(), tightestResult)
+		next(w, r)
+	}
+}
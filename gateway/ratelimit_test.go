@@ -0,0 +1,214 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	l := newRateLimiter("test", RateLimitConfig{Limit: 60, Period: Duration(time.Minute), Burst: 3, Key: rateLimitKeyIP})
+	now := time.Now()
+
+	for i := 2; i >= 0; i-- {
+		result := l.take("a", now)
+		if !result.allowed || result.remaining != i {
+			t.Fatalf("take = %+v, want allowed with %d remaining", result, i)
+		}
+	}
+	result := l.take("a", now)
+	if result.allowed || result.remaining != 0 {
+		t.Fatalf("take over burst = %+v", result)
+	}
+	// One token a second at 60 per minute
+	if result.retryAfter != time.Second || result.reset != 3*time.Second {
+		t.Errorf("retryAfter %v, reset %v; want 1s, 3s", result.retryAfter, result.reset)
+	}
+
+	// Other keys have buckets of their own
+	if result := l.take("b", now); !result.allowed || result.remaining != 2 {
+		t.Errorf("take for another key = %+v", result)
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	l := newRateLimiter("test", RateLimitConfig{Limit: 60, Period: Duration(time.Minute), Burst: 3, Key: rateLimitKeyIP})
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		l.take("a", now)
+	}
+
+	if result := l.take("a", now.Add(500*time.Millisecond)); result.allowed {
+		t.Fatalf("take after half a token = %+v", result)
+	}
+	if result := l.take("a", now.Add(time.Second)); !result.allowed || result.remaining != 0 {
+		t.Fatalf("take after one token = %+v", result)
+	}
+
+	// A bucket never holds more than burst
+	result := l.take("a", now.Add(time.Hour))
+	if !result.allowed || result.remaining != 2 {
+		t.Fatalf("take after an hour = %+v", result)
+	}
+
+	// Full buckets are swept
+	l.take("b", now.Add(time.Hour))
+	l.take("c", now.Add(2*time.Hour))
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("refilled bucket was not swept")
+	}
+	if _, ok := l.buckets["c"]; !ok {
+		t.Error("bucket in use was swept")
+	}
+}
+
+func TestRateLimiterDefaultBurst(t *testing.T) {
+	l := newRateLimiter("test", RateLimitConfig{Limit: 5, Period: Duration(time.Second), Key: rateLimitKeyIP})
+	if result := l.take("a", time.Now()); result.remaining != 4 {
+		t.Errorf("remaining = %d, want burst of limit 5 less one", result.remaining)
+	}
+}
+
+func TestRateLimiterSetHeaders(t *testing.T) {
+	l := newRateLimiter("cart", RateLimitConfig{Limit: 120, Period: Duration(time.Minute), Burst: 30, Key: rateLimitKeyCartID})
+	h := http.Header{}
+	l.setHeaders(h, rateLimitResult{allowed: true, remaining: 7, reset: 11500 * time.Millisecond})
+
+	want := map[string]string{
+		"RateLimit-Limit":     "30",
+		"RateLimit-Remaining": "7",
+		"RateLimit-Reset":     "12",
+		"RateLimit-Policy":    "120;w=60;burst=30",
+	}
+	for name, value := range want {
+		if got := h.Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestRateLimiterRequestKey(t *testing.T) {
+	cart := newRateLimiter("cart", RateLimitConfig{Limit: 1, Period: Duration(time.Second), Key: rateLimitKeyCartID})
+
+	r := httptest.NewRequest("GET", "/api/gw/v1/cart?cartId=c1", nil)
+	if got := cart.requestKey(r); got != "cart:c1" {
+		t.Errorf("query cartId key = %q", got)
+	}
+
+	r = httptest.NewRequest("POST", "/api/gw/v1/cart/items", strings.NewReader(`{"cartId":"c2","quantity":1}`))
+	r.Header.Set("Content-Type", "application/json")
+	if got := cart.requestKey(r); got != "cart:c2" {
+		t.Errorf("body cartId key = %q", got)
+	}
+	// The body is still readable by the handler
+	if body, err := io.ReadAll(r.Body); err != nil || string(body) != `{"cartId":"c2","quantity":1}` {
+		t.Errorf("body after key lookup = %q, %v", body, err)
+	}
+
+	r = httptest.NewRequest("POST", "/api/gw/v1/cart/items", strings.NewReader(`{"quantity":1}`))
+	r.Header.Set("Content-Type", "application/json")
+	if got := cart.requestKey(r); got != "ip:192.0.2.1" {
+		t.Errorf("key without cartId = %q, want the client IP", got)
+	}
+}
+
+func TestRateLimitRotatingCartIDs(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	g := newTestGateway(t, `
+upstreams:
+  backend:
+    url: `+backend.URL+`
+rate_limits:
+  cart:
+    limit: 2
+    period: 1m
+    key: cartId
+  cart-ip:
+    limit: 5
+    period: 1m
+    key: ip
+routes:
+  - name: cart
+    prefix: /cart
+    upstream: backend
+    auth: none
+    rate_limit: [cart, cart-ip]
+`)
+
+	request := func(cartID string) *httptest.ResponseRecorder {
+		return serveGateway(g, httptest.NewRequest("GET", "/cart?cartId="+cartID, nil))
+	}
+
+	// The cart policy limits one cart...
+	request("c0")
+	w := request("c0")
+	if w.Code != http.StatusOK || w.Header().Get("RateLimit-Remaining") != "0" || w.Header().Get("RateLimit-Limit") != "2" {
+		t.Fatalf("second request: status %d, headers %v", w.Code, w.Header())
+	}
+	if w := request("c0"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("third request for one cart: status %d", w.Code)
+	}
+
+	// ...and the IP policy a client rotating carts. The refused request
+	// didn't count against the IP.
+	for i := 1; i <= 3; i++ {
+		if w := request("c" + strings.Repeat("x", i)); w.Code != http.StatusOK {
+			t.Fatalf("request for a new cart: status %d", w.Code)
+		}
+	}
+	w = request("fresh")
+	if w.Code != http.StatusTooManyRequests || envelopeErrorCode(t, w) != "RATE_LIMITED" {
+		t.Fatalf("request over the IP limit: status %d", w.Code)
+	}
+	if got := w.Header().Get("RateLimit-Policy"); got != "5;w=60;burst=5" {
+		t.Errorf("RateLimit-Policy = %q, want the IP policy", got)
+	}
+}
+
+func TestRouteRateLimitNames(t *testing.T) {
+	for _, tt := range []struct {
+		yaml string
+		want string
+	}{
+		{"rate_limit: cart", "cart"},
+		{"rate_limit: [cart, cart-ip]", "cart,cart-ip"},
+	} {
+		cfg, err := parseConfig([]byte(`
+upstreams:
+  backend:
+    url: http://localhost:3001
+rate_limits:
+  cart: {limit: 1, period: 1s, key: cartId}
+  cart-ip: {limit: 1, period: 1s, key: ip}
+routes:
+  - name: cart
+    prefix: /
+    upstream: backend
+    `+tt.yaml+`
+`), ".yaml")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.yaml, err)
+		}
+		if got := strings.Join(cfg.Routes[0].RateLimit, ","); got != tt.want {
+			t.Errorf("%s: rate limits %q, want %q", tt.yaml, got, tt.want)
+		}
+	}
+
+	_, err := parseConfig([]byte(`
+upstreams:
+  backend:
+    url: http://localhost:3001
+routes:
+  - name: cart
+    prefix: /
+    upstream: backend
+    rate_limit: [missing]
+`), ".yaml")
+	if err == nil || !strings.Contains(err.Error(), `unknown rate limit "missing"`) {
+		t.Errorf("unknown policy error = %v", err)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// redactedValue replaces everything a redaction rule matches
+const redactedValue = "[REDACTED]"
+
+// Fields always masked in JSON bodies: contact details, addresses and
+// credentials
+var defaultRedactFields = []string{
+	"$..email", "$..phone", "$..firstName", "$..lastName",
+	"$..address", "$..address1", "$..address2", "$..shippingAddress", "$..billingAddress",
+	"$..street", "$..zip", "$..postalCode",
+	"$..apiKey", "$..api_key", "$..password", "$..secret", "$..authorization",
+	"$..token", "$..cartToken", "$..sessionToken", "$..quote",
+}
+
+// Patterns always masked in bodies, query strings and headers. When a
+// pattern has a group, only the group is masked.
+var defaultRedactPatterns = []string{
+	// Email addresses
+	`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	// Phone numbers in international or North American notation
+	`\+\d[\d ().-]{7,}\d`,
+	`\(?\b\d{3}\)?[ .-]\d{3}[ .-]\d{4}\b`,
+	// Street addresses such as "221 Baker Street"
+	`(?i)\b\d{1,5}(?: [A-Za-z0-9.]+){1,4} (?:street|st|avenue|ave|road|rd|boulevard|blvd|lane|ln|drive|dr|court|ct|way|place|pl)\b\.?`,
+	// JWTs, bearer tokens and the gateway's signed tokens
+	`\beyJ[\w-]+\.[\w-]+\.[\w-]*`,
+	`(?i)\bbearer ([\w.~+/-]+=*)`,
+	`\b[\w-]{8}\.\d{9,}\.[\w-]{43}\b`,
+	// Credentials in query strings
+	`(?i)[?&](?:token|api_key|apikey|access_token|key)=([^&\s"]+)`,
+}
+
+// Headers whose values are always masked
+var defaultRedactHeaders = []string{
+	"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie",
+	"X-API-Key", cartTokenHeader, sessionTokenHeader,
+}
+
+// redactor masks personal data and credentials in captured requests and
+// responses. JSON bodies have the values of matching fields masked
+// whatever their content; every string, and bodies that aren't JSON, then
+// have the patterns masked.
+type redactor struct {
+	fields   []jsonPath
+	patterns []*regexp.Regexp
+	headers  map[string]bool
+}
+
+// newRedactor compiles the built-in rules and those of cfg
+func newRedactor(cfg RedactConfig) (*redactor, error) {
+	rd := &redactor{headers: map[string]bool{}}
+	for _, field := range append(append([]string{}, defaultRedactFields...), cfg.Fields...) {
+		path, err := parseJSONPath(field)
+		if err != nil {
+			return nil, fmt.Errorf("redact field %q: %w", field, err)
+		}
+		rd.fields = append(rd.fields, path)
+	}
+	for _, pattern := range append(append([]string{}, defaultRedactPatterns...), cfg.Patterns...) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("redact pattern %q: %w", pattern, err)
+		}
+		rd.patterns = append(rd.patterns, re)
+	}
+	for _, name := range append(append([]string{}, defaultRedactHeaders...), cfg.Headers...) {
+		rd.headers[http.CanonicalHeaderKey(name)] = true
+	}
+	return rd, nil
+}
+
+// text masks the patterns in s
+func (rd *redactor) text(s string) string {
+	for _, re := range rd.patterns {
+		if re.NumSubexp() == 0 {
+			s = re.ReplaceAllString(s, redactedValue)
+			continue
+		}
+		var b strings.Builder
+		last := 0
+		for _, m := range re.FindAllStringSubmatchIndex(s, -1) {
+			if m[2] < 0 {
+				continue
+			}
+			b.WriteString(s[last:m[2]])
+			b.WriteString(redactedValue)
+			last = m[3]
+		}
+		b.WriteString(s[last:])
+		s = b.String()
+	}
+	return s
+}
+
+// query masks the patterns in a raw query string, which the credential
+// patterns expect to start with ?
+func (rd *redactor) query(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	return strings.TrimPrefix(rd.text("?"+rawQuery), "?")
+}
+
+// jsonBody masks a JSON document; ok is false when data isn't valid JSON
+func (rd *redactor) jsonBody(data []byte) (redacted []byte, ok bool) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil || decoder.More() {
+		return nil, false
+	}
+	doc = rd.value(doc, nil)
+
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, false
+	}
+	return bytes.TrimRight(out.Bytes(), "\n"), true
+}
+
+// value masks the JSON value found at path. Array elements appear in the
+// path as "[]".
+func (rd *redactor) value(v interface{}, path []string) interface{} {
+	if len(path) > 0 {
+		for _, field := range rd.fields {
+			if field.matches(path) {
+				return redactedValue
+			}
+		}
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = rd.value(item, append(path[:len(path):len(path)], key))
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = rd.value(item, append(path[:len(path):len(path)], "[]"))
+		}
+	case string:
+		return rd.text(v)
+	}
+	return v
+}
+
+// header returns the header values to record, masking credentials
+func (rd *redactor) header(h http.Header) map[string]string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := make(map[string]string, len(names))
+	for _, name := range names {
+		if rd.headers[http.CanonicalHeaderKey(name)] {
+			out[name] = redactedValue
+			continue
+		}
+		out[name] = rd.text(strings.Join(h[name], ", "))
+	}
+	return out
+}
+
+// jsonPath is a parsed JSON path such as $.customer.email, $..phone or
+// $.items[*].payload. Names are matched case-insensitively so a rule
+// covers every spelling a backend uses.
+type jsonPath []jsonPathStep
+
+// jsonPathStep matches one level of the document: an object member named
+// name ("*" for any), or an array element. A descendant step can skip any
+// number of levels first.
+type jsonPathStep struct {
+	name       string
+	element    bool
+	descendant bool
+}
+
+// parseJSONPath parses the subset of JSONPath used by redaction rules:
+// .name, ..name, ['name'], .* and [*]
+func parseJSONPath(s string) (jsonPath, error) {
+	if !strings.HasPrefix(s, "$") {
+		return nil, fmt.Errorf("must start with $")
+	}
+	var path jsonPath
+	rest := s[1:]
+	for rest != "" {
+		var step jsonPathStep
+		switch {
+		case strings.HasPrefix(rest, "[*]"):
+			step.element = true
+			rest = rest[3:]
+		case strings.HasPrefix(rest, "['") || strings.HasPrefix(rest, `["`):
+			end := strings.Index(rest[2:], string(rest[1])+"]")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated member name")
+			}
+			step.name = rest[2 : 2+end]
+			rest = rest[2+end+2:]
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+			if strings.HasPrefix(rest, ".") {
+				step.descendant = true
+				rest = rest[1:]
+			}
+			if strings.HasPrefix(rest, "[") {
+				// $..[*] and $..['name']: the bracket is the step
+				if !step.descendant {
+					return nil, fmt.Errorf("unexpected [ after .")
+				}
+				next, err := parseJSONPath("$" + rest)
+				if err != nil || len(next) == 0 {
+					return nil, fmt.Errorf("invalid step after ..")
+				}
+				next[0].descendant = true
+				return append(path, next...), nil
+			}
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			step.name = rest[:end]
+			rest = rest[end:]
+			if step.name == "" {
+				return nil, fmt.Errorf("empty member name")
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %q (array indexes and filters are not supported)", rest)
+		}
+		path = append(path, step)
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("must select a field")
+	}
+	return path, nil
+}
+
+// matches reports whether the path selects the value at location
+func (p jsonPath) matches(location []string) bool {
+	if len(p) == 0 {
+		return len(location) == 0
+	}
+	step := p[0]
+	if !step.descendant {
+		return len(location) > 0 && step.matchesLevel(location[0]) && p[1:].matches(location[1:])
+	}
+	for i := range location {
+		if step.matchesLevel(location[i]) && p[1:].matches(location[i+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s jsonPathStep) matchesLevel(key string) bool {
+	if s.element || key == "[]" {
+		return s.element && key == "[]"
+	}
+	return s.name == "*" || strings.EqualFold(s.name, key)
+}
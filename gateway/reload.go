@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Maximum number of diff lines written to the log for a single reload
+const maxDiffLines = 200
+
+// gatewayState is the routing state derived from one configuration.
+// It is immutable once published; a reload builds a new state and swaps it in,
+// while requests already in flight keep using the state they started with.
+type gatewayState struct {
+	config      *Config
+	upstreams   map[string]*upstreamPool
+	routes      *routeTable
+	retryBudget *retryBudget
+	idempotency *idempotencyStore
+	apiKeys     *apiKeyStore
+	jwt         *jwtVerifier
+	carts       *cartGuard
+	sessions    *sessionSigner
+	quotes      *quoteSigner
+	tracer      *tracer
+	capture     *bodyCapture
+	trusted     trustedProxies
+	stop        chan struct{}
+}
+
+// newGatewayState builds the routing state for a configuration and starts
+// its background health checks and API key file watching. Stores, rate
+// limiters, upstream pools and the tracer are shared with the previous state
+// when their settings didn't change.
+func (g *Gateway) newGatewayState(config *Config) (*gatewayState, error) {
+	var idempotencyStore StoreConfig
+	if config.Idempotency != nil {
+		idempotencyStore = config.Idempotency.Store
+	}
+	store, err := g.kvStore(idempotencyStore)
+	if err != nil {
+		return nil, fmt.Errorf("idempotency store: %w", err)
+	}
+
+	apiKeys, err := newAPIKeyStore(config.APIKeys, g.apiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	jwt, err := newJWTVerifier(config.JWT)
+	if err != nil {
+		return nil, err
+	}
+
+	var capture *bodyCapture
+	if config.Capture.enabled() {
+		sink, err := g.captureSink(config.Capture.Sink)
+		if err != nil {
+			return nil, fmt.Errorf("capture sink: %w", err)
+		}
+		if capture, err = newBodyCapture(config.Capture, sink); err != nil {
+			return nil, err
+		}
+	}
+
+	// Validated with the configuration
+	trustedEntries := config.TrustedProxies
+	if trustedEntries == nil {
+		trustedEntries = defaultTrustedProxies
+	}
+	trusted, _ := parseTrustedProxies(trustedEntries)
+
+	state := &gatewayState{
+		config:      config,
+		upstreams:   make(map[string]*upstreamPool, len(config.Upstreams)),
+		retryBudget: newRetryBudget(config.RetryBudget),
+		idempotency: newIdempotencyStore(store, config.Idempotency),
+		apiKeys:     apiKeys,
+		jwt:         jwt,
+		carts:       newCartGuard(config.Carts),
+		sessions:    newSessionSigner(config.DepositSessions),
+		quotes:      newQuoteSigner(config.Quotes),
+		tracer:      g.tracer(config.Tracing),
+		capture:     capture,
+		trusted:     trusted,
+		stop:        make(chan struct{}),
+	}
+	for name, uc := range config.Upstreams {
+		pool := g.upstreamPool(name, uc)
+		if uc.HealthCheck != nil {
+			pool.startHealthChecks(uc.HealthCheck, probeClient, state.stop)
+		}
+		state.upstreams[name] = pool
+	}
+	apiKeys.watch(configPollInterval(), state.stop)
+
+	limiters := make(map[string]*rateLimiter, len(config.RateLimits))
+	for name, rc := range config.RateLimits {
+		limiters[name] = g.rateLimiter(name, rc)
+	}
+	state.routes = compileRoutes(config, state.upstreams, limiters)
+	return state, nil
+}
+
+// upstreamPool returns the pool for an upstream, reusing the one built for
+// an identical configuration so target health, ejections, circuit breaker
+// state and connection counts survive reloads. Its health checks are
+// started again by each state.
+func (g *Gateway) upstreamPool(name string, cfg UpstreamConfig) *upstreamPool {
+	g.poolsMu.Lock()
+	defer g.poolsMu.Unlock()
+
+	if pool, ok := g.pools[name]; ok && reflect.DeepEqual(pool.config, cfg) {
+		return pool
+	}
+	pool := newUpstreamPool(name, cfg)
+	if g.pools == nil {
+		g.pools = map[string]*upstreamPool{}
+	}
+	g.pools[name] = pool
+	return pool
+}
+
+// close stops the background work of a state that has been replaced
+func (s *gatewayState) close() {
+	close(s.stop)
+}
+
+// reloadConfig re-reads the configuration file and swaps in the new routing state.
+// An invalid configuration is rejected and the last good one stays active.
+func (g *Gateway) reloadConfig(reason string) {
+	g.reloadMu.Lock()
+	defer g.reloadMu.Unlock()
+
+	path := configPath()
+	if path == "" {
+		slog.Info("Config reload skipped: GATEWAY_CONFIG not set, using built-in configuration", "reason", reason)
+		return
+	}
+
+	current := g.state.Load()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Error("Config reload rejected, keeping last good config", "reason", reason, "error", err)
+		return
+	}
+	if bytes.Equal(data, current.config.source) {
+		return
+	}
+
+	config, err := parseConfig(data, filepath.Ext(path))
+	if err != nil {
+		slog.Error("Config reload rejected, keeping last good config", "reason", reason, "error", err)
+		logConfigDiff(current.config.source, data)
+		return
+	}
+
+	state, err := g.newGatewayState(config)
+	if err != nil {
+		slog.Error("Config reload rejected, keeping last good config", "reason", reason, "error", err)
+		return
+	}
+	g.state.Store(state)
+	current.close()
+	slog.Info("Config reloaded", "reason", reason, "path", path)
+	logConfigDiff(current.config.source, data)
+}
+
+// configPollInterval returns how often configuration files are checked for
+// changes (GATEWAY_CONFIG_POLL_INTERVAL, default 5s)
+func configPollInterval() time.Duration {
+	interval := 5 * time.Second
+	if v := os.Getenv("GATEWAY_CONFIG_POLL_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			interval = d
+		} else {
+			slog.Warn("Invalid GATEWAY_CONFIG_POLL_INTERVAL", "value", v, "using", interval.String())
+		}
+	}
+	return interval
+}
+
+// watchConfig reloads the configuration on SIGHUP and whenever the
+// configuration file changes on disk
+func (g *Gateway) watchConfig(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	path := configPath()
+	if path == "" {
+		go func() {
+			for range hup {
+				g.reloadConfig("SIGHUP")
+			}
+		}()
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		lastSum := fileChecksum(path)
+		for {
+			select {
+			case <-hup:
+				g.reloadConfig("SIGHUP")
+			case <-ticker.C:
+				// Editors often write files in several steps, so compare content
+				// rather than modification times
+				sum := fileChecksum(path)
+				if sum == lastSum {
+					continue
+				}
+				lastSum = sum
+				g.reloadConfig("file changed")
+			}
+		}
+	}()
+}
+
+// fileChecksum returns a digest of the file's content, or "" if it can't be read
+func fileChecksum(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// logConfigDiff logs the settings that differ between two configuration
+// documents, with secrets masked
+func logConfigDiff(oldSource, newSource []byte) {
+	oldLines, err := configLines(oldSource)
+	if err != nil {
+		return
+	}
+	newLines, err := configLines(newSource)
+	if err != nil {
+		slog.Info("Config diff unavailable: the file can't be parsed")
+		return
+	}
+	lines := diffLines(oldLines, newLines)
+	if len(lines) == 0 {
+		return
+	}
+	if len(lines) > maxDiffLines {
+		omitted := len(lines) - maxDiffLines
+		lines = append(lines[:maxDiffLines], fmt.Sprintf("... %d more lines", omitted))
+	}
+	slog.Info("Config diff (- active, + file)", "diff", strings.Join(lines, "\n"))
+}
+
+// Settings whose values are masked in config diffs: keys containing one of
+// secretKeyParts, and the values of tracing headers, which carry exporter
+// credentials
+var (
+	secretKeyParts = []string{"secret", "password", "token", "api_key"}
+	// Environment references without a default name a secret without
+	// revealing it
+	envReference = regexp.MustCompile(`^\$\{\w+(:-)?\}$`)
+	// Credentials embedded in URLs such as redis://:password@host
+	urlPassword = regexp.MustCompile(`(://[^:/@\s]*:)[^@/\s]+@`)
+)
+
+// configLines flattens a configuration document into sorted "path: value"
+// lines, with secrets masked, so that changes can be logged
+func configLines(source []byte) ([]string, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(source, &doc); err != nil {
+		return nil, err
+	}
+	var lines []string
+	flattenConfig("", doc, false, &lines)
+	return lines, nil
+}
+
+func flattenConfig(path string, v interface{}, secret bool, lines *[]string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			*lines = append(*lines, path+": {}")
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+			flattenConfig(child, v[key], secret || isSecretKey(key) || (path == "tracing" && key == "headers"), lines)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			*lines = append(*lines, path+": []")
+		}
+		for i, item := range v {
+			flattenConfig(fmt.Sprintf("%s[%d]", path, i), item, secret, lines)
+		}
+	case nil:
+		*lines = append(*lines, path+": null")
+	default:
+		value := fmt.Sprint(v)
+		switch {
+		case secret && !envReference.MatchString(value):
+			value = redactedValue
+		default:
+			value = redactURLPassword(value)
+		}
+		*lines = append(*lines, path+": "+value)
+	}
+}
+
+// redactURLPassword masks the password of URLs in s
+func redactURLPassword(s string) string {
+	return urlPassword.ReplaceAllString(s, "${1}"+redactedValue+"@")
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	if strings.HasSuffix(key, "_ttl") {
+		return false
+	}
+	for _, part := range secretKeyParts {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// diffLines returns the lines removed from a ("-") and added in b ("+"),
+// based on their longest common subsequence
+func diffLines(a, b []string) []string {
+	// lcs[i][j] is the LCS length of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "- "+a[i])
+			i++
+		default:
+			out = append(out, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+ "+b[j])
+	}
+	return out
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// requestAttrs holds identifiers discovered while serving a request,
+// such as the cartId a typed handler decoded from the body. It is attached
+// to the context by the outermost middleware so inner handlers can record
+// values that outer middleware and upstream selection can read.
+type requestAttrs struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+type requestAttrsContextKey struct{}
+
+func withRequestAttrs(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(requestAttrsContextKey{}).(*requestAttrs); ok {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestAttrsContextKey{}, &requestAttrs{values: map[string]string{}}))
+}
+
+// setRequestAttr records a request attribute; empty values are ignored
+func setRequestAttr(r *http.Request, key, value string) {
+	attrs, ok := r.Context().Value(requestAttrsContextKey{}).(*requestAttrs)
+	if !ok || value == "" {
+		return
+	}
+	attrs.mu.Lock()
+	attrs.values[key] = value
+	attrs.mu.Unlock()
+}
+
+// requestAttr returns a request attribute, or "" if it was never set
+func requestAttr(r *http.Request, key string) string {
+	attrs, ok := r.Context().Value(requestAttrsContextKey{}).(*requestAttrs)
+	if !ok {
+		return ""
+	}
+	attrs.mu.Lock()
+	defer attrs.mu.Unlock()
+	return attrs.values[key]
+}
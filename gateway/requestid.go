@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// requestIDHeader carries the request ID from clients, to upstreams and back
+const requestIDHeader = "X-Request-ID"
+
+// Request IDs sent by clients are kept when they are short tokens that are
+// safe to log and forward; anything else is replaced
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDContextKey struct{}
+
+// requestIDMiddleware accepts the client's X-Request-ID or generates one,
+// and returns it in the response. It runs first so every log line and
+// upstream call of the request can carry the ID.
+func (g *Gateway) requestIDMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		r.Header.Set(requestIDHeader, id)
+		w.Header().Set(requestIDHeader, id)
+		next(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id)))
+	}
+}
+
+// requestID returns the ID of an inbound request, or the ID header of an
+// outbound one
+func requestID(r *http.Request) string {
+	if id, ok := r.Context().Value(requestIDContextKey{}).(string); ok {
+		return id
+	}
+	return r.Header.Get(requestIDHeader)
+}
+
+// newRequestID returns a UUIDv7 (RFC 9562): a millisecond timestamp
+// followed by random bits, so IDs sort by creation time
+func newRequestID() string {
+	var uuid [16]byte
+	rand.Read(uuid[6:])
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixMilli()))
+	copy(uuid[:6], ms[2:])
+	uuid[6] = 0x70 | uuid[6]&0x0f
+	uuid[8] = 0x80 | uuid[8]&0x3f
+
+	var buf [36]byte
+	hex.Encode(buf[0:8], uuid[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], uuid[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], uuid[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], uuid[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], uuid[10:])
+	return string(buf[:])
+}
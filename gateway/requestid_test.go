@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var uuidV7Pattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestNewRequestID(t *testing.T) {
+	before := time.Now().UnixMilli()
+	seen := map[string]bool{}
+	var ids []string
+	for i := 0; i < 1000; i++ {
+		id := newRequestID()
+		if !uuidV7Pattern.MatchString(id) {
+			t.Fatalf("%s is not a UUIDv7", id)
+		}
+		if seen[id] {
+			t.Fatalf("%s generated twice", id)
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	after := time.Now().UnixMilli()
+
+	// The first 48 bits are the creation time in milliseconds
+	ms, err := strconv.ParseInt(strings.ReplaceAll(ids[0][:13], "-", ""), 16, 64)
+	if err != nil || ms < before || ms > after {
+		t.Errorf("timestamp of %s = %d, want between %d and %d", ids[0], ms, before, after)
+	}
+
+	// IDs from different milliseconds sort by creation time
+	time.Sleep(2 * time.Millisecond)
+	if later := newRequestID(); later <= ids[0] {
+		t.Errorf("%s sorts before %s", later, ids[0])
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	g := newTestGateway(t, proxyConfig("http://localhost:3001"))
+
+	tests := []struct {
+		name   string
+		header []string
+		keep   bool
+	}{
+		{"UUID", []string{"0190b6f4-8c2e-7d3a-9f1b-2c4d6e8f0a1b"}, true},
+		{"opaque token", []string{"req_01HZX.abc:42"}, true},
+		{"128 characters", []string{strings.Repeat("a", 128)}, true},
+		{"missing", nil, false},
+		{"empty", []string{""}, false},
+		{"129 characters", []string{strings.Repeat("a", 129)}, false},
+		{"spaces", []string{"id with spaces"}, false},
+		{"header injection", []string{"abc\r\nX-Admin: 1"}, false},
+		{"log injection", []string{`abc" level=ERROR`}, false},
+		{"non-ASCII", []string{"réf-1"}, false},
+		{"first of several is used", []string{"first", "second"}, true},
+	}
+	for _, tt := range tests {
+		var seen, forwarded string
+		handler := g.requestIDMiddleware(func(w http.ResponseWriter, r *http.Request) {
+			seen = requestID(r)
+			forwarded = r.Header.Get(requestIDHeader)
+		})
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header[http.CanonicalHeaderKey(requestIDHeader)] = tt.header
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		switch {
+		case tt.keep && seen != tt.header[0]:
+			t.Errorf("%s: id = %q, want the client's", tt.name, seen)
+		case !tt.keep && !uuidV7Pattern.MatchString(seen):
+			t.Errorf("%s: id = %q, want a generated one", tt.name, seen)
+		}
+		if forwarded != seen || w.Header().Get(requestIDHeader) != seen {
+			t.Errorf("%s: request header %q, response header %q, id %q", tt.name, forwarded, w.Header().Get(requestIDHeader), seen)
+		}
+		if n := len(r.Header.Values(requestIDHeader)); n != 1 {
+			t.Errorf("%s: %d request ID headers", tt.name, n)
+		}
+	}
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	var received string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(requestIDHeader)
+		w.Header().Set(requestIDHeader, "backend-id")
+	}))
+	defer backend.Close()
+	g := newTestGateway(t, proxyConfig(backend.URL))
+
+	r := httptest.NewRequest("GET", "/products", nil)
+	r.Header.Set(requestIDHeader, "client-id-1")
+	w := serveGateway(g, r)
+	if received != "client-id-1" || w.Header().Get(requestIDHeader) != "client-id-1" {
+		t.Errorf("client ID: upstream got %q, client got %q", received, w.Header().Get(requestIDHeader))
+	}
+
+	w = serveGateway(g, httptest.NewRequest("GET", "/products", nil))
+	if !uuidV7Pattern.MatchString(received) || w.Header().Get(requestIDHeader) != received {
+		t.Errorf("generated ID: upstream got %q, client got %q", received, w.Header().Get(requestIDHeader))
+	}
+
+	// Outbound requests carry the ID of the inbound one
+	out := httptest.NewRequest("GET", "http://backend/", nil)
+	out.Header.Set(requestIDHeader, "outbound")
+	if got := requestID(out); got != "outbound" {
+		t.Errorf("requestID of outbound request = %q", got)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Defaults for retry policies and the retry budget
+const (
+	defaultRetryAttempts     = 3
+	defaultRetryBaseDelay    = 100 * time.Millisecond
+	defaultRetryMaxDelay     = 2 * time.Second
+	defaultRetryBudgetRatio  = 0.2
+	defaultRetryBudgetMinRPS = 5
+)
+
+// Statuses retried when a policy doesn't list its own: the ones Fly
+// returns while a machine restarts
+var defaultRetryStatuses = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// retryPolicy decides whether and when a failed upstream call is retried
+type retryPolicy struct {
+	attempts  int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+	onStatus  map[int]bool
+}
+
+func newRetryPolicy(cfg *RetryConfig) *retryPolicy {
+	if cfg == nil {
+		return nil
+	}
+	policy := &retryPolicy{
+		attempts:  cfg.Attempts,
+		baseDelay: time.Duration(cfg.BaseDelay),
+		maxDelay:  time.Duration(cfg.MaxDelay),
+		onStatus:  map[int]bool{},
+	}
+	if policy.attempts <= 0 {
+		policy.attempts = defaultRetryAttempts
+	}
+	if policy.baseDelay <= 0 {
+		policy.baseDelay = defaultRetryBaseDelay
+	}
+	if policy.maxDelay <= 0 {
+		policy.maxDelay = defaultRetryMaxDelay
+	}
+	statuses := cfg.OnStatus
+	if len(statuses) == 0 {
+		statuses = defaultRetryStatuses
+	}
+	for _, code := range statuses {
+		policy.onStatus[code] = true
+	}
+	return policy
+}
+
+// backoff returns the delay before the given retry (1 for the first retry):
+// exponential growth capped at maxDelay, with full jitter so clients that
+// failed together don't retry together
+func (p *retryPolicy) backoff(retry int) time.Duration {
+	ceiling := p.baseDelay << (retry - 1)
+	if ceiling > p.maxDelay || ceiling <= 0 {
+		ceiling = p.maxDelay
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// retryable reports whether the outcome of an attempt is worth retrying
+func (p *retryPolicy) retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		// The caller went away or the circuit opened; retrying can't help
+		var circuitErr *errCircuitOpen
+		return !errors.Is(err, context.Canceled) && !errors.As(err, &circuitErr)
+	}
+	return p.onStatus[resp.StatusCode]
+}
+
+// Methods that can safely be repeated (RFC 9110 section 9.2.2)
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// retryBudget caps retries gateway-wide to a fraction of regular traffic,
+// so an upstream outage doesn't turn into a retry storm. Each request
+// deposits ratio tokens and each retry spends one; a minimum rate keeps
+// retries possible when traffic is low.
+type retryBudget struct {
+	mu           sync.Mutex
+	ratio        float64
+	minPerSecond float64
+	tokens       float64
+	maxTokens    float64
+	last         time.Time
+}
+
+func newRetryBudget(cfg *RetryBudgetConfig) *retryBudget {
+	b := &retryBudget{
+		ratio:        defaultRetryBudgetRatio,
+		minPerSecond: defaultRetryBudgetMinRPS,
+		last:         time.Now(),
+	}
+	if cfg != nil {
+		if cfg.Ratio > 0 {
+			b.ratio = cfg.Ratio
+		}
+		if cfg.MinRetriesPerSecond > 0 {
+			b.minPerSecond = cfg.MinRetriesPerSecond
+		}
+	}
+	// Allow bursts of up to ten seconds' worth of the minimum rate
+	b.maxTokens = b.minPerSecond * 10
+	b.tokens = b.maxTokens
+	return b
+}
+
+// deposit is called once per upstream request
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > b.maxTokens {
+		b.tokens = b.maxTokens
+	}
+}
+
+// withdraw reports whether a retry may be sent
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.minPerSecond
+	b.last = now
+	if b.tokens > b.maxTokens {
+		b.tokens = b.maxTokens
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// roundTrip sends a request to the upstream pool of the matched route.
+// newRequest builds the outbound request for the target chosen for each
+// attempt. Attempts are retried according to the route's retry policy
+// when the request can be replayed and is safe to repeat: an idempotent
+// method, or a request whose Idempotency-Key the gateway's idempotency
+// store holds. Keys sent to routes the store doesn't guard don't count,
+// since upstreams ignore them.
+func (g *Gateway) roundTrip(r *http.Request, pool *upstreamPool, method string, replayable bool, newRequest func(target *upstreamTarget) (*http.Request, error)) (*http.Response, error) {
+	route := routeFromContext(r.Context())
+	budget := g.state.Load().retryBudget
+	budget.deposit()
+
+	// Typed handlers read whole responses within the client timeout;
+	// proxied routes stream theirs
+	client := g.client
+	if route.Handler == "" {
+		client = g.proxyClient
+	}
+
+	attempts := 1
+	policy := route.retry
+	if policy != nil && replayable && (isIdempotent(method) || requestAttr(r, "idempotencyKey") != "") {
+		attempts = policy.attempts
+	}
+
+	for attempt := 1; ; attempt++ {
+		call, err := pool.breaker.allow()
+		if err != nil {
+			g.countUpstreamError(pool.name, err)
+			return nil, err
+		}
+		target := pool.pick(pool.balancerKey(r))
+		req, err := newRequest(target)
+		if err != nil {
+			call.abandon()
+			return nil, err
+		}
+		// The outbound request carries the values of the inbound one, such as
+		// its request ID, but isn't cancelled with it
+		req = req.WithContext(context.WithoutCancel(r.Context()))
+		req = withUpstreamName(req, pool.name)
+		req.Header.Set(requestIDHeader, requestID(r))
+		attemptSpan := startUpstreamSpan(r, req, pool.name, attempt)
+
+		release := target.acquire()
+		sent := time.Now()
+		resp, err := client.Do(req)
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		finishUpstreamSpan(attemptSpan, status, err)
+		g.observeUpstreamAttempt(pool.name, method, status, time.Since(sent))
+		pool.report(target, err, status)
+		call.done(err != nil || status >= 500)
+
+		retry := attempt < attempts && policy.retryable(resp, err)
+		if retry && !budget.withdraw() {
+			slog.WarnContext(r.Context(), "Retry budget exhausted, not retrying", "method", method, "upstream_path", req.URL.Path)
+			retry = false
+		}
+		if !retry {
+			if err != nil {
+				release()
+				g.countUpstreamError(pool.name, err)
+				return nil, err
+			}
+			resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+			return resp, nil
+		}
+
+		var outcome string
+		if err != nil {
+			outcome = err.Error()
+		} else {
+			outcome = resp.Status
+			// Drain so the connection can be reused
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		release()
+
+		delay := policy.backoff(attempt)
+		slog.WarnContext(r.Context(), "Retrying upstream call", "method", method, "upstream_path", req.URL.Path, "upstream", pool.name, "delay", delay.String(), "attempt", attempt+1, "attempts", attempts, "outcome", outcome)
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+}
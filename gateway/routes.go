@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// builtinHandler is a request handler implemented inside the gateway that
+// routes can reference by name instead of proxying to an upstream
+type builtinHandler struct {
+	serve            func(g *Gateway, w http.ResponseWriter, r *http.Request)
+	requiresUpstream bool
+}
+
+var builtinHandlers = map[string]builtinHandler{
+	"frontend":        {serve: (*Gateway).frontendAPIHandler, requiresUpstream: true},
+	"upstream_health": {serve: (*Gateway).handleUpstreamHealth},
+	"openapi":         {serve: (*Gateway).handleOpenAPI},
+	"deny":            {serve: (*Gateway).handleDeny},
+}
+
+// Handler for paths that are never proxied, such as backend endpoints that
+// must only be reached through the checks of the frontend API
+func (g *Gateway) handleDeny(w http.ResponseWriter, r *http.Request) {
+	slog.WarnContext(r.Context(), "Denied path", "method", r.Method, "path", r.URL.Path)
+	g.sendResponse(w, http.StatusForbidden, nil, &ErrorInfo{
+		Code:    "FORBIDDEN",
+		Message: r.URL.Path + " is only available through the frontend API",
+	})
+}
+
+// compiledRoute is a RouteConfig prepared for matching
+type compiledRoute struct {
+	RouteConfig
+	pattern    *regexp.Regexp
+	methods    map[string]bool
+	upstream   *upstreamPool
+	retry      *retryPolicy
+	rateLimits []*rateLimiter
+}
+
+// routeTable is the router compiled from the configuration.
+// Routes are evaluated in configuration order and the first match wins.
+type routeTable struct {
+	routes []*compiledRoute
+}
+
+func compileRoutes(cfg *Config, upstreams map[string]*upstreamPool, limiters map[string]*rateLimiter) *routeTable {
+	table := &routeTable{}
+	for _, rc := range cfg.Routes {
+		route := &compiledRoute{RouteConfig: rc}
+		if rc.Pattern != "" {
+			route.pattern = regexp.MustCompile(rc.Pattern)
+		}
+		if len(rc.Methods) > 0 {
+			route.methods = make(map[string]bool, len(rc.Methods))
+			for _, m := range rc.Methods {
+				route.methods[strings.ToUpper(m)] = true
+			}
+		}
+		if rc.Upstream != "" {
+			route.upstream = upstreams[rc.Upstream]
+		}
+		route.retry = newRetryPolicy(rc.Retry)
+		for _, name := range rc.RateLimit {
+			route.rateLimits = append(route.rateLimits, limiters[name])
+		}
+		if route.Auth == "" {
+			route.Auth = authPolicyAPIKey
+		}
+		table.routes = append(table.routes, route)
+	}
+	return table
+}
+
+// match returns the first route accepting the request, or nil
+func (t *routeTable) match(method, path string) *compiledRoute {
+	for _, route := range t.routes {
+		if route.methods != nil && !route.methods[method] {
+			continue
+		}
+		switch {
+		case route.Path != "":
+			if path == route.Path {
+				return route
+			}
+		case route.Prefix != "":
+			if strings.HasPrefix(path, route.Prefix) {
+				return route
+			}
+		case route.pattern != nil:
+			if route.pattern.MatchString(path) {
+				return route
+			}
+		}
+	}
+	return nil
+}
+
+// upstreamPath applies the strip-prefix and rewrite rules to an inbound path
+func (route *compiledRoute) upstreamPath(path string) string {
+	if route.Rewrite != "" && route.pattern != nil {
+		// Pattern routes replace the matched text and can reference capture groups, e.g. /v2/$1
+		return route.pattern.ReplaceAllString(path, route.Rewrite)
+	}
+	if route.StripPrefix != "" {
+		path = strings.TrimPrefix(path, route.StripPrefix)
+	}
+	if route.Rewrite != "" {
+		return route.Rewrite
+	}
+	return path
+}
+
+// template returns the path template of the route for traces, e.g. "/rest/*"
+func (route *compiledRoute) template() string {
+	switch {
+	case route.Path != "":
+		return route.Path
+	case route.Prefix != "":
+		return route.Prefix + "*"
+	default:
+		return route.Pattern
+	}
+}
+
+// describe renders the route for the startup log, e.g. "/rest/* -> postgrest (strip /rest)"
+func (route *compiledRoute) describe() string {
+	var b strings.Builder
+	switch {
+	case route.Path != "":
+		b.WriteString(route.Path)
+	case route.Prefix != "":
+		b.WriteString(route.Prefix + "*")
+	default:
+		b.WriteString("~" + route.Pattern)
+	}
+	if len(route.Methods) > 0 {
+		b.WriteString(" [" + strings.Join(route.Methods, ",") + "]")
+	}
+	if route.Handler != "" {
+		b.WriteString(" -> handler " + route.Handler)
+		if route.Upstream != "" {
+			b.WriteString(" (" + route.Upstream + ")")
+		}
+	} else {
+		b.WriteString(" -> " + route.Upstream)
+		if route.StripPrefix != "" {
+			b.WriteString(" (strip " + route.StripPrefix + ")")
+		}
+		if route.Rewrite != "" {
+			b.WriteString(" (rewrite " + route.Rewrite + ")")
+		}
+	}
+	switch route.Auth {
+	case authPolicyNone:
+		b.WriteString(" [public]")
+	case authPolicyAPIKey:
+	default:
+		b.WriteString(" [auth " + route.Auth + "]")
+	}
+	if len(route.RateLimit) > 0 {
+		b.WriteString(" [rate limit " + strings.Join(route.RateLimit, ", ") + "]")
+	}
+	return b.String()
+}
+
+type routeContextKey struct{}
+
+// withRoute stores the matched route on the request context
+func withRoute(r *http.Request, route *compiledRoute) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), routeContextKey{}, route))
+}
+
+// routeFromContext returns the route matched for the request, if any
+func routeFromContext(ctx context.Context) *compiledRoute {
+	route, _ := ctx.Value(routeContextKey{}).(*compiledRoute)
+	return route
+}
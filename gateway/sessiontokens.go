@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Deposit sessions expire after a day in the backend; their tokens by default too
+const defaultSessionTokenTTL = 24 * time.Hour
+
+// Header carrying a deposit session token, as an alternative to ?token=
+const sessionTokenHeader = "X-Deposit-Session-Token"
+
+// Session token failures
+var (
+	errMissingSessionToken = errors.New("missing deposit session token")
+	errInvalidSessionToken = errors.New("invalid deposit session token")
+	errExpiredSessionToken = errors.New("deposit session token expired")
+)
+
+// sessionSigner issues and checks the tokens embedded in deposit session
+// URLs. A token is <key id>.<expiry>.<HMAC of session ID and expiry>, signed
+// with a keyring so the secret can be rotated without breaking active sessions.
+type sessionSigner struct {
+	keys []signingKey
+	ttl  time.Duration
+}
+
+// newSessionSigner returns nil when deposit session URLs aren't signed
+func newSessionSigner(cfg *DepositSessionsConfig) *sessionSigner {
+	if !cfg.enabled() {
+		return nil
+	}
+	s := &sessionSigner{keys: newKeyring(cfg.Secrets), ttl: time.Duration(cfg.TokenTTL)}
+	if s.ttl <= 0 {
+		s.ttl = defaultSessionTokenTTL
+	}
+	return s
+}
+
+// sign returns a token for the session and when it expires
+func (s *sessionSigner) sign(sessionID string, now time.Time) (string, time.Time) {
+	expiresAt := now.Add(s.ttl).Truncate(time.Second)
+	exp := strconv.FormatInt(expiresAt.Unix(), 10)
+	key := s.keys[0]
+	return key.id + "." + exp + "." + key.mac(sessionSigningInput(sessionID, exp)), expiresAt
+}
+
+// verify checks that token was issued for the session and hasn't expired
+func (s *sessionSigner) verify(sessionID, token string, now time.Time) error {
+	if token == "" {
+		return errMissingSessionToken
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errInvalidSessionToken
+	}
+	kid, exp, signature := parts[0], parts[1], parts[2]
+	expiresAt, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return errInvalidSessionToken
+	}
+	// A token signed with a secret that has been retired is invalid
+	key, ok := lookupKey(s.keys, kid)
+	if !ok || !key.verify(sessionSigningInput(sessionID, exp), signature) {
+		return errInvalidSessionToken
+	}
+	if now.Unix() >= expiresAt {
+		return errExpiredSessionToken
+	}
+	return nil
+}
+
+func sessionSigningInput(sessionID, exp string) string {
+	return "deposit-session:" + sessionID + "." + exp
+}
+
+// sessionToken returns the token a request presents, from the URL or a header
+func sessionToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	return r.Header.Get(sessionTokenHeader)
+}
+
+// authorizeSession checks the request's deposit session token, replying with
+// a FORBIDDEN envelope if it isn't valid for the session
+func (g *Gateway) authorizeSession(w http.ResponseWriter, r *http.Request, sessionID string) bool {
+	signer := g.state.Load().sessions
+	if signer == nil {
+		return true
+	}
+	if err := signer.verify(sessionID, sessionToken(r), time.Now()); err != nil {
+		slog.WarnContext(r.Context(), "Forbidden: invalid deposit session token", "method", r.Method, "path", r.URL.Path, "error", err)
+		g.sendResponse(w, http.StatusForbidden, nil, &ErrorInfo{
+			Code:    "FORBIDDEN",
+			Message: err.Error(),
+		})
+		return false
+	}
+	return true
+}
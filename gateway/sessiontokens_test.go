@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testSessionSecret         = "session-secret-that-is-at-least-32-chars"
+	testPreviousSessionSecret = "previous-session-secret-of-32-chars-or-more"
+)
+
+func TestSessionTokenSignVerify(t *testing.T) {
+	signer := newSessionSigner(&DepositSessionsConfig{Secrets: []string{testSessionSecret}, TokenTTL: Duration(time.Hour)})
+	now := time.Now()
+	token, expiresAt := signer.sign("session-1", now)
+	if want := now.Add(time.Hour).Truncate(time.Second); !expiresAt.Equal(want) {
+		t.Errorf("expiresAt = %v, want %v", expiresAt, want)
+	}
+
+	if err := signer.verify("session-1", token, now); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + parts[1] + "." + strings.Repeat("A", len(parts[2]))
+	// Moving the expiry invalidates the signature
+	extended := parts[0] + ".9999999999." + parts[2]
+
+	tests := []struct {
+		name      string
+		sessionID string
+		token     string
+		now       time.Time
+		want      error
+	}{
+		{"missing token", "session-1", "", now, errMissingSessionToken},
+		{"other session", "session-2", token, now, errInvalidSessionToken},
+		{"tampered signature", "session-1", tampered, now, errInvalidSessionToken},
+		{"extended expiry", "session-1", extended, now, errInvalidSessionToken},
+		{"malformed", "session-1", "not-a-token", now, errInvalidSessionToken},
+		{"non-numeric expiry", "session-1", parts[0] + ".soon." + parts[2], now, errInvalidSessionToken},
+		{"just before expiry", "session-1", token, expiresAt.Add(-time.Second), nil},
+		{"at expiry", "session-1", token, expiresAt, errExpiredSessionToken},
+	}
+	for _, tt := range tests {
+		if err := signer.verify(tt.sessionID, tt.token, tt.now); err != tt.want {
+			t.Errorf("%s: verify = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestSessionTokenDefaultTTL(t *testing.T) {
+	signer := newSessionSigner(&DepositSessionsConfig{Secrets: []string{testSessionSecret}})
+	now := time.Now()
+	if _, expiresAt := signer.sign("session-1", now); expiresAt.Sub(now) <= 23*time.Hour {
+		t.Errorf("token expires after %v, want %v", expiresAt.Sub(now), defaultSessionTokenTTL)
+	}
+}
+
+func TestSessionTokenRotation(t *testing.T) {
+	now := time.Now()
+	old := newSessionSigner(&DepositSessionsConfig{Secrets: []string{testPreviousSessionSecret}})
+	oldToken, _ := old.sign("session-1", now)
+
+	// The new secret signs, the previous one is still accepted
+	rotated := newSessionSigner(&DepositSessionsConfig{Secrets: []string{testSessionSecret, "", testPreviousSessionSecret}})
+	if err := rotated.verify("session-1", oldToken, now); err != nil {
+		t.Fatalf("token of the previous secret: %v", err)
+	}
+	newToken, _ := rotated.sign("session-1", now)
+	if strings.Split(newToken, ".")[0] == strings.Split(oldToken, ".")[0] {
+		t.Error("new tokens are signed with the previous secret")
+	}
+	if err := old.verify("session-1", newToken, now); err != errInvalidSessionToken {
+		t.Errorf("new token under the old keyring = %v", err)
+	}
+
+	// Once the previous secret is dropped its tokens are refused
+	retired := newSessionSigner(&DepositSessionsConfig{Secrets: []string{testSessionSecret}})
+	if err := retired.verify("session-1", oldToken, now); err != errInvalidSessionToken {
+		t.Errorf("token of a retired secret = %v, want %v", err, errInvalidSessionToken)
+	}
+}
+
+func TestSessionTokenFromRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/gw/v1/deposit-sessions/s1?token=from-query", nil)
+	r.Header.Set(sessionTokenHeader, "from-header")
+	if got := sessionToken(r); got != "from-query" {
+		t.Errorf("sessionToken = %q, want the query token", got)
+	}
+	r = httptest.NewRequest("GET", "/api/gw/v1/deposit-sessions/s1", nil)
+	r.Header.Set(sessionTokenHeader, "from-header")
+	if got := sessionToken(r); got != "from-header" {
+		t.Errorf("sessionToken = %q, want the header token", got)
+	}
+}
+
+func TestBackendDepositSessionPathsDenied(t *testing.T) {
+	g := newTestGateway(t, string(defaultConfigYAML))
+	routes := g.state.Load().routes
+	for _, path := range []string{
+		"/api/api/v1/deposit-sessions",
+		"/api/api/v1/deposit-sessions/session-1",
+		"/api/api/v1/deposit-sessions/session-1/checkout",
+		"/api/api/v1/Deposit-Sessions/session-1/complete",
+	} {
+		if route := routes.match("POST", path); route == nil || route.Name != "backend-denied" {
+			t.Errorf("%s is routed to %v", path, route)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/api/api/v1/deposit-sessions/session-1/complete", nil)
+	if w := serveGateway(g, r); w.Code != http.StatusForbidden {
+		t.Errorf("POST .../complete = %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// Shortest secret accepted for signing tokens
+const minSigningSecretLength = 32
+
+// signingKey is one secret of a keyring used to sign tokens the gateway
+// hands out and later verifies
+type signingKey struct {
+	id     string
+	secret []byte
+}
+
+// newKeyring builds a keyring from configured secrets. The first secret
+// signs new tokens; tokens signed with any of them are accepted, so a secret
+// can be rotated by adding the new one in front and removing the old one
+// once its tokens have expired. Empty entries (unset environment variables)
+// are skipped.
+func newKeyring(secrets []string) []signingKey {
+	var keys []signingKey
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		// The key ID names the secret without revealing it
+		sum := sha256.Sum256([]byte(secret))
+		keys = append(keys, signingKey{
+			id:     base64.RawURLEncoding.EncodeToString(sum[:6]),
+			secret: []byte(secret),
+		})
+	}
+	return keys
+}
+
+// lookupKey returns the key with the given ID, if it is still configured
+func lookupKey(keys []signingKey, id string) (signingKey, bool) {
+	for _, key := range keys {
+		if key.id == id {
+			return key, true
+		}
+	}
+	return signingKey{}, false
+}
+
+// mac returns the base64url HMAC-SHA256 of data
+func (k signingKey) mac(data string) string {
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks a signature made with mac in constant time
+func (k signingKey) verify(data, signature string) bool {
+	return hmac.Equal([]byte(k.mac(data)), []byte(signature))
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// W3C Trace Context headers (https://www.w3.org/TR/trace-context/)
+const (
+	traceparentHeader = "traceparent"
+	tracestateHeader  = "tracestate"
+)
+
+// traceContext reads and writes the W3C Trace Context headers
+var traceContext = propagation.TraceContext{}
+
+// tracer creates spans with the OpenTelemetry SDK, which batches the sampled
+// ones to the OTLP exporter. Spans are queued without blocking requests;
+// when the exporter can't keep up, they are dropped.
+type tracer struct {
+	config   TracingConfig
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+func newTracer(cfg TracingConfig) (*tracer, error) {
+	exporter, err := newExporter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	service := cfg.ServiceName
+	if service == "" {
+		service = defaultTracingServiceName
+	}
+	ratio := 1.0
+	if cfg.SampleRatio != nil {
+		ratio = *cfg.SampleRatio
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter,
+			sdktrace.WithMaxQueueSize(otlpQueueSize),
+			sdktrace.WithMaxExportBatchSize(otlpBatchSize),
+			sdktrace.WithBatchTimeout(otlpFlushInterval),
+			sdktrace.WithExportTimeout(otlpExportTimeout),
+		),
+		// Traces started by a caller keep the caller's decision
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))),
+	)
+	return &tracer{config: cfg, provider: provider, tracer: provider.Tracer("gateway")}, nil
+}
+
+// tracer returns the tracer for cfg, keeping the running one when the
+// tracing settings didn't change. A replaced tracer flushes what it has
+// queued and stops.
+func (g *Gateway) tracer(cfg *TracingConfig) *tracer {
+	g.tracingMu.Lock()
+	defer g.tracingMu.Unlock()
+
+	if g.tracing != nil && cfg.enabled() && reflect.DeepEqual(g.tracing.config, *cfg) {
+		return g.tracing
+	}
+	if g.tracing != nil {
+		go g.tracing.shutdown()
+		g.tracing = nil
+	}
+	if cfg.enabled() {
+		t, err := newTracer(*cfg)
+		if err != nil {
+			slog.Error("Tracing disabled", "error", err)
+			return nil
+		}
+		g.tracing = t
+	}
+	return g.tracing
+}
+
+// shutdown exports the queued spans and stops the tracer
+func (t *tracer) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), otlpExportTimeout)
+	defer cancel()
+	t.provider.Shutdown(ctx)
+}
+
+// span is one operation of a trace: the handling of an inbound request or
+// one attempt of an upstream call. Unsampled spans still carry IDs so the
+// trace context can be propagated, but record nothing.
+type span struct {
+	tracer *tracer
+	span   trace.Span
+	method string
+}
+
+// startServerSpan starts the span of an inbound request, continuing the
+// caller's trace when it sent a valid traceparent
+func (t *tracer) startServerSpan(r *http.Request) *span {
+	ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	_, s := t.tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer))
+	return &span{tracer: t, span: s, method: r.Method}
+}
+
+// startChild starts a span in the same trace as s
+func (s *span) startChild(method string, kind trace.SpanKind) *span {
+	if s == nil {
+		return nil
+	}
+	ctx := trace.ContextWithSpan(context.Background(), s.span)
+	_, child := s.tracer.tracer.Start(ctx, method, trace.WithSpanKind(kind))
+	return &span{tracer: s.tracer, span: child, method: method}
+}
+
+// sampled reports whether the span is recorded and exported
+func (s *span) sampled() bool {
+	return s.span.SpanContext().IsSampled()
+}
+
+// traceID returns the span's trace ID in hex
+func (s *span) traceID() string {
+	return s.span.SpanContext().TraceID().String()
+}
+
+// setAttr sets an attribute of a sampled span; value is a string, int or
+// bool
+func (s *span) setAttr(key string, value interface{}) {
+	if s == nil || !s.span.IsRecording() {
+		return
+	}
+	switch v := value.(type) {
+	case int:
+		s.span.SetAttributes(attribute.Int(key, v))
+	case bool:
+		s.span.SetAttributes(attribute.Bool(key, v))
+	default:
+		s.span.SetAttributes(attribute.String(key, fmt.Sprint(v)))
+	}
+}
+
+// setRoute names a server span after the template of the route that
+// matched, e.g. "GET /api/gw/v1/cart/items/{lineId}"
+func (s *span) setRoute(template string) {
+	if s == nil {
+		return
+	}
+	s.span.SetName(s.method + " " + template)
+	s.setAttr("http.route", template)
+}
+
+// setError marks the span as failed
+func (s *span) setError(message string) {
+	if s == nil {
+		return
+	}
+	s.span.SetStatus(codes.Error, message)
+}
+
+// finish ends the span, queueing it for export if it is sampled
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.span.End()
+}
+
+type spanContextKey struct{}
+
+// withSpan stores the request's server span on its context
+func withSpan(r *http.Request, s *span) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), spanContextKey{}, s))
+}
+
+// spanFromContext returns the server span of the request, or nil when
+// tracing is off
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+// tracingMiddleware records a server span for every request. It runs right
+// after requestIDMiddleware so the span covers everything else.
+func (g *Gateway) tracingMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := g.state.Load().tracer
+		if t == nil {
+			next(w, r)
+			return
+		}
+
+		s := t.startServerSpan(r)
+		s.setAttr("http.request.method", r.Method)
+		s.setAttr("url.path", r.URL.Path)
+		s.setAttr("client.address", getClientIP(r))
+		if ua := r.UserAgent(); ua != "" {
+			s.setAttr("user_agent.original", ua)
+		}
+		s.setAttr("gateway.request_id", requestID(r))
+
+		ww := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		// Deferred so spans of requests aborted mid-response are exported
+		defer func() {
+			s.setAttr("http.response.status_code", ww.statusCode)
+			if ww.statusCode >= 500 {
+				s.setAttr("error.type", strconv.Itoa(ww.statusCode))
+				s.setError("")
+			}
+			s.finish()
+		}()
+		next(ww, withSpan(r, s))
+	}
+}
+
+// startUpstreamSpan starts the client span of one attempt of an upstream
+// call and sends its trace context with the request. Without tracing, the
+// caller's trace context is forwarded unchanged.
+func startUpstreamSpan(r, req *http.Request, upstream string, attempt int) *span {
+	s := spanFromContext(r.Context()).startChild(req.Method, trace.SpanKindClient)
+	if s == nil {
+		for _, name := range []string{traceparentHeader, tracestateHeader} {
+			if value := r.Header.Get(name); value != "" {
+				req.Header.Set(name, value)
+			}
+		}
+		return nil
+	}
+
+	req.Header.Del(traceparentHeader)
+	req.Header.Del(tracestateHeader)
+	traceContext.Inject(trace.ContextWithSpan(r.Context(), s.span), propagation.HeaderCarrier(req.Header))
+
+	s.setAttr("http.request.method", req.Method)
+	// The query is left out: it can carry API keys and session tokens
+	s.setAttr("url.full", req.URL.Scheme+"://"+req.URL.Host+req.URL.EscapedPath())
+	s.setAttr("server.address", req.URL.Hostname())
+	if port, err := strconv.Atoi(req.URL.Port()); err == nil {
+		s.setAttr("server.port", port)
+	} else if req.URL.Scheme == "https" {
+		s.setAttr("server.port", 443)
+	} else {
+		s.setAttr("server.port", 80)
+	}
+	s.setAttr("peer.service", upstream)
+	if attempt > 1 {
+		s.setAttr("http.request.resend_count", attempt-1)
+	}
+	return s
+}
+
+// finishUpstreamSpan records the outcome of an upstream call attempt
+func finishUpstreamSpan(s *span, status int, err error) {
+	if s == nil {
+		return
+	}
+	switch {
+	case err != nil:
+		s.setAttr("error.type", reflect.TypeOf(err).String())
+		s.setError(err.Error())
+	case status >= 400:
+		s.setAttr("http.response.status_code", status)
+		s.setAttr("error.type", strconv.Itoa(status))
+		s.setError("")
+	default:
+		s.setAttr("http.response.status_code", status)
+	}
+	s.finish()
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeCollector keeps the spans of the OTLP export requests it receives,
+// over HTTP or gRPC, along with the service.name of their resource
+type fakeCollector struct {
+	coltracepb.UnimplementedTraceServiceServer
+
+	mu      sync.Mutex
+	spans   []*tracepb.Span
+	service string
+	auth    string
+}
+
+func (c *fakeCollector) add(req *coltracepb.ExportTraceServiceRequest, auth string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.auth = auth
+	for _, rs := range req.ResourceSpans {
+		for _, attr := range rs.Resource.GetAttributes() {
+			if attr.Key == "service.name" {
+				c.service = attr.Value.GetStringValue()
+			}
+		}
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+}
+
+func (c *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+		http.Error(w, "unexpected export request", http.StatusBadRequest)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var req coltracepb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.add(&req, r.Header.Get("Authorization"))
+	resp, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(resp)
+}
+
+func (c *fakeCollector) Export(ctx context.Context, req *coltracepb.ExportTraceServiceRequest) (*coltracepb.ExportTraceServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	c.add(req, strings.Join(md.Get("authorization"), ","))
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+func (c *fakeCollector) received() ([]*tracepb.Span, string, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.spans, c.service, c.auth
+}
+
+// newTracingTestGateway proxies /api/ to a backend that records the trace
+// context it receives, exporting spans to endpoint over protocol
+func newTracingTestGateway(t *testing.T, endpoint, protocol string) (*Gateway, *http.Header) {
+	t.Helper()
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		io.WriteString(w, `{}`)
+	}))
+	t.Cleanup(backend.Close)
+
+	g := newTestGateway(t, `
+upstreams:
+  backend:
+    url: `+backend.URL+`
+tracing:
+  endpoint: `+endpoint+`
+  protocol: `+protocol+`
+  service_name: gateway-test
+  headers:
+    Authorization: Bearer otlp-token
+routes:
+  - name: backend
+    prefix: /api/
+    upstream: backend
+    strip_prefix: /api
+    auth: none
+`)
+	return g, &received
+}
+
+// flushSpans exports the spans the gateway's tracer has queued
+func flushSpans(t *testing.T, g *Gateway) {
+	t.Helper()
+	if err := g.state.Load().tracer.provider.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkTrace checks the server span of a proxied request and the client
+// span of its upstream call
+func checkTrace(t *testing.T, collector *fakeCollector, backendHeader http.Header) {
+	t.Helper()
+	spans, service, auth := collector.received()
+	if service != "gateway-test" {
+		t.Errorf("service.name = %q", service)
+	}
+	if auth != "Bearer otlp-token" {
+		t.Errorf("export Authorization = %q", auth)
+	}
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+	var server, client *tracepb.Span
+	for _, s := range spans {
+		switch s.Kind {
+		case tracepb.Span_SPAN_KIND_SERVER:
+			server = s
+		case tracepb.Span_SPAN_KIND_CLIENT:
+			client = s
+		}
+	}
+	if server == nil || client == nil {
+		t.Fatalf("span kinds = %v, %v", spans[0].Kind, spans[1].Kind)
+	}
+
+	if !strings.HasPrefix(server.Name, "GET /api/") {
+		t.Errorf("server span name = %q", server.Name)
+	}
+	if got := spanAttr(server, "http.response.status_code"); got != "200" {
+		t.Errorf("server http.response.status_code = %q", got)
+	}
+	if got := spanAttr(server, "gateway.route"); got != "backend" {
+		t.Errorf("server gateway.route = %q", got)
+	}
+	if got := spanAttr(client, "peer.service"); got != "backend" {
+		t.Errorf("client peer.service = %q", got)
+	}
+	if string(client.TraceId) != string(server.TraceId) || string(client.ParentSpanId) != string(server.SpanId) {
+		t.Errorf("client span is not a child of the server span")
+	}
+
+	want := "00-" + hex.EncodeToString(client.TraceId) + "-" + hex.EncodeToString(client.SpanId) + "-01"
+	if got := backendHeader.Get(traceparentHeader); got != want {
+		t.Errorf("upstream traceparent = %q, want %q", got, want)
+	}
+}
+
+func spanAttr(s *tracepb.Span, key string) string {
+	for _, attr := range s.Attributes {
+		if attr.Key == key {
+			if v, ok := attr.Value.Value.(*commonpb.AnyValue_IntValue); ok {
+				return strconv.FormatInt(v.IntValue, 10)
+			}
+			return attr.Value.GetStringValue()
+		}
+	}
+	return ""
+}
+
+func TestTracingExportHTTP(t *testing.T) {
+	collector := &fakeCollector{}
+	srv := httptest.NewServer(collector)
+	defer srv.Close()
+	g, backendHeader := newTracingTestGateway(t, srv.URL, otlpProtocolProtobuf)
+
+	if w := serveGateway(g, httptest.NewRequest("GET", "/api/v1/products", nil)); w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	flushSpans(t, g)
+	checkTrace(t, collector, *backendHeader)
+}
+
+func TestTracingExportGRPC(t *testing.T) {
+	collector := &fakeCollector{}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	coltracepb.RegisterTraceServiceServer(srv, collector)
+	go srv.Serve(lis)
+	defer srv.Stop()
+	g, backendHeader := newTracingTestGateway(t, "http://"+lis.Addr().String(), otlpProtocolGRPC)
+
+	if w := serveGateway(g, httptest.NewRequest("GET", "/api/v1/products", nil)); w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	flushSpans(t, g)
+	checkTrace(t, collector, *backendHeader)
+}
+
+func TestTracingCallerTraceContext(t *testing.T) {
+	const (
+		traceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentID = "00f067aa0ba902b7"
+	)
+	collector := &fakeCollector{}
+	srv := httptest.NewServer(collector)
+	defer srv.Close()
+	g, backendHeader := newTracingTestGateway(t, srv.URL, otlpProtocolProtobuf)
+
+	// A sampled caller trace is continued, with its tracestate
+	r := httptest.NewRequest("GET", "/api/v1/products", nil)
+	r.Header.Set(traceparentHeader, "00-"+traceID+"-"+parentID+"-01")
+	r.Header.Set(tracestateHeader, "vendor=value")
+	serveGateway(g, r)
+	flushSpans(t, g)
+	spans, _, _ := collector.received()
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+	for _, s := range spans {
+		if hex.EncodeToString(s.TraceId) != traceID {
+			t.Errorf("span %q trace ID = %x", s.Name, s.TraceId)
+		}
+		if s.Kind == tracepb.Span_SPAN_KIND_SERVER && hex.EncodeToString(s.ParentSpanId) != parentID {
+			t.Errorf("server span parent = %x", s.ParentSpanId)
+		}
+	}
+	if got := backendHeader.Get(tracestateHeader); got != "vendor=value" {
+		t.Errorf("upstream tracestate = %q", got)
+	}
+
+	// An unsampled one is propagated but not recorded
+	r = httptest.NewRequest("GET", "/api/v1/products", nil)
+	r.Header.Set(traceparentHeader, "00-"+traceID+"-"+parentID+"-00")
+	serveGateway(g, r)
+	flushSpans(t, g)
+	if spans, _, _ := collector.received(); len(spans) != 2 {
+		t.Errorf("unsampled request exported %d spans", len(spans)-2)
+	}
+	got := backendHeader.Get(traceparentHeader)
+	if !strings.HasPrefix(got, "00-"+traceID+"-") || !strings.HasSuffix(got, "-00") || strings.Contains(got, parentID) {
+		t.Errorf("unsampled upstream traceparent = %q", got)
+	}
+}
+
+func TestTracingSampleRatioZero(t *testing.T) {
+	collector := &fakeCollector{}
+	srv := httptest.NewServer(collector)
+	defer srv.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	g := newTestGateway(t, `
+upstreams:
+  backend:
+    url: `+backend.URL+`
+tracing:
+  endpoint: `+srv.URL+`
+  sample_ratio: 0
+routes:
+  - name: backend
+    prefix: /api/
+    upstream: backend
+    auth: none
+`)
+
+	serveGateway(g, httptest.NewRequest("GET", "/api/v1/products", nil))
+	flushSpans(t, g)
+	if spans, _, _ := collector.received(); len(spans) != 0 {
+		t.Errorf("exported %d spans at sample_ratio 0", len(spans))
+	}
+}
+
+func TestTracingProtocolValidation(t *testing.T) {
+	tests := []struct {
+		protocol string
+		ok       bool
+	}{
+		{"", true},
+		{"http/protobuf", true},
+		{"grpc", true},
+		{"http/json", false},
+		{"zipkin", false},
+	}
+	for _, tt := range tests {
+		cfg := &Config{
+			Upstreams: map[string]UpstreamConfig{"backend": {URL: "http://localhost:3001"}},
+			Routes:    []RouteConfig{{Name: "backend", Prefix: "/", Upstream: "backend"}},
+			Tracing:   &TracingConfig{Endpoint: "http://localhost:4317", Protocol: tt.protocol},
+		}
+		if err := cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("protocol %q: Validate = %v", tt.protocol, err)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Load balancing strategies an upstream can use
+const (
+	balancerRoundRobin       = "round_robin"
+	balancerLeastConnections = "least_connections"
+	balancerConsistentHash   = "consistent_hash"
+)
+
+// Number of points each target gets on the consistent hash ring
+const hashRingReplicas = 160
+
+// upstreamTarget is one instance of an upstream service
+type upstreamTarget struct {
+	url    string
+	active int64 // requests currently in flight
+	health targetHealth
+}
+
+// upstreamPool is the set of instances serving one upstream service
+type upstreamPool struct {
+	name        string
+	config      UpstreamConfig
+	targets     []*upstreamTarget
+	balancer    string
+	hashKey     string
+	next        uint64
+	ring        []ringPoint
+	healthCheck *HealthCheckConfig
+	passive     passivePolicy
+	breaker     *circuitBreaker
+	headers     *headerPolicy
+}
+
+type ringPoint struct {
+	hash   uint64
+	target *upstreamTarget
+}
+
+func newUpstreamPool(name string, cfg UpstreamConfig) *upstreamPool {
+	pool := &upstreamPool{
+		name:        name,
+		config:      cfg,
+		balancer:    cfg.Balancer,
+		hashKey:     cfg.HashKey,
+		healthCheck: cfg.HealthCheck,
+		passive:     newPassivePolicy(cfg.PassiveHealth),
+		breaker:     newCircuitBreaker(name, cfg.CircuitBreaker),
+		headers:     newHeaderPolicy(cfg.RequestHeaders),
+	}
+	if pool.balancer == "" {
+		pool.balancer = balancerRoundRobin
+	}
+
+	urls := cfg.Targets
+	if cfg.URL != "" {
+		urls = append([]string{cfg.URL}, urls...)
+	}
+	for _, u := range urls {
+		target := &upstreamTarget{url: strings.TrimSuffix(u, "/")}
+		target.health.probeHealthy = true
+		pool.targets = append(pool.targets, target)
+	}
+
+	if pool.balancer == balancerConsistentHash {
+		for _, t := range pool.targets {
+			for i := 0; i < hashRingReplicas; i++ {
+				pool.ring = append(pool.ring, ringPoint{hash: hashString(fmt.Sprintf("%s#%d", t.url, i)), target: t})
+			}
+		}
+		sort.Slice(pool.ring, func(i, j int) bool { return pool.ring[i].hash < pool.ring[j].hash })
+	}
+	return pool
+}
+
+// describe renders the pool for the startup log
+func (p *upstreamPool) describe() string {
+	urls := make([]string, len(p.targets))
+	for i, t := range p.targets {
+		urls[i] = t.url
+	}
+	if len(urls) == 1 {
+		return urls[0]
+	}
+	desc := strings.Join(urls, ", ") + " (" + p.balancer
+	if p.balancer == balancerConsistentHash {
+		desc += " on " + p.hashKey
+	}
+	return desc + ")"
+}
+
+// pick selects the target for a request, skipping targets that are
+// ejected or failing health checks. key is only used by the consistent
+// hash balancer; requests without a key are spread round-robin. If no
+// target is available every target is considered, since refusing all
+// traffic would be worse than trying a possibly unhealthy instance.
+func (p *upstreamPool) pick(key string) *upstreamTarget {
+	if len(p.targets) == 1 {
+		return p.targets[0]
+	}
+
+	now := time.Now()
+	usable := func(t *upstreamTarget) bool { return t.available(now) }
+	if !p.anyAvailable(now) {
+		usable = func(*upstreamTarget) bool { return true }
+	}
+
+	switch p.balancer {
+	case balancerConsistentHash:
+		if key != "" {
+			return p.pickHashed(key, usable)
+		}
+	case balancerLeastConnections:
+		return p.pickLeastConnections(usable)
+	}
+	return p.pickRoundRobin(usable)
+}
+
+func (p *upstreamPool) anyAvailable(now time.Time) bool {
+	for _, t := range p.targets {
+		if t.available(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *upstreamPool) pickRoundRobin(usable func(*upstreamTarget) bool) *upstreamTarget {
+	start := atomic.AddUint64(&p.next, 1) - 1
+	for i := uint64(0); i < uint64(len(p.targets)); i++ {
+		if t := p.targets[(start+i)%uint64(len(p.targets))]; usable(t) {
+			return t
+		}
+	}
+	return p.targets[start%uint64(len(p.targets))]
+}
+
+func (p *upstreamPool) pickLeastConnections(usable func(*upstreamTarget) bool) *upstreamTarget {
+	// Start from a rotating offset so ties don't always go to the first target
+	start := int(atomic.AddUint64(&p.next, 1) % uint64(len(p.targets)))
+	var best *upstreamTarget
+	for i := range p.targets {
+		t := p.targets[(start+i)%len(p.targets)]
+		if !usable(t) {
+			continue
+		}
+		if best == nil || t.inFlight() < best.inFlight() {
+			best = t
+		}
+	}
+	return best
+}
+
+// pickHashed walks the ring clockwise from the key's position to the first
+// usable target, so only the carts of an ejected target move elsewhere
+func (p *upstreamPool) pickHashed(key string, usable func(*upstreamTarget) bool) *upstreamTarget {
+	h := hashString(key)
+	start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+	for i := 0; i < len(p.ring); i++ {
+		if t := p.ring[(start+i)%len(p.ring)].target; usable(t) {
+			return t
+		}
+	}
+	return p.ring[start%len(p.ring)].target
+}
+
+// hashString hashes s for ring placement. FNV alone distributes short,
+// similar keys like cart IDs poorly, so its output goes through the
+// murmur3 finalizer to spread them across the ring.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// balancerKey returns the value the pool hashes on for a request: a
+// request attribute set by the typed handlers, a path parameter or a
+// query parameter named by the pool's hash_key
+func (p *upstreamPool) balancerKey(r *http.Request) string {
+	if p.hashKey == "" {
+		return ""
+	}
+	if v := requestAttr(r, p.hashKey); v != "" {
+		return v
+	}
+	if v := pathParam(r, p.hashKey); v != "" {
+		return v
+	}
+	return r.URL.Query().Get(p.hashKey)
+}
+
+// inFlight returns the number of requests currently proxied to the target
+func (t *upstreamTarget) inFlight() int64 {
+	return atomic.LoadInt64(&t.active)
+}
+
+// acquire marks a request as in flight on the target; the returned
+// function must be called once the response has been consumed
+func (t *upstreamTarget) acquire() func() {
+	atomic.AddInt64(&t.active, 1)
+	var released int32
+	return func() {
+		if atomic.CompareAndSwapInt32(&released, 0, 1) {
+			atomic.AddInt64(&t.active, -1)
+		}
+	}
+}
+
+// releasingBody releases the target's in-flight slot when the response body is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
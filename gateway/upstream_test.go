@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestPool(balancer string, targets ...string) *upstreamPool {
+	return newUpstreamPool("backend", UpstreamConfig{Targets: targets, Balancer: balancer, HashKey: "cartId"})
+}
+
+// eject takes a target out of rotation for a minute
+func eject(t *upstreamTarget) {
+	t.health.mu.Lock()
+	t.health.ejectedUntil = time.Now().Add(time.Minute)
+	t.health.mu.Unlock()
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	pool := newTestPool(balancerRoundRobin, "http://a", "http://b", "http://c")
+
+	var picked []string
+	for i := 0; i < 6; i++ {
+		picked = append(picked, pool.pick("").url)
+	}
+	if got := strings.Join(picked, " "); got != "http://a http://b http://c http://a http://b http://c" {
+		t.Errorf("picks = %s", got)
+	}
+
+	// Unavailable targets are skipped
+	eject(pool.targets[1])
+	pool.targets[2].health.probeHealthy = false
+	for i := 0; i < 4; i++ {
+		if got := pool.pick("").url; got != "http://a" {
+			t.Fatalf("pick with b and c out = %s", got)
+		}
+	}
+
+	// With none available, every target is tried again
+	eject(pool.targets[0])
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		seen[pool.pick("").url] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("picks with no target available = %v", seen)
+	}
+}
+
+func TestLeastConnectionsBalancer(t *testing.T) {
+	pool := newTestPool(balancerLeastConnections, "http://a", "http://b", "http://c")
+
+	// Ties rotate
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		seen[pool.pick("").url] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("picks among idle targets = %v", seen)
+	}
+
+	releaseA1 := pool.targets[0].acquire()
+	pool.targets[0].acquire()
+	pool.targets[2].acquire()
+	for i := 0; i < 3; i++ {
+		if got := pool.pick("").url; got != "http://b" {
+			t.Fatalf("pick = %s, want the idle target", got)
+		}
+	}
+
+	// An unavailable target isn't picked however idle it is
+	eject(pool.targets[1])
+	if got := pool.pick("").url; got != "http://c" {
+		t.Errorf("pick with b ejected = %s", got)
+	}
+
+	// Releasing twice frees one slot only
+	releaseA1()
+	releaseA1()
+	if n := pool.targets[0].inFlight(); n != 1 {
+		t.Errorf("in flight on a = %d", n)
+	}
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	pool := newTestPool(balancerConsistentHash, "http://a", "http://b", "http://c")
+
+	before := map[string]string{}
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("cart-%d", i)
+		before[key] = pool.pick(key).url
+		counts[before[key]]++
+		if again := pool.pick(key).url; again != before[key] {
+			t.Fatalf("%s picked %s then %s", key, before[key], again)
+		}
+	}
+	for url, n := range counts {
+		if n < 700 || n > 1300 {
+			t.Errorf("%s got %d of 3000 keys", url, n)
+		}
+	}
+
+	// Ejecting a target moves its keys only
+	eject(pool.targets[1])
+	for key, url := range before {
+		got := pool.pick(key).url
+		switch {
+		case url == "http://b" && got == "http://b":
+			t.Fatalf("%s still on the ejected target", key)
+		case url != "http://b" && got != url:
+			t.Fatalf("%s moved from %s to %s", key, url, got)
+		}
+	}
+
+	// Requests without a key are spread round-robin
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		seen[pool.pick("").url] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("picks without a key = %v", seen)
+	}
+}
+
+func TestSingleTargetPool(t *testing.T) {
+	pool := newUpstreamPool("backend", UpstreamConfig{URL: "http://a/"})
+	eject(pool.targets[0])
+	if got := pool.pick("cart-1").url; got != "http://a" {
+		t.Errorf("pick = %s", got)
+	}
+	if got := pool.describe(); got != "http://a" {
+		t.Errorf("describe = %s", got)
+	}
+	if got := newTestPool(balancerConsistentHash, "http://a", "http://b").describe(); got != "http://a, http://b (consistent_hash on cartId)" {
+		t.Errorf("describe = %s", got)
+	}
+}
+
+func TestBalancerKey(t *testing.T) {
+	pool := newTestPool(balancerConsistentHash, "http://a", "http://b")
+
+	r := httptest.NewRequest("GET", "/cart?cartId=from-query", nil)
+	if got := pool.balancerKey(r); got != "from-query" {
+		t.Errorf("query key = %q", got)
+	}
+	r = withPathParams(r, "/carts/{cartId}", map[string]string{"cartId": "from-path"})
+	if got := pool.balancerKey(r); got != "from-path" {
+		t.Errorf("path key = %q", got)
+	}
+	r = withRequestAttrs(r)
+	setRequestAttr(r, "cartId", "from-handler")
+	if got := pool.balancerKey(r); got != "from-handler" {
+		t.Errorf("attribute key = %q", got)
+	}
+
+	// Without hash_key there is nothing to hash on
+	plain := newUpstreamPool("backend", UpstreamConfig{Targets: []string{"http://a", "http://b"}})
+	if got := plain.balancerKey(r); got != "" {
+		t.Errorf("key without hash_key = %q", got)
+	}
+}
+
+func TestReleasingBody(t *testing.T) {
+	target := &upstreamTarget{url: "http://a"}
+	body := &releasingBody{ReadCloser: io.NopCloser(strings.NewReader("ok")), release: target.acquire()}
+	if n := target.inFlight(); n != 1 {
+		t.Fatalf("in flight = %d", n)
+	}
+	body.Close()
+	body.Close()
+	if n := target.inFlight(); n != 0 {
+		t.Errorf("in flight after close = %d", n)
+	}
+}
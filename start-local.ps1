@@ -44,7 +44,7 @@ Set-Location gateway
 if ($goInstalled) {
     # Build and run with Go
     Write-Host "Building Gateway..." -ForegroundColor Cyan
-    go build -o gateway.exe main.go
+    go build -o gateway.exe .
     
     # Create .env if it doesn't exist
     if (-not (Test-Path ".env")) {